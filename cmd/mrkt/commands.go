@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/db"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/term"
+	validator "gopkg.in/go-playground/validator.v9"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// changes made with the CLI are audited as the system
+var systemActor = models.AuditActor{Type: "system"}
+
+func createAdmin(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	email := flags.String("email", "", "email address to log in with (required)")
+	username := flags.String("username", "", "username (required)")
+	role := flags.String("role", constants.ADMIN_ROLE_SUPER, "admin role: "+strings.Join(constants.AdminRoles, " or "))
+	_, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *email == "" || *username == "" {
+		flags.Usage()
+		return errors.New("email and username are required")
+	}
+	if err := validator.New().Var(*email, "email"); err != nil {
+		return errors.New("the email address is invalid")
+	}
+	if !slices.Contains(constants.AdminRoles, *role) {
+		return fmt.Errorf("the role must be %s", strings.Join(constants.AdminRoles, " or "))
+	}
+
+	// read rather than passed as a flag, so it doesn't end up in the
+	// shell's history
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	user := models.GetDefaultUser()
+	user.Email = *email
+	user.Username = *username
+	user.Password = password
+	user.IsAdmin = true
+	user.AdminRole = *role
+
+	// the same rules as signing up
+	if err := validator.New().StructPartial(user, "Password"); err != nil {
+		return errors.New("the password must be at least 8 characters long")
+	}
+
+	if _, err := h.CreateUser(ctx, user); err != nil {
+		return err
+	}
+
+	audit(ctx, h, "create-admin", "user.create", "users", user.ID.Hex(), nil, user)
+
+	fmt.Printf("Created admin %s (%s).\n", user.Email, user.ID.Hex())
+	if h.AdminTwoFactorRequired() {
+		fmt.Println("They will be asked to set up two-factor authentication when they first log in.")
+	}
+	return nil
+}
+
+// readPassword asks for a password on the terminal, without echoing it. If
+// stdin isn't a terminal, e.g. when the password is piped in, its first line
+// is read instead.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+func seed(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	file := flags.String("file", "./seed_entries.geojson", "GeoJSON file of sample entries")
+	_, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	created, err := h.AlertTypes().SeedAlertTypes(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %d alert types.\n", created)
+
+	return runImport(ctx, h, *file, "seed", handlers.ImportOptions{Format: constants.IMPORT_FORMAT_GEOJSON})
+}
+
+func importEntries(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	file := flags.String("file", "", "CSV or GeoJSON file to import (required)")
+	format := flags.String("format", "", "csv or geojson. Worked out from the file name by default")
+	mapping := flags.String("mapping", "", `JSON object of entry fields to the columns they are read from, e.g. {"title": "Incident"}`)
+	dryRun := flags.Bool("dry-run", false, "check the file without saving anything")
+	_, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *file == "" {
+		flags.Usage()
+		return errors.New("a file is required")
+	}
+
+	opts := handlers.ImportOptions{Format: *format, DryRun: *dryRun}
+
+	if opts.Format == "" {
+		switch strings.ToLower(filepath.Ext(*file)) {
+		case ".csv":
+			opts.Format = constants.IMPORT_FORMAT_CSV
+		case ".geojson", ".json":
+			opts.Format = constants.IMPORT_FORMAT_GEOJSON
+		}
+	}
+	if !handlers.IsImportFormat(opts.Format) {
+		return errors.New("the format must be csv or geojson")
+	}
+
+	if *mapping != "" {
+		if err := json.Unmarshal([]byte(*mapping), &opts.Mapping); err != nil {
+			return fmt.Errorf("the mapping must be a JSON object: %v", err)
+		}
+	}
+
+	return runImport(ctx, h, *file, "import", opts)
+}
+
+// runImport imports a file and prints what went wrong with each row.
+func runImport(ctx context.Context, h *handlers.Handlers, path, name string, opts handlers.ImportOptions) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	opts.ImportedBy = systemActor
+
+	report, err := h.ImportEntries(ctx, file, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range report.Rows {
+		for _, msg := range row.Errors {
+			fmt.Printf("row %d: error: %s\n", row.Row, msg)
+		}
+		for _, msg := range row.Warnings {
+			fmt.Printf("row %d: warning: %s\n", row.Row, msg)
+		}
+	}
+
+	if report.DryRun {
+		fmt.Printf("Dry run: %d of %d rows would be imported.\n", report.Imported, report.Total)
+		return nil
+	}
+
+	fmt.Printf("Imported %d of %d rows.\n", report.Imported, report.Total)
+
+	if report.Imported > 0 {
+		summary := bson.M{"format": opts.Format, "file": filepath.Base(path), "imported": report.Imported, "failed": report.Failed}
+		audit(ctx, h, name, "entry.import", "entries", "", nil, summary)
+	}
+	return nil
+}
+
+func recomputeRankings(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	_, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	ranked, err := h.RecomputeRankings(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Ranked %d users.\n", ranked)
+	return nil
+}
+
+func rebuildIndexes(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	drop := flags.Bool("drop", false, "drop the indexes first, so they are built from scratch")
+	if _, _, err := parseAndConnect(flags, args); err != nil {
+		return err
+	}
+
+	if err := db.RebuildIndexes(ctx, *drop); err != nil {
+		return err
+	}
+
+	fmt.Println("Indexes are up to date.")
+	return nil
+}
+
+func migrate(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	to := flags.Int("to", -1, "version to migrate to, reverting newer migrations. The latest by default")
+	status := flags.Bool("status", false, "list the migrations and whether they have been applied, without changing anything")
+	if _, _, err := parseAndConnect(flags, args); err != nil {
+		return err
+	}
+
+	if *status {
+		statuses, err := db.MigrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = "applied " + s.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-28s  %s\n", s.Version, applied, s.Description)
+		}
+		return nil
+	}
+
+	version := *to
+	if version < 0 {
+		version = db.LatestVersion()
+	}
+	done, err := db.MigrateTo(ctx, version)
+	for _, m := range done {
+		action := "Applied"
+		if m.Version > version {
+			action = "Reverted"
+		}
+		fmt.Printf("%s %d: %s\n", action, m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The database is at version %d.\n", version)
+	return nil
+}
+
+func exportEntries(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	format := flags.String("format", constants.EXPORT_FORMAT_GEOJSON, "geojson, csv or kml")
+	out := flags.String("out", "", "file to write to. Standard output by default")
+	from := flags.String("from", "", "only entries created from this date (YYYY-MM-DD)")
+	to := flags.String("to", "", "only entries created up to the end of this date (YYYY-MM-DD)")
+	alertType := flags.String("alert-type", "", "only entries of this alert type ID")
+	lat := flags.Float64("lat", 0, "latitude of the area to export")
+	lng := flags.Float64("lng", 0, "longitude of the area to export")
+	radius := flags.Float64("radius", 0, "radius of the area to export, in metres. The location ranking radius by default")
+	precision := flags.Int("precision", 0, "decimal places to round coordinates to, from 1 to 4, or 0 for exact coordinates")
+	cfg, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *radius <= 0 {
+		*radius = cfg.Location.Radius
+	}
+
+	if !handlers.IsExportFormat(*format) {
+		return errors.New("the format must be geojson, csv or kml")
+	}
+
+	var filter handlers.ExportFilter
+
+	if *from != "" {
+		if filter.From, err = time.Parse("2006-01-02", *from); err != nil {
+			return fmt.Errorf("invalid from date: %v", err)
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse("2006-01-02", *to); err != nil {
+			return fmt.Errorf("invalid to date: %v", err)
+		}
+		filter.To = filter.To.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	if *alertType != "" {
+		id, err := primitive.ObjectIDFromHex(*alertType)
+		if err != nil {
+			return fmt.Errorf("invalid alert type ID: %v", err)
+		}
+		filter.AlertType = &id
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "lat" || f.Name == "lng" {
+			filter.Near = &[2]float64{*lat, *lng}
+			filter.Radius = *radius
+		}
+	})
+
+	if *precision < 0 || *precision > 4 {
+		return errors.New("the precision must be from 0 to 4, where 0 means exact coordinates")
+	}
+	filter.Precision = *precision
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return h.ExportEntries(ctx, filter, *format, w)
+}
+
+func geocodeBackfill(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	limit := flags.Int64("limit", 0, "most entries to look up. All of them by default")
+	_, h, err := parseAndConnect(flags, args)
+	if err != nil {
+		return err
+	}
+
+	found, missing, err := h.BackfillAddresses(ctx, *limit)
+	fmt.Printf("Found %d addresses. %d could not be found.\n", found, missing)
+	return err
+}
+
+// audit records a change made with the CLI, the same way the API does.
+// Failing to record it doesn't undo the change, so it is only reported.
+func audit(ctx context.Context, h *handlers.Handlers, name, action, collection, targetID string, before, after interface{}) {
+	log := models.AuditLog{
+		Actor:      systemActor,
+		Action:     action,
+		Collection: collection,
+		TargetID:   targetID,
+		Route:      "mrkt " + name,
+	}
+	if err := h.RecordAudit(ctx, log, before, after); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record %s in the audit log: %v\n", action, err)
+	}
+}
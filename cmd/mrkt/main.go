@@ -0,0 +1,122 @@
+// Command mrkt runs operational tasks against the database the API uses,
+// like creating the first admin. It is configured the same way as the API.
+//
+// Usage:
+//
+//	mrkt <command> [flags]
+//
+// Run mrkt help to list the commands, or mrkt <command> -h for their flags.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/db"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/store"
+)
+
+type command struct {
+	summary string
+	run     func(ctx context.Context, flags *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"create-admin":       {"Create an admin user", createAdmin},
+	"seed":               {"Add the default alert types and sample entries", seed},
+	"import":             {"Import entries from a CSV or GeoJSON file", importEntries},
+	"recompute-rankings": {"Work out the top alpha and every user's rank again", recomputeRankings},
+	"rebuild-indexes":    {"Create the indexes of the applied migrations again", rebuildIndexes},
+	"migrate":            {"Apply or revert database migrations", migrate},
+	"export":             {"Export public entries as GeoJSON, CSV or KML", exportEntries},
+	"geocode-backfill":   {"Look up the addresses of entries that don't have one", geocodeBackfill},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		return
+	}
+
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "mrkt: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("mrkt "+name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s\n\nUsage of mrkt %s:\n", cmd.summary, name)
+		flags.PrintDefaults()
+	}
+
+	if err := runCommand(cmd, flags, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "mrkt %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs cmd until it is done or interrupted, then disconnects from
+// the database if the command connected to it. It is apart from main so that
+// happens before main exits, which would skip it.
+func runCommand(cmd command, flags *flag.FlagSet, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer disconnect()
+
+	return cmd.run(ctx, flags, args)
+}
+
+// disconnect waits for the database to finish what it was sent, but not for
+// longer than disconnectTimeout.
+func disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	if err := db.Disconnect(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "mrkt: disconnecting from the database: %v\n", err)
+	}
+}
+
+const disconnectTimeout = 10 * time.Second
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: mrkt <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, commands[name].summary)
+	}
+}
+
+// parseAndConnect parses a command's flags, then loads the config and
+// connects to the database. It is left until after the flags so -h works
+// without either. It returns the handlers to run the command with. The
+// connection is closed by runCommand once the command is done.
+func parseAndConnect(flags *flag.FlagSet, args []string) (*config.Config, *handlers.Handlers, error) {
+	flags.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.Connect(cfg.Mongo); err != nil {
+		return nil, nil, err
+	}
+	return cfg, handlers.New(cfg, store.NewMongo(db.Database)), nil
+}
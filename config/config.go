@@ -0,0 +1,458 @@
+// Package config loads the settings the API and the mrkt CLI run with.
+//
+// Settings come from, in order of precedence: environment variables, a .env
+// file, a YAML file and the defaults below. The YAML file is read from
+// CONFIG_FILE, or config.yaml if there is one.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting. Fields are read from the environment variable
+// in their env tag.
+type Config struct {
+	Port          string `yaml:"port" env:"PORT"`
+	OriginAllowed string `yaml:"originAllowed" env:"ORIGIN_ALLOWED"`
+	JWTKey        string `yaml:"jwtKey" env:"JWT_KEY"`
+	GoogleMapsKey string `yaml:"googleMapsKey" env:"GOOGLE_MAPS_KEY"`
+
+	// every admin has to use 2FA
+	AdminRequire2FA bool `yaml:"adminRequire2FA" env:"ADMIN_REQUIRE_2FA"`
+
+	// addresses or CIDR ranges of the proxies in front of the API, like the
+	// ingress. Only requests from them can say which client they are for, in
+	// X-Real-IP.
+	TrustedProxies []string `yaml:"trustedProxies" env:"TRUSTED_PROXIES"`
+
+	Server   ServerConfig   `yaml:"server"`
+	Timeouts TimeoutConfig  `yaml:"timeouts"`
+	Mongo    MongoConfig    `yaml:"mongo"`
+	SMTP     SMTPConfig     `yaml:"smtp"`
+	Ranking  RankingConfig  `yaml:"ranking"`
+	Location LocationConfig `yaml:"location"`
+	Tokens   TokenConfig    `yaml:"tokens"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+
+	RateLimits RateLimitConfig `yaml:"rateLimits"`
+
+	StatsCacheTTL time.Duration `yaml:"statsCacheTTL" env:"STATS_CACHE_TTL"`
+
+	// debug, info, warn or error
+	LogLevel string `yaml:"logLevel" env:"LOG_LEVEL"`
+
+	// OpenID Connect providers users can log in with, by name. The names
+	// can also be listed in OIDC_PROVIDERS, with each provider's settings in
+	// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and so on.
+	OIDCProviders map[string]OIDCProviderConfig `yaml:"oidcProviders"`
+}
+
+// ServerConfig sets how long the API gives requests and connections.
+type ServerConfig struct {
+	ReadTimeout  time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"` // reading a whole request, body included
+	WriteTimeout time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"` // keeping a connection open between requests
+	// how long requests in progress get to finish when the API is stopped
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+}
+
+// TimeoutConfig sets how long requests get before whatever they are waiting
+// on, like a MongoDB query, is canceled.
+type TimeoutConfig struct {
+	Request time.Duration `yaml:"request" env:"REQUEST_TIMEOUT"`
+	// routes that get longer or shorter, by method and route template, like
+	// "GET /entry/export". In ROUTE_TIMEOUTS, they are listed like
+	// GET /entry/export=10m,GET /location/safety=10s.
+	Routes map[string]time.Duration `yaml:"routes" env:"ROUTE_TIMEOUTS"`
+}
+
+// For returns how long requests to a route get.
+func (c TimeoutConfig) For(method, route string) time.Duration {
+	if timeout, ok := c.Routes[method+" "+route]; ok {
+		return timeout
+	}
+	return c.Request
+}
+
+// MongoConfig is the database to connect to.
+type MongoConfig struct {
+	URL      string `yaml:"url" env:"MONGO_URL"`
+	Database string `yaml:"database" env:"MONGO_DATABASE"`
+	// whether the API applies migrations when it starts. Without it, the API
+	// only checks they have been, and mrkt migrate has to be run first.
+	MigrateOnStart bool `yaml:"migrateOnStart" env:"MIGRATE_ON_START"`
+}
+
+// SMTPConfig is the mail server emails are sent through. Without a host,
+// emails are written to the log instead.
+type SMTPConfig struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     string `yaml:"port" env:"SMTP_PORT"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD"`
+}
+
+// RankingConfig sets how many entries users need to reach each rank, as a
+// percentage of the entries of the top alpha.
+type RankingConfig struct {
+	AlphaPercentile int `yaml:"alphaPercentile" env:"RANKING_ALPHA_PERCENTILE"`
+	BetaPercentile  int `yaml:"betaPercentile" env:"RANKING_BETA_PERCENTILE"`
+}
+
+// LocationConfig sets how the safety of a location is ranked. Entries of
+// MinLevel and above reported within Radius metres in the last WindowDays
+// days are averaged per day. An average from WarningAverage is a warning,
+// and from UnsafeAverage it is unsafe.
+type LocationConfig struct {
+	Radius         float64 `yaml:"radius" env:"LOCATION_RADIUS"`
+	WindowDays     int     `yaml:"windowDays" env:"LOCATION_WINDOW_DAYS"`
+	MinLevel       int     `yaml:"minLevel" env:"LOCATION_MIN_LEVEL"`
+	WarningAverage float64 `yaml:"warningAverage" env:"LOCATION_WARNING_AVERAGE"`
+	UnsafeAverage  float64 `yaml:"unsafeAverage" env:"LOCATION_UNSAFE_AVERAGE"`
+}
+
+// TokenConfig sets how long tokens last.
+type TokenConfig struct {
+	Session           time.Duration `yaml:"session" env:"SESSION_TOKEN_LIFETIME"`
+	Challenge         time.Duration `yaml:"challenge" env:"CHALLENGE_TOKEN_LIFETIME"` // finishing a 2FA or OIDC login
+	EmailVerification time.Duration `yaml:"emailVerification" env:"EMAIL_VERIFICATION_LIFETIME"`
+	Impersonation     time.Duration `yaml:"impersonation" env:"IMPERSONATION_TOKEN_LIFETIME"`
+	// how recently users without a password have to have logged in to make
+	// changes that would otherwise need it
+	RecentLogin time.Duration `yaml:"recentLogin" env:"RECENT_LOGIN_WINDOW"`
+}
+
+// TracingConfig is where traces are sent. Without an endpoint, traces are
+// still propagated to and from other services but not recorded.
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // OTLP over HTTP, e.g. http://collector:4318
+	ServiceName string  `yaml:"serviceName" env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"TRACE_SAMPLE_RATIO"` // of traces started here
+}
+
+// RateLimitConfig sets how often each client can use routes that are
+// expensive to serve. Each replica of the API keeps its own count.
+type RateLimitConfig struct {
+	Exports int `yaml:"exports" env:"EXPORT_RATE_LIMIT"` // public entry exports an hour, 0 for no limit
+}
+
+// OIDCProviderConfig is an OpenID Connect provider's client settings. The
+// issuer can be left out for providers we know about.
+type OIDCProviderConfig struct {
+	Issuer       string   `yaml:"issuer" env:"ISSUER"`
+	ClientID     string   `yaml:"clientID" env:"CLIENT_ID"`
+	ClientSecret string   `yaml:"clientSecret" env:"CLIENT_SECRET"`
+	RedirectURL  string   `yaml:"redirectURL" env:"REDIRECT_URL"`
+	Audiences    []string `yaml:"audiences" env:"AUDIENCES"` // client IDs of native apps
+}
+
+// Default returns the settings used for anything that isn't set.
+func Default() *Config {
+	return &Config{
+		Port:  "12345",
+		Mongo: MongoConfig{MigrateOnStart: true},
+		SMTP:  SMTPConfig{Port: "587"},
+		Ranking: RankingConfig{
+			AlphaPercentile: 80,
+			BetaPercentile:  40,
+		},
+		Location: LocationConfig{
+			Radius:         5000,
+			WindowDays:     5,
+			MinLevel:       3,
+			WarningAverage: 0.5,
+			UnsafeAverage:  1,
+		},
+		Server: ServerConfig{
+			ReadTimeout:     30 * time.Second,
+			WriteTimeout:    2 * time.Minute,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 25 * time.Second,
+		},
+		Timeouts: TimeoutConfig{
+			Request: 30 * time.Second,
+			Routes: map[string]time.Duration{
+				"GET /location/safety":         10 * time.Second,
+				"GET /entry/export":            10 * time.Minute,
+				"GET /users/me/export":         2 * time.Minute,
+				"GET /admin/users/{id}/export": 2 * time.Minute,
+				"GET /admin/audit":             5 * time.Minute, // as CSV
+				"POST /admin/entries/import":   10 * time.Minute,
+			},
+		},
+		Tokens: TokenConfig{
+			Session:           24 * time.Hour,
+			Challenge:         5 * time.Minute,
+			EmailVerification: 24 * time.Hour,
+			Impersonation:     30 * time.Minute,
+			RecentLogin:       5 * time.Minute,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "mrkt-api",
+			SampleRatio: 1,
+		},
+		RateLimits:    RateLimitConfig{Exports: 10},
+		StatsCacheTTL: 5 * time.Minute,
+		LogLevel:      "info",
+		OIDCProviders: map[string]OIDCProviderConfig{},
+	}
+}
+
+// TrustsProxy reports whether ip is one of the trusted proxies.
+func (c *Config) TrustsProxy(ip net.IP) bool {
+	for _, proxy := range c.TrustedProxies {
+		if network, err := parseProxy(proxy); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxy reads a trusted proxy, which can be a single address or a range.
+func parseProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", proxy)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(proxy)
+	return network, err
+}
+
+// Load reads the settings and checks they are valid.
+func Load() (*Config, error) {
+	cfg := Default()
+
+	if err := loadYAML(cfg); err != nil {
+		return nil, err
+	}
+
+	// the .env file only fills in what the environment doesn't set
+	dotenv, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("config: reading .env: %v", err)
+	}
+	lookup := func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := dotenv[name]
+		return value, ok
+	}
+
+	if err := loadEnv(reflect.ValueOf(cfg).Elem(), "", lookup); err != nil {
+		return nil, err
+	}
+
+	if names, ok := lookup("OIDC_PROVIDERS"); ok {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			provider := cfg.OIDCProviders[name]
+			prefix := "OIDC_" + strings.ToUpper(name) + "_"
+			if err := loadEnv(reflect.ValueOf(&provider).Elem(), prefix, lookup); err != nil {
+				return nil, err
+			}
+			cfg.OIDCProviders[name] = provider
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadYAML(cfg *Config) error {
+	path, required := os.LookupEnv("CONFIG_FILE")
+	if !required {
+		path = "config.yaml"
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: reading %s: %v", path, err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("config: reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv sets the fields of a struct from the environment variables in
+// their env tags, with the prefix added. Nested structs are loaded too.
+func loadEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field, prefix, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		name = prefix + name
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("config: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(int64(n))
+	case float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(n)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30m or 24h", value)
+		}
+		field.SetInt(int64(d))
+	case map[string]time.Duration:
+		// added to the routes already set
+		routes := field.Interface().(map[string]time.Duration)
+		if routes == nil {
+			routes = map[string]time.Duration{}
+		}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			i := strings.LastIndex(item, "=")
+			if i < 0 {
+				return fmt.Errorf("%q is not like GET /route=30s", item)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(item[i+1:]))
+			if err != nil {
+				return fmt.Errorf("%q is not a duration like 30s or 10m", item[i+1:])
+			}
+			routes[strings.TrimSpace(item[:i])] = d
+		}
+		field.Set(reflect.ValueOf(routes))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate checks every setting, and lists everything that is wrong.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(c.Mongo.URL != "", "MONGO_URL is required")
+	check(c.Mongo.Database != "", "MONGO_DATABASE is required")
+	check(c.JWTKey != "", "JWT_KEY is required")
+
+	if _, err := strconv.Atoi(c.Port); err != nil {
+		problems = append(problems, "PORT must be a port number")
+	}
+
+	check(c.Server.ReadTimeout > 0, "SERVER_READ_TIMEOUT must be more than 0")
+	check(c.Server.WriteTimeout > 0, "SERVER_WRITE_TIMEOUT must be more than 0")
+	check(c.Server.IdleTimeout > 0, "SERVER_IDLE_TIMEOUT must be more than 0")
+	check(c.Server.ShutdownTimeout > 0, "SERVER_SHUTDOWN_TIMEOUT must be more than 0")
+
+	check(c.Timeouts.Request > 0, "REQUEST_TIMEOUT must be more than 0")
+	for route, timeout := range c.Timeouts.Routes {
+		check(timeout > 0, fmt.Sprintf("the timeout of %s must be more than 0", route))
+	}
+
+	check(c.Ranking.BetaPercentile > 0 && c.Ranking.BetaPercentile < c.Ranking.AlphaPercentile && c.Ranking.AlphaPercentile <= 100,
+		"ranking percentiles must be 0 < beta < alpha <= 100")
+
+	check(c.Location.Radius > 0, "LOCATION_RADIUS must be more than 0")
+	check(c.Location.WindowDays > 0, "LOCATION_WINDOW_DAYS must be more than 0")
+	check(c.Location.MinLevel >= 1 && c.Location.MinLevel <= 5, "LOCATION_MIN_LEVEL must be from 1 to 5")
+	check(c.Location.WarningAverage > 0 && c.Location.WarningAverage < c.Location.UnsafeAverage,
+		"location averages must be 0 < warning < unsafe")
+
+	check(c.Tokens.Session > 0, "SESSION_TOKEN_LIFETIME must be more than 0")
+	check(c.Tokens.Challenge > 0, "CHALLENGE_TOKEN_LIFETIME must be more than 0")
+	check(c.Tokens.EmailVerification > 0, "EMAIL_VERIFICATION_LIFETIME must be more than 0")
+	check(c.Tokens.Impersonation > 0, "IMPERSONATION_TOKEN_LIFETIME must be more than 0")
+	check(c.Tokens.RecentLogin > 0, "RECENT_LOGIN_WINDOW must be more than 0")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "TRACE_SAMPLE_RATIO must be from 0 to 1")
+	check(c.RateLimits.Exports >= 0, "EXPORT_RATE_LIMIT can't be negative")
+	check(c.StatsCacheTTL >= 0, "STATS_CACHE_TTL can't be negative")
+	for _, proxy := range c.TrustedProxies {
+		_, err := parseProxy(proxy)
+		check(err == nil, fmt.Sprintf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", proxy))
+	}
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "LOG_LEVEL must be debug, info, warn or error")
+
+	for name, provider := range c.OIDCProviders {
+		check(provider.ClientID != "", fmt.Sprintf("the %s login provider needs a client ID", name))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
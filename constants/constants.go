@@ -1,6 +1,9 @@
 package constants
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // NotAdmin ...
 var NotAdmin = "This user is not an admin"
@@ -8,6 +11,12 @@ var IncorrectCredentials = "The details you entered seem to be incorrect."
 var AccessDenied = "You do not have permission to access this resource."
 var InvalidParams = "The data you provided is incorrect."
 var UserExists = "This user already exists"
+var AccountLocked = "Too many failed login attempts. Please try again later."
+var InvalidTwoFactorCode = "The verification code you entered is incorrect."
+var TwoFactorRequired = "Two-factor authentication must be enabled for this account."
+var TwoFactorNotPending = "Please start two-factor setup before confirming it."
+var InvalidVerificationToken = "This verification link is invalid or has expired."
+var VerifiedEmailRequired = "Your account with this provider doesn't have a verified email address."
 
 const ALPHA_RANK = 3
 const BETA_RANK = 2
@@ -21,6 +30,108 @@ const LOCATION_UNKNOWN = "unknown"
 const WELCOME_MESSAGE = "Welcome!"
 
 var Enabled = "enabled"
+var Erased = "erased"
+
+// Login attempt tracking. After LOGIN_FREE_ATTEMPTS failures, each further
+// attempt has to wait an exponentially growing delay capped at
+// LOGIN_MAX_DELAY. Crossing a lockout threshold blocks all attempts for
+// LOCKOUT_DURATION.
+const LOGIN_FREE_ATTEMPTS = 3
+const LOGIN_MAX_DELAY = 30 * time.Second
+const ACCOUNT_LOCKOUT_THRESHOLD = 10
+const IP_LOCKOUT_THRESHOLD = 50
+const LOCKOUT_DURATION = 15 * time.Minute
+
+// Kinds of content an entry can link to.
+const CONTENT_IMAGE = "image"
+const CONTENT_VIDEO = "video"
+
+var ContentTypes = []string{CONTENT_IMAGE, CONTENT_VIDEO}
+
+const NOTIFICATION_ACCOUNT_LOCKED = "account_locked"
+const NOTIFICATION_ENTRY_REJECTED = "entry_rejected"
+const NOTIFICATION_EMAIL_CHANGED = "email_changed"
+
+// Moderation states of an entry. New entries are public but still waiting for
+// review. Pending entries are held back until an admin approves them.
+const MODERATION_NEW = "new"
+const MODERATION_PENDING = "pending"
+const MODERATION_APPROVED = "approved"
+const MODERATION_REJECTED = "rejected"
+const MODERATION_HIDDEN = "hidden"
+const MODERATION_FLAGGED = "flagged" // hidden automatically after too many flags
+
+// Moderation actions admins can take, and the state each one leads to.
+var ModerationActions = map[string]string{
+	"approve": MODERATION_APPROVED,
+	"reject":  MODERATION_REJECTED,
+	"hide":    MODERATION_HIDDEN,
+}
+
+// HiddenModerationStates are the states that keep an entry out of public
+// listings and location rankings.
+var HiddenModerationStates = []string{MODERATION_PENDING, MODERATION_REJECTED, MODERATION_HIDDEN, MODERATION_FLAGGED}
+
+// QueuedModerationStates are the states that need an admin to look at them.
+var QueuedModerationStates = []string{MODERATION_NEW, MODERATION_PENDING, MODERATION_FLAGGED}
+
+// Reasons users can give for flagging an entry
+var FlagReasons = []string{"spam", "offensive", "fake", "wrong_location", "duplicate"}
+
+// FLAG_HIDE_THRESHOLD is the flag score at which an entry is hidden until an
+// admin reviews it. Each flag counts for the rank of the user who raised it,
+// so an alpha's flag weighs three times as much as a pup's.
+const FLAG_HIDE_THRESHOLD = 5
+
+var AlreadyFlagged = "You have already flagged this entry."
+var EntryChanged = "This entry was changed by someone else. Please reload it and try again."
+var AccountBanned = "This account has been banned."
+var AccountClosed = "This account has been closed."
+var SessionEnded = "Your session has ended. Please log in again."
+var RecentLoginRequired = "Please log in again to make this change."
+var ImpersonationReadOnly = "Impersonation tokens can only be used to view data."
+
+// Roles admins can have. The validate tags on AdminRole fields list them too.
+const ADMIN_ROLE_SUPER = "super"
+const ADMIN_ROLE_STANDARD = "standard"
+
+var AdminRoles = []string{ADMIN_ROLE_SUPER, ADMIN_ROLE_STANDARD}
+
+// Restrictions admins can put on users
+const RESTRICTION_SUSPENDED = "suspended"
+const RESTRICTION_BANNED = "banned"
+const RESTRICTION_SHADOW_BANNED = "shadowBanned"
+
+// File formats entries can be imported from
+const IMPORT_FORMAT_CSV = "csv"
+const IMPORT_FORMAT_GEOJSON = "geojson"
+
+// GEOCODE_BATCH_SIZE is how many entries are reverse geocoded at the same
+// time, when importing entries or filling in missing addresses.
+const GEOCODE_BATCH_SIZE = 50
+
+// File formats entries can be exported as
+const EXPORT_FORMAT_GEOJSON = "geojson"
+const EXPORT_FORMAT_CSV = "csv"
+const EXPORT_FORMAT_KML = "kml"
+
+// JWT purposes. Session tokens have no purpose. The others only allow the
+// holder to finish logging in.
+const TOKEN_PURPOSE_2FA_CHALLENGE = "2fa_challenge"
+const TOKEN_PURPOSE_2FA_ENROL = "2fa_enrol"
+const TOKEN_PURPOSE_OIDC_STATE = "oidc_state"
+
+// Impersonation tokens let admins see the API as a user does, for support.
+// They can only be used to read.
+const TOKEN_PURPOSE_IMPERSONATION = "impersonation"
+
+const TWO_FACTOR_ISSUER = "Mrkt"
+const RECOVERY_CODE_COUNT = 10
+
+// AccountSuspended ...
+func AccountSuspended(until time.Time) string {
+	return fmt.Sprintf("This account has been suspended until %s.", until.Format(time.RFC1123))
+}
 
 // ResourceNotFound ...
 func ResourceNotFound(resource string) string {
@@ -37,11 +148,12 @@ func InvalidParam(resource string) string {
 	return fmt.Sprintf("The %s you entered is invalid.", resource)
 }
 
-// CustomError ...
-type CustomError struct {
-	Msg string
+// TooManyRequests ...
+func TooManyRequests(wait time.Duration) string {
+	return fmt.Sprintf("Too many requests. Please try again in %d seconds.", int(wait.Seconds())+1)
 }
 
-func (e *CustomError) Error() string {
-	return fmt.Sprintf("%s", e.Msg)
+// TooManyAttempts ...
+func TooManyAttempts(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %d seconds.", int(wait.Seconds())+1)
 }
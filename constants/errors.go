@@ -0,0 +1,145 @@
+package constants
+
+import "net/http"
+
+// Error codes sent with every error response, so clients can tell errors
+// apart without reading the message.
+const (
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeRateLimited  = "rate_limited"
+	CodeInternal     = "internal_error"
+	CodeUnavailable  = "unavailable"
+	CodeTimeout      = "timeout"
+	CodeCanceled     = "canceled"
+)
+
+// StatusClientClosedRequest is the status requests are logged with when the
+// client went away before they were answered. It is nginx's, so it means the
+// same thing in the ingress logs.
+const StatusClientClosedRequest = 499
+
+// InternalErrorMessage is all users are told about internal errors. The
+// details are logged instead.
+const InternalErrorMessage = "Something went wrong on our end. Please try again later."
+
+// TimeoutMessage is what users are told when their request ran out of time.
+const TimeoutMessage = "That took too long. Please try again later."
+
+var codeStatuses = map[string]int{
+	CodeValidation:   http.StatusBadRequest,
+	CodeUnauthorized: http.StatusUnauthorized,
+	CodeForbidden:    http.StatusForbidden,
+	CodeNotFound:     http.StatusNotFound,
+	CodeConflict:     http.StatusConflict,
+	CodeRateLimited:  http.StatusTooManyRequests,
+	CodeInternal:     http.StatusInternalServerError,
+	CodeUnavailable:  http.StatusServiceUnavailable,
+	CodeTimeout:      http.StatusGatewayTimeout,
+	CodeCanceled:     StatusClientClosedRequest,
+}
+
+// CustomError is an error whose message is safe to show users. Its code says
+// what kind of error it is, and errors without one are validation errors.
+// Create them with the constructors below, so the code is always explicit.
+type CustomError struct {
+	Msg  string
+	Code string
+	// what caused the error, if anything. It is logged, never shown.
+	Err error
+}
+
+func (e *CustomError) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns the cause of the error.
+func (e *CustomError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode is the error's code, CodeValidation if it doesn't have one.
+func (e *CustomError) ErrorCode() string {
+	if e.Code == "" {
+		return CodeValidation
+	}
+	return e.Code
+}
+
+// Status is the HTTP status the error is sent with.
+func (e *CustomError) Status() int {
+	if status, ok := codeStatuses[e.ErrorCode()]; ok {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+// CodeForStatus is the error code for an HTTP error status.
+func CodeForStatus(status int) string {
+	for code, s := range codeStatuses {
+		if s == status {
+			return code
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeValidation
+}
+
+// ValidationError is for requests with missing or invalid values.
+func ValidationError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeValidation}
+}
+
+// UnauthorizedError is for requests whose user couldn't be identified.
+func UnauthorizedError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeUnauthorized}
+}
+
+// ForbiddenError is for users who aren't allowed to do what they asked.
+func ForbiddenError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeForbidden}
+}
+
+// NotFoundError is for things that don't exist.
+func NotFoundError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeNotFound}
+}
+
+// ConflictError is for changes that clash with something that already
+// exists or has changed since it was read.
+func ConflictError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeConflict}
+}
+
+// RateLimitedError is for users who have tried something too many times.
+func RateLimitedError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeRateLimited}
+}
+
+// UnavailableError is for requests the API can't serve for now, like while
+// it is starting up or shutting down.
+func UnavailableError(msg string) *CustomError {
+	return &CustomError{Msg: msg, Code: CodeUnavailable}
+}
+
+// TimeoutError is for requests that ran out of time. err is what ran out of
+// time, which is logged.
+func TimeoutError(err error) *CustomError {
+	return &CustomError{Msg: TimeoutMessage, Code: CodeTimeout, Err: err}
+}
+
+// CanceledError is for requests the client gave up on. No one sees it, but
+// it keeps them from being logged as internal errors.
+func CanceledError() *CustomError {
+	return &CustomError{Msg: "The request was canceled.", Code: CodeCanceled}
+}
+
+// InternalError wraps an error users shouldn't see the details of.
+func InternalError(err error) *CustomError {
+	return &CustomError{Msg: InternalErrorMessage, Code: CodeInternal, Err: err}
+}
@@ -3,25 +3,31 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/OpeOnikute/mrkt-api/constants"
-	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
 	"github.com/OpeOnikute/mrkt-api/models"
 
-	"github.com/go-playground/locales/en"
-	ut "github.com/go-playground/universal-translator"
 	"github.com/gorilla/mux"
-
-	validator "gopkg.in/go-playground/validator.v9"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var defaultRes = make(map[string]interface{})
 
+const dateParamFormat = "2006-01-02"
+
 type loginBody struct {
 	Email    string
 	Password string
@@ -32,10 +38,10 @@ type loginResponse struct {
 	Data    interface{} `json:"data" bson:"data"`
 }
 
-var alertTypeHandler handlers.AlertTypeHandler
-
 // AdminController ...
-type AdminController struct{}
+type AdminController struct {
+	*API
+}
 
 // CreateUserEndpoint ...
 func (c AdminController) CreateUserEndpoint(response http.ResponseWriter, request *http.Request) {
@@ -43,24 +49,26 @@ func (c AdminController) CreateUserEndpoint(response http.ResponseWriter, reques
 	user := models.GetDefaultUser()
 	err := json.NewDecoder(request.Body).Decode(&user)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
 		return
 	}
 
 	user.IsAdmin = request.URL.Query().Get("isAdmin") == "true"
 
-	if ok, errors := validateRequest(user); !ok {
+	if ok, errors := c.validateRequest(request, user); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
-	result, err := handlers.CreateUser(user)
+	result, err := c.handlers.CreateUser(request.Context(), user)
 
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
+	c.recordAudit(request, auditUserCreate, "users", user.ID.Hex(), nil, user)
+
 	SendSuccessResponse(response, result)
 }
 
@@ -75,31 +83,41 @@ func (c AdminController) AdminLoginEndpoint(response http.ResponseWriter, reques
 		return
 	}
 
-	user, err := handlers.GetUserByEmail(body.Email, true)
-
-	if err != nil {
-		SendQueryErrorResponse(response, err, "admin")
+	user, ok := c.authenticateLogin(response, request, body, true)
+	if !ok {
 		return
 	}
 
-	// compare passwords
-	if correct := handlers.ComparePasswords(user.Password, []byte(body.Password)); correct != true {
-		SendErrorResponse(response, http.StatusUnauthorized, constants.IncorrectCredentials, defaultRes)
-		return
-	}
+	c.sendLoginResponse(response, user)
+}
 
-	// generate jwt token and send
-	token, err := handlers.GenerateJWTToken(&user)
+// TwoFactorLoginEndpoint exchanges a login challenge and a 2FA code for a token
+func (c AdminController) TwoFactorLoginEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.twoFactorLogin(response, request, true)
+}
 
-	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
-		return
-	}
+// SetupTwoFactorEndpoint ...
+func (c AdminController) SetupTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.setupTwoFactor(response, request, true)
+}
+
+// ConfirmTwoFactorEndpoint ...
+func (c AdminController) ConfirmTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.confirmTwoFactor(response, request, true)
+}
 
-	data := make(map[string]string)
-	data["token"] = token
+// DisableTwoFactorEndpoint ...
+func (c AdminController) DisableTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.disableTwoFactor(response, request, true)
+}
 
-	SendSuccessResponse(response, data)
+// adminUserBody lists the fields admins can change on a user. isAdmin is
+// deliberately left out.
+type adminUserBody struct {
+	Username  *string `json:"username" validate:"omitempty,min=1"`
+	Email     *string `json:"email" validate:"omitempty,email"`
+	Password  *string `json:"password" validate:"omitempty,min=8"`
+	AdminRole *string `json:"adminRole" validate:"omitempty,oneof=super standard"`
 }
 
 // UpdateUserEndpoint ...
@@ -107,28 +125,67 @@ func (c AdminController) UpdateUserEndpoint(response http.ResponseWriter, reques
 	// get ID
 	params := mux.Vars(request)
 
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("user ID"), defaultRes)
+		return
+	}
+
 	isAdmin := request.URL.Query().Get("isAdmin") == "true"
-	user, err := handlers.GetUserByID(params["id"], isAdmin)
+	user, err := c.handlers.GetUser(request.Context(), bson.M{"_id": id, "isAdmin": isAdmin})
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "admin")
 		return
 	}
 
-	err = json.NewDecoder(request.Body).Decode(&user)
+	var body adminUserBody
 
-	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
+	if body.Username != nil && *body.Username != user.Username {
+		if err := c.handlers.ChangeUsername(request.Context(), user, *body.Username); err != nil {
+			SendError(response, err)
+			return
+		}
+	}
+
+	if body.Password != nil {
+		if _, err := c.handlers.ChangePassword(request.Context(), user, *body.Password); err != nil {
+			SendError(response, err)
+			return
+		}
+	}
+
+	if body.Email != nil && *body.Email != user.Email {
+		if err := c.handlers.ChangeEmail(request.Context(), user, *body.Email); err != nil {
+			SendError(response, err)
+			return
+		}
+	}
+
+	fields := bson.M{}
+	if body.AdminRole != nil && isAdmin {
+		fields["adminRole"] = *body.AdminRole
+	}
+
 	// update model
-	result, err := handlers.UpdateUserByID(params["id"], user)
+	result, err := c.handlers.UpdateUserFields(request.Context(), user.ID, fields)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
+	c.recordUserAudit(request, auditUserUpdate, user)
+
 	SendSuccessResponse(response, result)
 }
 
@@ -138,7 +195,7 @@ func (c AdminController) DeleteUserEndpoint(response http.ResponseWriter, reques
 	params := mux.Vars(request)
 
 	isAdmin := request.URL.Query().Get("isAdmin") == "true"
-	user, err := handlers.GetUserByID(params["id"], isAdmin)
+	user, err := c.handlers.GetUserByID(request.Context(), params["id"], isAdmin)
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "admin")
@@ -146,25 +203,75 @@ func (c AdminController) DeleteUserEndpoint(response http.ResponseWriter, reques
 	}
 
 	// update model
-	result, err := handlers.DeleteUserByID(user)
+	result, err := c.handlers.DeleteUserByID(request.Context(), user)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
+	c.recordUserAudit(request, auditUserDelete, user)
+
 	// send reponse
 	SendSuccessResponse(response, result)
 }
 
-// GetUsersEndpoint ...
+// GetUsersEndpoint lists users. They can be filtered by status (including
+// restrictions like suspended), rank, signup date with from and to, and
+// searched by username or email with q.
 func (c AdminController) GetUsersEndpoint(response http.ResponseWriter, request *http.Request) {
-	isAdmin := request.URL.Query().Get("isAdmin") == "true"
-	results, err := handlers.GetAllUsers(isAdmin)
+	query := request.URL.Query()
+	q := bson.M{"isAdmin": query.Get("isAdmin") == "true"}
+
+	switch status := query.Get("status"); status {
+	case "":
+	case constants.RESTRICTION_SUSPENDED:
+		q["restriction.state"] = status
+		q["restriction.until"] = bson.M{"$gt": time.Now()}
+	case constants.RESTRICTION_BANNED, constants.RESTRICTION_SHADOW_BANNED:
+		q["restriction.state"] = status
+	default:
+		q["status"] = status
+	}
+
+	if rank := query.Get("rank"); rank != "" {
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("rank"), defaultRes)
+			return
+		}
+		q["ranking.rank"] = n
+	}
+
+	from, to, ok := parseDateRange(response, query)
+	if !ok {
+		return
+	}
+	created := bson.M{}
+	if !from.IsZero() {
+		created["$gte"] = from
+	}
+	if !to.IsZero() {
+		created["$lte"] = to
+	}
+	if len(created) > 0 {
+		q["created"] = created
+	}
+
+	if search := strings.TrimSpace(query.Get("q")); search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(search), Options: "i"}
+		q["$or"] = []bson.M{{"username": pattern}, {"email": pattern}}
+	}
+
+	results, err := c.handlers.GetAllUsers(request.Context(), q)
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "admin")
 		return
 	}
+
+	for i := range results {
+		results[i].Password = ""
+	}
 	SendSuccessResponse(response, results)
 }
 
@@ -173,7 +280,7 @@ func (c AdminController) GetUserEndpoint(response http.ResponseWriter, request *
 	params := mux.Vars(request)
 
 	isAdmin := request.URL.Query().Get("isAdmin") == "true"
-	user, err := handlers.GetUserByID(params["id"], isAdmin)
+	user, err := c.handlers.GetUserByID(request.Context(), params["id"], isAdmin)
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "admin")
@@ -182,28 +289,60 @@ func (c AdminController) GetUserEndpoint(response http.ResponseWriter, request *
 	SendSuccessResponse(response, user)
 }
 
+// UnlockUserEndpoint lifts a login lockout on a user's account
+func (c AdminController) UnlockUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("user ID"), defaultRes)
+		return
+	}
+
+	isAdmin := request.URL.Query().Get("isAdmin") == "true"
+	user, err := c.handlers.GetUser(request.Context(), bson.M{"_id": id, "isAdmin": isAdmin})
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if err := c.handlers.UnlockAccount(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordAudit(request, auditUserUnlock, "users", user.ID.Hex(), nil, nil)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
 // CreateAlertTypeEndpoint ...
 func (c AdminController) CreateAlertTypeEndpoint(response http.ResponseWriter, request *http.Request) {
 	alertType := models.AlertType{}
 
 	err := json.NewDecoder(request.Body).Decode(&alertType)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
 		return
 	}
 
-	if ok, errors := validateRequest(alertType); !ok {
+	if ok, errors := c.validateRequest(request, alertType); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
-	result, err := alertTypeHandler.CreateAlertType(alertType)
+	result, err := c.handlers.AlertTypes().CreateAlertType(request.Context(), alertType)
 
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		alertType.ID = id
+		c.recordAudit(request, auditAlertTypeCreate, "alertTypes", id.Hex(), nil, alertType)
+	}
+
 	SendSuccessResponse(response, result)
 }
 
@@ -217,10 +356,10 @@ func (c AdminController) GetAlertTypesEndpoint(response http.ResponseWriter, req
 		query["name"] = nameQuery
 	}
 
-	results, err := alertTypeHandler.GetMultiple(query)
+	results, err := c.handlers.AlertTypes().GetMultiple(request.Context(), query)
 
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 	SendSuccessResponse(response, results)
@@ -229,7 +368,7 @@ func (c AdminController) GetAlertTypesEndpoint(response http.ResponseWriter, req
 // GetAlertTypeEndpoint ...
 func (c AdminController) GetAlertTypeEndpoint(response http.ResponseWriter, request *http.Request) {
 	params := mux.Vars(request)
-	entry, err := alertTypeHandler.FindByID(params["id"])
+	entry, err := c.handlers.AlertTypes().FindByID(request.Context(), params["id"])
 	if err != nil {
 		SendQueryErrorResponse(response, err, "alert type")
 		return
@@ -242,29 +381,33 @@ func (c AdminController) UpdateAlertTypeEndpoint(response http.ResponseWriter, r
 	// get ID
 	params := mux.Vars(request)
 	// get alert type
-	alertType, err := alertTypeHandler.FindByID(params["id"])
+	alertType, err := c.handlers.AlertTypes().FindByID(request.Context(), params["id"])
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "alert type")
 		return
 	}
 
-	if json.NewDecoder(request.Body).Decode(&alertType); err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+	before := alertType
+
+	if err := json.NewDecoder(request.Body).Decode(&alertType); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
 		return
 	}
 
-	if ok, errors := validateRequest(alertType); !ok {
+	if ok, errors := c.validateRequest(request, alertType); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
-	result, err := alertTypeHandler.UpdateByID(params["id"], alertType)
+	result, err := c.handlers.AlertTypes().UpdateByID(request.Context(), params["id"], alertType)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
+	c.recordAudit(request, auditAlertTypeUpdate, "alertTypes", before.ID.Hex(), before, alertType)
+
 	SendSuccessResponse(response, result)
 }
 
@@ -272,12 +415,22 @@ func (c AdminController) UpdateAlertTypeEndpoint(response http.ResponseWriter, r
 func (c AdminController) DeleteAlertTypeEndpoint(response http.ResponseWriter, request *http.Request) {
 	// get ID
 	params := mux.Vars(request)
-	result, err := alertTypeHandler.DeleteByID(params["id"])
+	alertType, err := c.handlers.AlertTypes().FindByID(request.Context(), params["id"])
+	if err != nil {
+		SendQueryErrorResponse(response, err, "alert type")
+		return
+	}
+
+	result, err := c.handlers.AlertTypes().DeleteByID(request.Context(), params["id"])
 	if err != nil {
 		SendQueryErrorResponse(response, err, "alert type")
 		return
 	}
 
+	deleted := alertType
+	deleted.Status = "deleted"
+	c.recordAudit(request, auditAlertTypeDelete, "alertTypes", alertType.ID.Hex(), alertType, deleted)
+
 	// send reponse
 	SendSuccessResponse(response, result)
 }
@@ -285,7 +438,10 @@ func (c AdminController) DeleteAlertTypeEndpoint(response http.ResponseWriter, r
 // AdminAuthenticationMiddleware is a Middleware function, which will be called for each request
 func (c AdminController) AdminAuthenticationMiddleware(next http.Handler) http.Handler {
 
-	unauthenticated := []string{"/admin/login"}
+	unauthenticated := []string{"/admin/login", "/admin/login/2fa"}
+
+	// routes an admin who still has to set up 2FA is allowed to use
+	enrolment := []string{"/admin/2fa/setup", "/admin/2fa/confirm"}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -303,9 +459,28 @@ func (c AdminController) AdminAuthenticationMiddleware(next http.Handler) http.H
 			return
 		}
 
-		if valid, claim := handlers.VerifyJWTToken(token, true); valid {
+		if yes := contains(enrolment, url); yes {
+			if valid, claim := c.handlers.VerifyPurposeToken(token, constants.TOKEN_PURPOSE_2FA_ENROL, true); valid {
+				ctx := context.WithValue(r.Context(), "AdminID", claim.UserID) // nolint
+				logging.With(ctx, "userId", claim.UserID.Hex())
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		if valid, claim := c.handlers.VerifyJWTToken(token, true); valid {
+			if c.handlers.AdminTwoFactorRequired() && !claim.MFA && !contains(enrolment, url) {
+				SendErrorResponse(w, http.StatusForbidden, constants.TwoFactorRequired, defaultRes)
+				return
+			}
+
+			if ok := c.checkSession(w, r, claim); !ok {
+				return
+			}
+
 			// Pass down the request to the next middleware (or final handler)
 			ctx := context.WithValue(r.Context(), "AdminID", claim.UserID) // nolint
+			logging.With(ctx, "userId", claim.UserID.Hex())
 			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			// Write an error and stop the handler chain
@@ -314,38 +489,64 @@ func (c AdminController) AdminAuthenticationMiddleware(next http.Handler) http.H
 	})
 }
 
-// SendQueryErrorResponse ...
+// SendQueryErrorResponse sends an error from looking something up. Not
+// finding it is a 404 that names what was looked for.
 func SendQueryErrorResponse(r http.ResponseWriter, e error, modelName string) {
-	var status int
-	msg := e.Error()
-	if msg == mongo.ErrNoDocuments.Error() {
-		msg = fmt.Sprintf("We could not find any %s. Please check your details and try again.", modelName)
-		status = http.StatusBadRequest
-	} else {
-		status = http.StatusInternalServerError
-	}
-	SendErrorResponse(r, status, msg, defaultRes)
+	if errors.Is(e, mongo.ErrNoDocuments) {
+		msg := fmt.Sprintf("We could not find any %s. Please check your details and try again.", modelName)
+		e = constants.NotFoundError(msg)
+	}
+	SendError(r, e)
+}
+
+// SendError sends the response for an error. A *constants.CustomError is sent
+// with its own status, code and message. Errors from the request running out
+// of time are a timeout, and from the client going away are canceled. Anything
+// else is an internal error: it is logged, and the user only gets a generic
+// message.
+func SendError(r http.ResponseWriter, err error) {
+	var custom *constants.CustomError
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		custom = constants.NotFoundError(constants.ResourceNotFound("resource"))
+	case errors.Is(err, context.DeadlineExceeded):
+		custom = constants.TimeoutError(err)
+	case errors.Is(err, context.Canceled):
+		custom = constants.CanceledError()
+	case !errors.As(err, &custom):
+		custom = constants.InternalError(err)
+	}
+
+	if custom.Err != nil {
+		logError(r, custom.Err)
+	}
+	writeError(r, custom.Status(), custom.ErrorCode(), custom.Msg, defaultRes)
 }
 
-// SendErrorResponse ...
+// SendErrorResponse sends an error with the given status. The message of a
+// 5xx is logged instead of sent, since it may have internal details in it.
 func SendErrorResponse(r http.ResponseWriter, status int, message string, data interface{}) {
+	if status >= http.StatusInternalServerError {
+		logError(r, errors.New(message))
+		message = constants.InternalErrorMessage
+	}
+	writeError(r, status, constants.CodeForStatus(status), message, data)
+}
 
+func writeError(r http.ResponseWriter, status int, code, message string, data interface{}) {
 	res := make(map[string]interface{})
 	res["status"] = "error"
+	res["code"] = code
 	res["message"] = message
 	res["data"] = data
+	// set on the response by RequestIDMiddleware
+	res["requestId"] = r.Header().Get(requestIDHeader)
 
 	jsonRes, _ := json.Marshal(res)
 
 	r.Header().Set("content-type", "application/json")
 	r.WriteHeader(status)
 	r.Write([]byte(jsonRes))
-
-	if status == http.StatusInternalServerError {
-		// disable logger till I can figure out nil pointer error
-		// lg := new(handlers.Logger)
-		// lg.Error(message)
-	}
 }
 
 // SendSuccessResponse ...
@@ -354,45 +555,94 @@ func SendSuccessResponse(r http.ResponseWriter, result interface{}) {
 	res := make(map[string]interface{})
 	res["status"] = "success"
 	res["data"] = result
+	res["requestId"] = r.Header().Get(requestIDHeader)
 
 	r.Header().Set("content-type", "application/json")
 	json.NewEncoder(r).Encode(res)
 }
 
-func validateRequest(b interface{}) (bool, map[string]interface{}) {
-
-	// init validator
-	v := validator.New()
+// getClientIP returns the IP of the client that made the request. Behind the
+// ingress the connecting address is the proxy, which passes the client's
+// address on in X-Real-IP. Anyone else could send any address there, so it
+// is only read from the trusted proxies.
+func (api *API) getClientIP(request *http.Request) string {
+	host := remoteHost(request)
+	if ip := request.Header.Get("X-Real-IP"); ip != "" && api.conf.TrustsProxy(net.ParseIP(host)) {
+		return ip
+	}
+	return host
+}
 
-	// register translations
-	translator := en.New()
-	uni := ut.New(translator, translator)
+// remoteHost is the address the request came from, without the port.
+func remoteHost(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
 
-	trans, _ := uni.GetTranslator("en")
+// parseDateRange reads the from and to query params, which can be dates or
+// RFC 3339 times. A date on its own covers the whole of that day. Either can
+// be left out, in which case it is zero. It writes the error response itself.
+func parseDateRange(response http.ResponseWriter, query url.Values) (from, to time.Time, ok bool) {
+	parse := func(name string) (time.Time, bool) {
+		value := query.Get(name)
+		if value == "" {
+			return time.Time{}, true
+		}
+		if t, err := time.Parse(dateParamFormat, value); err == nil {
+			if name == "to" {
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			return t, true
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, true
+		}
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam(name), defaultRes)
+		return time.Time{}, false
+	}
 
-	_ = v.RegisterTranslation("email", trans, func(ut ut.Translator) error {
-		return ut.Add("email", "{0} must be a valid email", true) // see universal-translator for details
-	}, func(ut ut.Translator, fe validator.FieldError) string {
-		t, _ := ut.T("email", fe.Field())
-		return t
-	})
+	if from, ok = parse("from"); !ok {
+		return
+	}
+	to, ok = parse("to")
+	return
+}
 
-	// prepare response
-	ok := true
-	errors := make(map[string]interface{})
+// parseArea reads the lat, lng and radius query params of an area filter.
+// near is nil if no area was given. It writes the error response itself.
+func (api *API) parseArea(response http.ResponseWriter, query url.Values) (near *[2]float64, radius float64, ok bool) {
+	lat, lng := query.Get("lat"), query.Get("lng")
+	if lat == "" && lng == "" {
+		return nil, 0, true
+	}
 
-	// parse validation
-	err := v.Struct(b)
+	latFloat, err := strconv.ParseFloat(lat, 64)
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("latitude"), defaultRes)
+		return nil, 0, false
+	}
 
+	lngFloat, err := strconv.ParseFloat(lng, 64)
 	if err != nil {
-		ok = false
-		for _, e := range err.(validator.ValidationErrors) {
-			tg := e.Tag()
-			errors[tg] = e.Translate(trans)
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("longitude"), defaultRes)
+		return nil, 0, false
+	}
+
+	// area filters without a radius use the same one as location rankings
+	radius = api.conf.Location.Radius
+	if value := query.Get("radius"); value != "" {
+		r, err := strconv.ParseFloat(value, 64)
+		if err != nil || r <= 0 {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("radius"), defaultRes)
+			return nil, 0, false
 		}
+		radius = r
 	}
 
-	return ok, errors
+	return &[2]float64{latFloat, lngFloat}, radius, true
 }
 
 func contains(arr []string, str string) bool {
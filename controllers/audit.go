@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Actions recorded in the audit log. They are named <collection>.<verb>.
+const (
+	auditUserCreate       = "user.create"
+	auditUserUpdate       = "user.update"
+	auditUserDelete       = "user.delete"
+	auditUserUnlock       = "user.unlock"
+	auditUserExport       = "user.export"
+	auditUserErase        = "user.erase"
+	auditUserLink         = "user.link"
+	auditTwoFactorSetup   = "user.2fa.setup"
+	auditTwoFactorConfirm = "user.2fa.confirm"
+	auditTwoFactorDisable = "user.2fa.disable"
+	auditUserRestrict     = "user.restrict"
+	auditUserReinstate    = "user.reinstate"
+	auditUserLogout       = "user.logout"
+	auditUserImpersonate  = "user.impersonate"
+	// every request made with an impersonation token
+	auditImpersonatedView = "user.impersonate.view"
+	auditEntryCreate      = "entry.create"
+	auditEntryUpdate      = "entry.update"
+	auditEntryDelete      = "entry.delete"
+	auditEntryFlag        = "entry.flag"
+	auditEntryModerate    = "entry.moderate"
+	auditEntryRollback    = "entry.rollback"
+	auditEntryImport      = "entry.import"
+	auditAlertTypeCreate  = "alertType.create"
+	auditAlertTypeUpdate  = "alertType.update"
+	auditAlertTypeDelete  = "alertType.delete"
+)
+
+const (
+	defaultAuditLogsLimit = 100
+	maxAuditLogsLimit     = 1000
+
+	requestIDHeader = "X-Request-ID"
+	// longer IDs sent by the proxies are replaced rather than stored
+	maxClientRequestIDBytes = 128
+)
+
+// requestIDPattern is what an X-Request-ID passed on by a proxy can look
+// like. Anything else could break the logs it is written to.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// RequestIDMiddleware tags every request with an ID so audit logs can be tied
+// back to the request that caused them. The X-Request-ID of a request from
+// the trusted proxies is kept, so their logs can be tied to ours, otherwise a
+// new one is generated. Either way it is sent back.
+func (api *API) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if len(id) > maxClientRequestIDBytes || !requestIDPattern.MatchString(id) || !api.conf.TrustsProxy(net.ParseIP(remoteHost(r))) {
+			id = primitive.NewObjectID().Hex()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), "RequestID", id) // nolint
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recordAudit logs a change made by the request. before and after are the
+// document before and after the change, either of which can be nil. A
+// failure to write the log doesn't fail the request, since the change has
+// already been made by then. For the same reason, the log is written even if
+// the request has run out of time.
+func (api *API) recordAudit(request *http.Request, action, collection, targetID string, before, after interface{}) {
+	requestID, _ := request.Context().Value("RequestID").(string)
+
+	entry := models.AuditLog{
+		Actor:      getAuditActor(request),
+		Action:     action,
+		Collection: collection,
+		TargetID:   targetID,
+		Route:      request.Method + " " + request.URL.Path,
+		IP:         api.getClientIP(request),
+		RequestID:  requestID,
+	}
+
+	ctx, cancel := detached(request)
+	defer cancel()
+	if err := api.handlers.RecordAudit(ctx, entry, before, after); err != nil {
+		logging.FromContext(request.Context()).Error("Failed to record audit log", "action", action, "collection", collection, "targetId", targetID, logging.Error(err))
+	}
+}
+
+// recordUserAudit records a change to a user. The user is read back to see
+// what the change did.
+func (api *API) recordUserAudit(request *http.Request, action string, before models.User) {
+	ctx, cancel := detached(request)
+	defer cancel()
+	after, err := api.handlers.FindUser(ctx, bson.M{"_id": before.ID})
+	if err != nil {
+		logging.FromContext(request.Context()).Warn("Failed to read back user for the audit log", "targetId", before.ID.Hex(), logging.Error(err))
+		api.recordAudit(request, action, "users", before.ID.Hex(), nil, nil)
+		return
+	}
+	api.recordAudit(request, action, "users", before.ID.Hex(), before, after)
+}
+
+// recordEntryAudit is recordUserAudit for entries.
+func (api *API) recordEntryAudit(request *http.Request, action string, before models.Entry) {
+	ctx, cancel := detached(request)
+	defer cancel()
+	after, err := api.handlers.GetEntryByID(ctx, before.ID.Hex())
+	if err != nil {
+		logging.FromContext(request.Context()).Warn("Failed to read back entry for the audit log", "targetId", before.ID.Hex(), logging.Error(err))
+		api.recordAudit(request, action, "entries", before.ID.Hex(), nil, nil)
+		return
+	}
+	api.recordAudit(request, action, "entries", before.ID.Hex(), before, after)
+}
+
+// withAuditUser makes the user the actor of changes recorded for requests they
+// make before they are logged in, like signing up.
+func withAuditUser(request *http.Request, id primitive.ObjectID) *http.Request {
+	ctx := context.WithValue(request.Context(), "UserID", id) // nolint
+	logging.With(ctx, "userId", id.Hex())
+	return request.WithContext(ctx)
+}
+
+// getAuditActor works out who made the request from what the authentication
+// middleware put in its context.
+func getAuditActor(request *http.Request) models.AuditActor {
+	if id, ok := request.Context().Value("ImpersonatorID").(primitive.ObjectID); ok {
+		return models.AuditActor{Type: "admin", ID: &id}
+	}
+	if id, ok := request.Context().Value("AdminID").(primitive.ObjectID); ok {
+		return models.AuditActor{Type: "admin", ID: &id}
+	}
+	if id, ok := request.Context().Value("UserID").(primitive.ObjectID); ok {
+		return models.AuditActor{Type: "user", ID: &id}
+	}
+	return models.AuditActor{Type: "anonymous"}
+}
+
+// GetAuditLogsEndpoint lists audit logs, newest first. They can be filtered by
+// actor, action, collection, target and a from/to date range, and downloaded
+// as CSV with format=csv.
+func (c AdminController) GetAuditLogsEndpoint(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	filter := handlers.AuditFilter{
+		Action:     query.Get("action"),
+		Collection: query.Get("collection"),
+		TargetID:   query.Get("target"),
+		Limit:      defaultAuditLogsLimit,
+	}
+
+	if actor := query.Get("actor"); actor != "" {
+		id, err := primitive.ObjectIDFromHex(actor)
+		if err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("actor"), defaultRes)
+			return
+		}
+		filter.ActorID = &id
+	}
+
+	var ok bool
+	if filter.From, filter.To, ok = parseDateRange(response, query); !ok {
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("limit"), defaultRes)
+			return
+		}
+		filter.Limit = n
+	}
+
+	if query.Get("format") == "csv" {
+		// exports aren't capped unless a limit is asked for
+		if query.Get("limit") == "" {
+			filter.Limit = 0
+		}
+
+		sendDownload(response, request, "text/csv", "audit-logs.csv", func(w io.Writer) error {
+			return c.handlers.ExportAuditLogsCSV(request.Context(), filter, w)
+		})
+		return
+	}
+
+	if filter.Limit > maxAuditLogsLimit {
+		filter.Limit = maxAuditLogsLimit
+	}
+
+	logs, err := c.handlers.GetAuditLogs(request.Context(), filter)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	SendSuccessResponse(response, logs)
+}
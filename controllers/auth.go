@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type twoFactorBody struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Password  string `json:"password"`
+}
+
+// authenticateLogin checks the login credentials and enforces the login
+// attempt limits. Unknown emails and wrong passwords get the same response so
+// the endpoint can't be used to find out who has an account. It writes the
+// error response itself and returns false if the login should not go ahead.
+func (api *API) authenticateLogin(response http.ResponseWriter, request *http.Request, body loginBody, isAdmin bool) (models.User, bool) {
+	ip := api.getClientIP(request)
+
+	if ok := api.checkLoginAllowed(response, request, body.Email, isAdmin, ip); !ok {
+		return models.User{}, false
+	}
+
+	user, err := api.handlers.GetUserByEmail(request.Context(), body.Email, isAdmin)
+	if err != nil && err != mongo.ErrNoDocuments {
+		SendError(response, err)
+		return user, false
+	}
+
+	// an unknown user has an empty hash, which never matches
+	if correct := handlers.ComparePasswords(user.Password, []byte(body.Password)); !correct {
+		api.recordFailedLogin(request, user, body.Email, isAdmin, ip)
+		SendErrorResponse(response, http.StatusUnauthorized, constants.IncorrectCredentials, defaultRes)
+		return user, false
+	}
+
+	if err := api.handlers.ResetLoginAttempts(request.Context(), body.Email, isAdmin); err != nil {
+		logging.FromContext(request.Context()).Error("Failed to reset login attempts", logging.Error(err))
+	}
+
+	return user, true
+}
+
+// checkLoginAllowed writes a 429 and returns false if the account or IP has
+// to wait before trying to log in again.
+func (api *API) checkLoginAllowed(response http.ResponseWriter, request *http.Request, email string, isAdmin bool, ip string) bool {
+	wait, err := api.handlers.CheckLoginAllowed(request.Context(), email, isAdmin, ip)
+	if err != nil {
+		SendError(response, err)
+		return false
+	}
+
+	if wait > 0 {
+		response.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		SendErrorResponse(response, http.StatusTooManyRequests, constants.TooManyAttempts(wait), defaultRes)
+		return false
+	}
+
+	return true
+}
+
+// recordFailedLogin counts a failed attempt and lets the user know if it
+// locked their account. user is empty if the email doesn't exist.
+func (api *API) recordFailedLogin(request *http.Request, user models.User, email string, isAdmin bool, ip string) {
+	locked, err := api.handlers.RecordFailedLogin(request.Context(), email, isAdmin, ip)
+	if err != nil {
+		logging.FromContext(request.Context()).Error("Failed to record login attempt", logging.Error(err))
+	}
+
+	if locked && user.Email != "" {
+		if err := api.handlers.NotifyAccountLocked(request.Context(), user); err != nil {
+			logging.FromContext(request.Context()).Error("Failed to send lockout notification", logging.Error(err))
+		}
+	}
+}
+
+// sendLoginResponse finishes a login once the user's first factor has been
+// checked. Users with 2FA get a challenge to exchange for a session token,
+// and admins who have to use 2FA but haven't set it up get a token that only
+// lets them enrol.
+func (api *API) sendLoginResponse(response http.ResponseWriter, user models.User) {
+	var token string
+	var err error
+
+	if err := handlers.CheckRestriction(user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+
+	switch {
+	case user.TwoFactor.Enabled:
+		token, err = api.handlers.GenerateChallengeToken(&user, constants.TOKEN_PURPOSE_2FA_CHALLENGE)
+		data["twoFactorRequired"] = true
+		data["challenge"] = token
+	case user.IsAdmin && api.handlers.AdminTwoFactorRequired():
+		token, err = api.handlers.GenerateChallengeToken(&user, constants.TOKEN_PURPOSE_2FA_ENROL)
+		data["twoFactorEnrolmentRequired"] = true
+		data["enrolmentToken"] = token
+	default:
+		token, err = api.handlers.GenerateJWTToken(&user)
+		data["token"] = token
+	}
+
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	SendSuccessResponse(response, data)
+}
+
+func (api *API) twoFactorLogin(response http.ResponseWriter, request *http.Request, isAdmin bool) {
+	var body twoFactorBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	valid, claim := api.handlers.VerifyPurposeToken(body.Challenge, constants.TOKEN_PURPOSE_2FA_CHALLENGE, isAdmin)
+	if !valid {
+		SendErrorResponse(response, http.StatusUnauthorized, constants.AccessDenied, defaultRes)
+		return
+	}
+
+	user, err := api.handlers.GetUser(request.Context(), bson.M{"_id": claim.UserID, "isAdmin": isAdmin})
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	// codes are guessable too, so they share the login attempt limits
+	ip := api.getClientIP(request)
+	if ok := api.checkLoginAllowed(response, request, user.Email, isAdmin, ip); !ok {
+		return
+	}
+
+	correct, err := api.handlers.VerifyTwoFactorCode(request.Context(), user, body.Code)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	if !correct {
+		api.recordFailedLogin(request, user, user.Email, isAdmin, ip)
+		SendErrorResponse(response, http.StatusUnauthorized, constants.InvalidTwoFactorCode, defaultRes)
+		return
+	}
+
+	if err := api.handlers.ResetLoginAttempts(request.Context(), user.Email, isAdmin); err != nil {
+		logging.FromContext(request.Context()).Error("Failed to reset login attempts", logging.Error(err))
+	}
+
+	token, err := api.handlers.GenerateJWTToken(&user)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	SendSuccessResponse(response, map[string]string{"token": token})
+}
+
+func (api *API) setupTwoFactor(response http.ResponseWriter, request *http.Request, isAdmin bool) {
+	user, err := api.getRequestUser(request, isAdmin)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if user.TwoFactor.Enabled {
+		SendErrorResponse(response, http.StatusBadRequest, "Two-factor authentication is already enabled.", defaultRes)
+		return
+	}
+
+	key, err := api.handlers.StartTwoFactorEnrolment(request.Context(), user)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	api.recordUserAudit(request, auditTwoFactorSetup, user)
+
+	// the URI is meant to be rendered as a QR code by the client
+	data := map[string]string{"secret": key.Secret(), "uri": key.URL()}
+	SendSuccessResponse(response, data)
+}
+
+func (api *API) confirmTwoFactor(response http.ResponseWriter, request *http.Request, isAdmin bool) {
+	var body twoFactorBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	user, err := api.getRequestUser(request, isAdmin)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	before := user
+	codes, err := api.handlers.ConfirmTwoFactorEnrolment(request.Context(), &user, body.Code)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	api.recordUserAudit(request, auditTwoFactorConfirm, before)
+
+	// the old token doesn't carry the second factor, so hand out a new one
+	token, err := api.handlers.GenerateJWTToken(&user)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	data := map[string]interface{}{"recoveryCodes": codes, "token": token}
+	SendSuccessResponse(response, data)
+}
+
+func (api *API) disableTwoFactor(response http.ResponseWriter, request *http.Request, isAdmin bool) {
+	var body twoFactorBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if isAdmin && api.handlers.AdminTwoFactorRequired() {
+		SendErrorResponse(response, http.StatusForbidden, constants.TwoFactorRequired, defaultRes)
+		return
+	}
+
+	user, err := api.getRequestUser(request, isAdmin)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if ok := api.checkCurrentPassword(response, request, user, body.Password); !ok {
+		return
+	}
+
+	correct, err := api.handlers.VerifyTwoFactorCode(request.Context(), user, body.Code)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	if !correct {
+		SendErrorResponse(response, http.StatusUnauthorized, constants.InvalidTwoFactorCode, defaultRes)
+		return
+	}
+
+	if err := api.handlers.DisableTwoFactor(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	api.recordUserAudit(request, auditTwoFactorDisable, user)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// checkSession writes a 401 and returns false if the token's session has been
+// ended, e.g. because the user was banned.
+func (api *API) checkSession(response http.ResponseWriter, request *http.Request, claim *handlers.JwtClaim) bool {
+	return sessionValid(response, api.handlers.CheckSession(request.Context(), claim))
+}
+
+// checkImpersonation is checkSession for impersonation tokens, which also
+// stop working when the admin they were issued to can no longer use them.
+func (api *API) checkImpersonation(response http.ResponseWriter, request *http.Request, claim *handlers.JwtClaim) bool {
+	return sessionValid(response, api.handlers.CheckImpersonation(request.Context(), claim))
+}
+
+// sessionValid writes the error the session was checked with, if there is
+// one, and returns whether there wasn't.
+func sessionValid(response http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	if err == mongo.ErrNoDocuments {
+		err = constants.UnauthorizedError(constants.SessionEnded)
+	}
+	SendError(response, err)
+	return false
+}
+
+// getRequestUser loads the user the request was authenticated as.
+func (api *API) getRequestUser(request *http.Request, isAdmin bool) (models.User, error) {
+	key := "UserID"
+	if isAdmin {
+		key = "AdminID"
+	}
+
+	id, ok := request.Context().Value(key).(primitive.ObjectID)
+	if !ok {
+		return models.User{}, mongo.ErrNoDocuments
+	}
+
+	return api.handlers.GetUser(request.Context(), bson.M{"_id": id, "isAdmin": isAdmin})
+}
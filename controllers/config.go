@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// API holds what the controllers run with: their settings, the handlers
+// they call and the state they keep between requests. Every controller
+// embeds it.
+type API struct {
+	conf     *config.Config
+	handlers *handlers.Handlers
+	validate *validator.Validate
+
+	// how often each client can export entries, nil if they aren't limited
+	exportLimiter *rateLimiter
+}
+
+// NewAPI returns an API that runs with cfg and calls h.
+func NewAPI(cfg *config.Config, h *handlers.Handlers) *API {
+	api := &API{conf: cfg, handlers: h, validate: newValidator(h)}
+	if n := cfg.RateLimits.Exports; n > 0 {
+		api.exportLimiter = newRateLimiter(time.Hour/time.Duration(n), n)
+	}
+	return api
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// responseGrace is how long a request has to send its response once its
+// deadline has passed, e.g. to say it timed out.
+const responseGrace = 5 * time.Second
+
+// detachedTimeout is how long detached work gets.
+const detachedTimeout = 10 * time.Second
+
+// RequestDeadlines gives each request a deadline, after which whatever it is
+// waiting on is canceled. Requests get REQUEST_TIMEOUT, unless their route
+// has a timeout of its own in ROUTE_TIMEOUTS. Handlers pass the deadline on
+// with request.Context().
+func (api *API) RequestDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		timeout := api.conf.Timeouts.For(r.Method, route)
+
+		// the server's read and write timeouts would cut routes that get
+		// longer off, e.g. while an import is still reading its file
+		deadline := time.Now().Add(timeout + responseGrace)
+		controller := http.NewResponseController(w)
+		if timeout+responseGrace > api.conf.Server.ReadTimeout {
+			_ = controller.SetReadDeadline(deadline)
+		}
+		if timeout+responseGrace > api.conf.Server.WriteTimeout {
+			_ = controller.SetWriteDeadline(deadline)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// detached returns a context for work that has to be finished once a change
+// has been made, like recording it in the audit log, even if the request has
+// timed out or the client has gone. It keeps the request's logger and span.
+func detached(request *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(request.Context()), detachedTimeout)
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+
+	"github.com/OpeOnikute/mrkt-api/logging"
+)
+
+// downloadBufferSize is how much of a download is held back before any of it
+// is sent. Downloads that fail before then get a proper error response.
+const downloadBufferSize = 32 * 1024
+
+// sendDownload streams a file to the client as write produces it. Until the
+// first downloadBufferSize bytes are written, nothing has been sent, so an
+// error gets the usual error response. After that the status has gone, so
+// the connection is cut instead, and clients can tell the file is incomplete.
+func sendDownload(response http.ResponseWriter, request *http.Request, contentType, filename string, write func(io.Writer) error) {
+	w := &downloadWriter{response: response, contentType: contentType, filename: filename}
+	buffered := bufio.NewWriterSize(w, downloadBufferSize)
+
+	err := write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		return
+	}
+
+	if !w.started {
+		SendError(response, err)
+		return
+	}
+	// logged here, since aborted requests aren't logged when they end
+	logging.FromContext(request.Context()).Error("Failed to send a download", "filename", filename, logging.Error(err))
+	panic(http.ErrAbortHandler)
+}
+
+// downloadWriter sends the download's headers before the first of it.
+type downloadWriter struct {
+	response    http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (w *downloadWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.response.Header().Set("Content-Type", w.contentType)
+		w.response.Header().Set("Content-Disposition", `attachment; filename="`+w.filename+`"`)
+		w.started = true
+	}
+	return w.response.Write(b)
+}
@@ -7,8 +7,11 @@ import (
 
 	"github.com/OpeOnikute/mrkt-api/constants"
 	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/metrics"
 	"github.com/OpeOnikute/mrkt-api/models"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/gorilla/mux"
@@ -16,7 +19,9 @@ import (
 )
 
 // EntriesController ...
-type EntriesController struct{}
+type EntriesController struct {
+	*API
+}
 
 // AddEntryEndpoint ...
 func (c EntriesController) AddEntryEndpoint(response http.ResponseWriter, request *http.Request) {
@@ -29,148 +34,261 @@ func (c EntriesController) AddEntryEndpoint(response http.ResponseWriter, reques
 		return
 	}
 
-	if ok, errors := validateRequest(entry); !ok {
+	if ok, errors := c.validateRequest(request, entry); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
 	// validate incident type
-	if _, err := alertTypeHandler.FindByID(entry.AlertType.Hex()); err != nil {
+	alertType, err := c.handlers.AlertTypes().FindByID(request.Context(), entry.AlertType.Hex())
+	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			SendErrorResponse(response, http.StatusBadRequest, constants.ResourceNotFound("alert type"), defaultRes)
 			return
 		}
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
-	if userID := request.Context().Value("UserID"); userID != nil {
-		entry.UploadedBy = userID
+	// Some alert types are held back until an admin approves them
+	entry.Moderation = models.Moderation{State: constants.MODERATION_NEW}
+	if alertType.RequiresModeration {
+		entry.Moderation.State = constants.MODERATION_PENDING
+	}
+
+	// Logged in users can still choose to report anonymously. We keep track
+	// of them so they can manage the entry, but nobody else gets to see it.
+	entry.UploadedBy = nil
+	entry.EditToken = ""
+	if userID, ok := request.Context().Value("UserID").(primitive.ObjectID); ok {
+		entry.UploadedBy = &userID
 	} else {
-		entry.UploadedBy = "anonymous"
+		entry.Anonymous = true
+	}
+
+	// shadow-banned users see their entries as usual, but nobody else does
+	entry.Hidden = false
+	if entry.UploadedBy != nil {
+		hidden, err := c.handlers.IsShadowBanned(request.Context(), *entry.UploadedBy)
+		if err != nil {
+			SendError(response, err)
+			return
+		}
+		entry.Hidden = hidden
+	}
+
+	data := make(map[string]interface{})
+
+	if entry.Anonymous {
+		token, err := handlers.NewEditToken(entry)
+		if err != nil {
+			SendError(response, err)
+			return
+		}
+		// only ever sent once. Without it an anonymous reporter can't
+		// change the entry.
+		data["editToken"] = token
 	}
 
-	result, err := handlers.CreateEntry(entry)
+	result, err := c.handlers.CreateEntry(request.Context(), entry)
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
+		return
 	}
-	SendSuccessResponse(response, result)
+
+	if _, err := c.handlers.SaveEntryRevision(request.Context(), *entry, getAuditActor(request), 0); err != nil {
+		logging.FromContext(request.Context()).Error("Failed to save the first revision of entry", "entryId", entry.ID.Hex(), logging.Error(err))
+	}
+
+	metrics.EntryCreated(alertType.Name, alertType.Level)
+	c.recordAudit(request, auditEntryCreate, "entries", entry.ID.Hex(), nil, entry)
+
+	data["InsertedID"] = result.InsertedID
+	SendSuccessResponse(response, data)
 }
 
 // UpdateEntryEndpoint ...
 func (c EntriesController) UpdateEntryEndpoint(response http.ResponseWriter, request *http.Request) {
-	// set response headers
-	response.Header().Set("content-type", "application/json")
 	// get ID
 	params := mux.Vars(request)
 	// get entry
-	entry, err := handlers.GetEntryByID(params["id"])
-	uploadedBy := entry.UploadedBy
+	entry, err := c.handlers.GetEntryByID(request.Context(), params["id"])
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "entry")
 		return
 	}
 
-	if json.NewDecoder(request.Body).Decode(&entry); err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+	if !canModifyEntry(request, entry) {
+		msg := "You don't have permission to modify this resource."
+		SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
 		return
 	}
 
-	if ok, errors := validateRequest(entry); !ok {
+	existing := entry
+
+	if err := json.NewDecoder(request.Body).Decode(&entry); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, entry); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
-	if userID := request.Context().Value("UserID"); userID != nil {
-		if uploadedBy != userID {
-			msg := "You don't have permission to modify this resource."
-			SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
-			return
-		}
-		// Prevent changing the uploadedBy param to another thing
-		entry.UploadedBy = userID
+	// Prevent changing who reported the entry and how it can be managed.
+	// Entries without a known reporter have to stay anonymous.
+	entry.ID = existing.ID
+	entry.UploadedBy = existing.UploadedBy
+	entry.EditToken = existing.EditToken
+	entry.Status = existing.Status
+	entry.Moderation = existing.Moderation
+	entry.FlagScore = existing.FlagScore
+	entry.Version = existing.Version
+	entry.Edited = existing.Edited
+	entry.EditedAt = existing.EditedAt
+	entry.Created = existing.Created
+	if entry.UploadedBy == nil {
+		entry.Anonymous = true
 	}
 
 	// update model
-	result, err := handlers.UpdateEntryByID(params["id"], entry)
+	entry, err = c.handlers.ReviseEntry(request.Context(), existing, entry, getAuditActor(request))
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+		SendError(response, err)
 		return
 	}
 
-	// send reponse
-	json.NewEncoder(response).Encode(result)
+	c.recordAudit(request, auditEntryUpdate, "entries", entry.ID.Hex(), existing, entry)
+
+	SendSuccessResponse(response, entry)
 }
 
 // DeleteEntryEndpoint ...
 func (c EntriesController) DeleteEntryEndpoint(response http.ResponseWriter, request *http.Request) {
-	// set response headers
-	response.Header().Set("content-type", "application/json")
 	// get ID
 	params := mux.Vars(request)
 	// get entry
-	entry, err := handlers.GetEntryByID(params["id"])
+	entry, err := c.handlers.GetEntryByID(request.Context(), params["id"])
 	if err != nil {
 		SendQueryErrorResponse(response, err, "entry")
 		return
 	}
 
-	if userID := request.Context().Value("UserID"); userID != nil {
-		if entry.UploadedBy != userID {
-			msg := "You don't have permission to modify this resource."
-			SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
-			return
-		}
+	if !canModifyEntry(request, entry) {
+		msg := "You don't have permission to modify this resource."
+		SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
+		return
 	}
 
 	// update model
-	result, err := handlers.DeleteEntryByID(entry)
+	result, err := c.handlers.DeleteEntryByID(request.Context(), entry)
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+		SendError(response, err)
 		return
 	}
 
-	// send reponse
-	json.NewEncoder(response).Encode(result)
+	c.recordEntryAudit(request, auditEntryDelete, entry)
+
+	SendSuccessResponse(response, result)
 }
 
 // GetEntriesEndpoint ...
 func (c EntriesController) GetEntriesEndpoint(response http.ResponseWriter, request *http.Request) {
 	q := bson.M{}
 
-	if userID := request.Context().Value("UserID"); userID != nil {
+	userID, isOwner := request.Context().Value("UserID").(primitive.ObjectID)
+	if isOwner {
 		q["uploadedBy"] = userID
+	} else {
+		q = handlers.PublicEntryQuery(q)
 	}
 
-	results, err := handlers.GetAllEntries(q)
+	results, err := c.handlers.GetAllEntries(request.Context(), q)
 	if err != nil {
 		SendQueryErrorResponse(response, err, "entry")
 		return
 	}
+
+	if !isOwner {
+		for i := range results {
+			results[i] = results[i].Public()
+		}
+	}
+
 	SendSuccessResponse(response, results)
 }
 
 // GetEntryEndpoint ...
 func (c EntriesController) GetEntryEndpoint(response http.ResponseWriter, request *http.Request) {
 	params := mux.Vars(request)
-	entry, err := handlers.GetEntryByID(params["id"])
+	entry, err := c.handlers.GetEntryByID(request.Context(), params["id"])
 	if err != nil {
 		SendQueryErrorResponse(response, err, "entry")
 		return
 	}
 
-	if userID := request.Context().Value("UserID"); userID != nil {
-		if entry.UploadedBy != userID {
+	if userID, ok := request.Context().Value("UserID").(primitive.ObjectID); ok {
+		if !entry.IsUploadedBy(userID) {
 			msg := "You don't have permission to access this resource."
 			SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
 			return
 		}
+		SendSuccessResponse(response, entry)
+		return
 	}
 
-	SendSuccessResponse(response, entry)
+	if !entry.IsPublic() {
+		SendQueryErrorResponse(response, mongo.ErrNoDocuments, "entry")
+		return
+	}
+
+	SendSuccessResponse(response, entry.Public())
+}
+
+// FlagEntryEndpoint lets users report an entry as spam, offensive etc.
+func (c EntriesController) FlagEntryEndpoint(response http.ResponseWriter, request *http.Request) {
+	flag := models.Flag{}
+
+	if err := json.NewDecoder(request.Body).Decode(&flag); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, flag); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	params := mux.Vars(request)
+	entry, err := c.handlers.GetEntryByID(request.Context(), params["id"])
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if !entry.IsPublic() || entry.IsUploadedBy(user.ID) {
+		msg := "You can't flag this entry."
+		SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
+		return
+	}
+
+	flag, err = c.handlers.FlagEntry(request.Context(), entry, user, flag)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordAudit(request, auditEntryFlag, "flags", flag.ID.Hex(), nil, flag)
+
+	SendSuccessResponse(response, flag)
 }
 
 // GetLocationRanking ...
@@ -193,12 +311,22 @@ func (c EntriesController) GetLocationRanking(response http.ResponseWriter, requ
 		return
 	}
 
-	result, err := handlers.GetLocationRanking(latFloat, lngFloat)
+	result, err := c.handlers.GetLocationRanking(request.Context(), latFloat, lngFloat)
 
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
 	SendSuccessResponse(response, result)
 }
+
+// canModifyEntry reports whether the request comes from the entry's reporter,
+// either as the logged in user who reported it or by presenting the edit
+// token that was handed out when it was reported anonymously.
+func canModifyEntry(request *http.Request, entry models.Entry) bool {
+	if userID, ok := request.Context().Value("UserID").(primitive.ObjectID); ok && entry.IsUploadedBy(userID) {
+		return true
+	}
+	return handlers.CheckEditToken(entry, request.Header.Get("X-Edit-Token"))
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// coarsest and finest coordinates can be rounded to. 1 decimal place is
+// about 11km, 4 is about 11m.
+const (
+	exportMinPrecision = 1
+	exportMaxPrecision = 4
+)
+
+// Content types of each export format
+var exportContentTypes = map[string]string{
+	constants.EXPORT_FORMAT_GEOJSON: "application/geo+json",
+	constants.EXPORT_FORMAT_CSV:     "text/csv",
+	constants.EXPORT_FORMAT_KML:     "application/vnd.google-earth.kml+xml",
+}
+
+// ExportEntriesEndpoint downloads public entries as GeoJSON, CSV or KML. They
+// can be filtered by area, date range and alert type, and their coordinates
+// rounded to a number of decimal places with precision. Each client can only
+// export so many times an hour.
+func (c EntriesController) ExportEntriesEndpoint(response http.ResponseWriter, request *http.Request) {
+	if ok := c.checkRateLimit(response, request, c.exportLimiter); !ok {
+		return
+	}
+
+	query := request.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = constants.EXPORT_FORMAT_GEOJSON
+	}
+	if !handlers.IsExportFormat(format) {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("format"), defaultRes)
+		return
+	}
+
+	var filter handlers.ExportFilter
+	var ok bool
+
+	if filter.From, filter.To, ok = parseDateRange(response, query); !ok {
+		return
+	}
+	if filter.Near, filter.Radius, ok = c.parseArea(response, query); !ok {
+		return
+	}
+
+	if alertType := query.Get("alertType"); alertType != "" {
+		id, err := primitive.ObjectIDFromHex(alertType)
+		if err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("alert type"), defaultRes)
+			return
+		}
+		filter.AlertType = &id
+	}
+
+	if precision := query.Get("precision"); precision != "" {
+		n, err := strconv.Atoi(precision)
+		if err != nil || n < exportMinPrecision || n > exportMaxPrecision {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("precision"), defaultRes)
+			return
+		}
+		filter.Precision = n
+	}
+
+	sendDownload(response, request, exportContentTypes[format], "entries."+format, func(w io.Writer) error {
+		return c.handlers.ExportEntries(request.Context(), filter, format, w)
+	})
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/db"
+)
+
+// HealthController ...
+type HealthController struct {
+	*API
+}
+
+// set once the API has been told to stop, so it is taken out of the service
+// while it finishes the requests it has
+var shuttingDown atomic.Bool
+
+// ShuttingDown makes the API report that it isn't ready any more.
+func ShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// LivenessEndpoint reports that the API is running. It doesn't check the
+// database, so the API isn't restarted when MongoDB is down.
+func (c HealthController) LivenessEndpoint(response http.ResponseWriter, request *http.Request) {
+	SendSuccessResponse(response, map[string]interface{}{"status": "ok"})
+}
+
+// ReadinessEndpoint reports whether the API can serve requests: MongoDB can
+// be reached and the indexes have been created.
+func (c HealthController) ReadinessEndpoint(response http.ResponseWriter, request *http.Request) {
+	if shuttingDown.Load() {
+		SendError(response, constants.UnavailableError("The API is shutting down."))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		SendError(response, constants.UnavailableError("MongoDB can't be reached."))
+		return
+	}
+
+	if !db.Migrated() {
+		SendError(response, constants.UnavailableError("The database hasn't been migrated yet."))
+		return
+	}
+
+	SendSuccessResponse(response, map[string]interface{}{"status": "ok"})
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// largest file that can be imported at once
+const importMaxBytes = 20 << 20
+
+// ImportEntriesEndpoint imports entries from an uploaded CSV or GeoJSON file,
+// sent as the multipart form field "file". The format is worked out from the
+// file name unless given in "format". "mapping" is a JSON object of entry
+// fields to the columns they are read from, and "dryRun" checks the file
+// without saving anything. It responds with what happened to every row.
+func (c AdminController) ImportEntriesEndpoint(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, importMaxBytes)
+
+	file, header, err := request.FormFile("file")
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("file"), defaultRes)
+		return
+	}
+	defer file.Close()
+
+	opts := handlers.ImportOptions{
+		Format:     strings.ToLower(request.FormValue("format")),
+		ImportedBy: getAuditActor(request),
+	}
+
+	if opts.Format == "" {
+		switch strings.ToLower(filepath.Ext(header.Filename)) {
+		case ".csv":
+			opts.Format = constants.IMPORT_FORMAT_CSV
+		case ".geojson", ".json":
+			opts.Format = constants.IMPORT_FORMAT_GEOJSON
+		}
+	}
+	if !handlers.IsImportFormat(opts.Format) {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("format"), defaultRes)
+		return
+	}
+
+	if mapping := request.FormValue("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &opts.Mapping); err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("mapping"), defaultRes)
+			return
+		}
+	}
+
+	if dryRun := request.FormValue("dryRun"); dryRun != "" {
+		if opts.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("dryRun"), defaultRes)
+			return
+		}
+	}
+
+	report, err := c.handlers.ImportEntries(request.Context(), file, opts)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	if !report.DryRun && report.Imported > 0 {
+		summary := bson.M{"format": opts.Format, "file": header.Filename, "imported": report.Imported, "failed": report.Failed}
+		c.recordAudit(request, auditEntryImport, "entries", "", nil, summary)
+	}
+
+	SendSuccessResponse(response, report)
+}
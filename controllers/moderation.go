@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type moderationBody struct {
+	Reason string `json:"reason"`
+}
+
+type bulkModerationBody struct {
+	IDs    []string `json:"ids" validate:"required,min=1"`
+	Action string   `json:"action" validate:"required"`
+	Reason string   `json:"reason"`
+}
+
+// GetAllEntriesEndpoint lists entries whatever their moderation state. They
+// can be filtered with the state and status query params.
+func (c AdminController) GetAllEntriesEndpoint(response http.ResponseWriter, request *http.Request) {
+	query := bson.M{}
+
+	if state := request.URL.Query().Get("state"); state != "" {
+		query["moderation.state"] = state
+	}
+
+	if status := request.URL.Query().Get("status"); status != "" {
+		query["status"] = status
+	}
+
+	results, err := c.handlers.GetAllEntries(request.Context(), query)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+	SendSuccessResponse(response, results)
+}
+
+// GetModerationQueueEndpoint lists the entries waiting for review
+func (c AdminController) GetModerationQueueEndpoint(response http.ResponseWriter, request *http.Request) {
+	results, err := c.handlers.GetModerationQueue(request.Context())
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+	SendSuccessResponse(response, results)
+}
+
+// GetFlaggedEntriesEndpoint lists entries users have flagged, most flagged
+// first
+func (c AdminController) GetFlaggedEntriesEndpoint(response http.ResponseWriter, request *http.Request) {
+	results, err := c.handlers.GetFlaggedEntries(request.Context())
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+	SendSuccessResponse(response, results)
+}
+
+// GetEntryFlagsEndpoint lists the flags raised on an entry
+func (c AdminController) GetEntryFlagsEndpoint(response http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("entry ID"), defaultRes)
+		return
+	}
+
+	results, err := c.handlers.GetFlags(request.Context(), bson.M{"entry": id})
+	if err != nil {
+		SendQueryErrorResponse(response, err, "flag")
+		return
+	}
+	SendSuccessResponse(response, results)
+}
+
+// ApproveEntryEndpoint ...
+func (c AdminController) ApproveEntryEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.moderateEntry(response, request, "approve")
+}
+
+// RejectEntryEndpoint ...
+func (c AdminController) RejectEntryEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.moderateEntry(response, request, "reject")
+}
+
+// HideEntryEndpoint ...
+func (c AdminController) HideEntryEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.moderateEntry(response, request, "hide")
+}
+
+// BulkModerateEndpoint applies the same action to several entries
+func (c AdminController) BulkModerateEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body bulkModerationBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	adminID, _ := request.Context().Value("AdminID").(primitive.ObjectID)
+
+	failed := c.handlers.BulkModerateEntries(request.Context(), body.IDs, body.Action, body.Reason, adminID, func(before, after models.Entry) {
+		c.recordAudit(request, auditEntryModerate, "entries", before.ID.Hex(), before, after)
+	})
+
+	data := map[string]interface{}{
+		"moderated": len(body.IDs) - len(failed),
+		"failed":    failed,
+	}
+	SendSuccessResponse(response, data)
+}
+
+func (api *API) moderateEntry(response http.ResponseWriter, request *http.Request, action string) {
+	var body moderationBody
+
+	// the reason is optional for approvals, so an empty body is fine
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+			return
+		}
+	}
+
+	params := mux.Vars(request)
+	entry, err := api.handlers.GetEntryByID(request.Context(), params["id"])
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+
+	adminID, _ := request.Context().Value("AdminID").(primitive.ObjectID)
+
+	before := entry
+	entry, err = api.handlers.ModerateEntry(request.Context(), entry, action, body.Reason, adminID)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	api.recordAudit(request, auditEntryModerate, "entries", entry.ID.Hex(), before, entry)
+
+	SendSuccessResponse(response, entry)
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/metrics"
+	"github.com/OpeOnikute/mrkt-api/tracing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// quietRoutes are logged at debug level, since they are requested every few
+// seconds by Kubernetes and Prometheus.
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// ObserveRequests logs, traces and records metrics for every request.
+//
+// Each request gets a span, continuing the trace in its traceparent header if
+// it has one. Handlers get a logger for the request from its context, tagged
+// with the request and trace IDs. Once the request has been handled, it is
+// logged with its route, status and how long it took. Panics are logged with
+// their stack and sent as internal errors.
+//
+// It has to come after RequestIDMiddleware.
+func ObserveRequests(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// the route template, so requests for different IDs are grouped
+		var route string
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanName := r.Method
+		if route != "" {
+			spanName += " " + route
+		}
+		ctx, span := tracing.Tracer().Start(ctx, spanName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+
+		requestID, _ := r.Context().Value("RequestID").(string)
+		logger := slog.Default().With("requestId", requestID, "method", r.Method, "route", route)
+		if sc := span.SpanContext(); sc.IsValid() {
+			logger = logger.With("traceId", sc.TraceID().String())
+		}
+		ctx = logging.NewContext(ctx, logger)
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					span.End()
+					panic(v)
+				}
+				lw.err = logging.Panic(v, debug.Stack())
+				if !lw.wroteHeader {
+					writeError(lw, http.StatusInternalServerError, constants.CodeInternal, constants.InternalErrorMessage, defaultRes)
+				}
+			}
+
+			args := []interface{}{
+				"path", r.URL.Path,
+				"status", lw.status,
+				"bytes", lw.bytes,
+				"latencyMs", float64(time.Since(start).Microseconds()) / 1000,
+			}
+			level := slog.LevelInfo
+			if quietRoutes[route] {
+				level = slog.LevelDebug
+			}
+			if lw.err.Key != "" {
+				args = append(args, lw.err)
+				level = slog.LevelError
+			}
+			logging.FromContext(ctx).Log(ctx, level, "request", args...)
+			metrics.ObserveRequest(r.Method, route, lw.status, time.Since(start))
+
+			span.SetAttributes(semconv.HTTPResponseStatusCode(lw.status))
+			if lw.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(lw.status))
+			}
+			span.End()
+		}()
+
+		router.ServeHTTP(lw, r.WithContext(ctx))
+	})
+}
+
+// logError logs an internal error with the request it failed. If the request
+// is logged by ObserveRequests, the error goes in that log.
+func logError(w http.ResponseWriter, err error) {
+	if lw, ok := w.(*loggingResponseWriter); ok {
+		lw.err = logging.Error(err)
+		return
+	}
+	slog.Error("Request failed", "requestId", w.Header().Get(requestIDHeader), logging.Error(err))
+}
+
+// loggingResponseWriter keeps track of what was sent, and the error that
+// failed the request if there was one.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+	err         slog.Attr
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend
+// its write deadline.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush lets exports keep streaming.
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
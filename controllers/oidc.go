@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/metrics"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type oidcTokenBody struct {
+	IDToken string `json:"idToken" validate:"required"`
+	// the nonce the app passed to the provider, which the ID token has to
+	// carry
+	Nonce string `json:"nonce" validate:"required"`
+}
+
+// OIDCAuthorizeEndpoint returns the URL to send a user to for logging in with
+// a provider.
+func (c UsersController) OIDCAuthorizeEndpoint(response http.ResponseWriter, request *http.Request) {
+	provider, ok := c.getOIDCProvider(response, request)
+	if !ok {
+		return
+	}
+
+	url, err := provider.AuthCodeURL()
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	SendSuccessResponse(response, map[string]string{"url": url})
+}
+
+// OIDCCallbackEndpoint is where the provider sends the user back to after
+// they log in.
+func (c UsersController) OIDCCallbackEndpoint(response http.ResponseWriter, request *http.Request) {
+	provider, ok := c.getOIDCProvider(response, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("error") != "" {
+		SendErrorResponse(response, http.StatusUnauthorized, query.Get("error_description"), defaultRes)
+		return
+	}
+
+	claims, err := provider.Exchange(request.Context(), query.Get("code"), query.Get("state"))
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.oidcLogin(response, request, provider, claims)
+}
+
+// OIDCTokenEndpoint logs in with an ID token the client got directly from
+// the provider, e.g. through the native Google or Apple sign in on mobile.
+func (c UsersController) OIDCTokenEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body oidcTokenBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	provider, ok := c.getOIDCProvider(response, request)
+	if !ok {
+		return
+	}
+
+	claims, err := provider.VerifyIDToken(request.Context(), body.IDToken, body.Nonce)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.oidcLogin(response, request, provider, claims)
+}
+
+func (api *API) oidcLogin(response http.ResponseWriter, request *http.Request, provider *handlers.OIDCProvider, claims handlers.OIDCClaims) {
+	user, result, err := api.handlers.LoginWithOIDC(request.Context(), provider.Name, claims)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	// the user isn't logged in yet, but they are the one making the change
+	request = withAuditUser(request, user.ID)
+	switch result {
+	case handlers.OIDCUserCreated:
+		metrics.SignedUp(provider.Name)
+		api.recordAudit(request, auditUserCreate, "users", user.ID.Hex(), nil, user)
+	case handlers.OIDCUserLinked:
+		before := bson.M{"identities": user.Identities[:len(user.Identities)-1]}
+		after := bson.M{"identities": user.Identities}
+		api.recordAudit(request, auditUserLink, "users", user.ID.Hex(), before, after)
+	}
+
+	api.sendLoginResponse(response, user)
+}
+
+func (api *API) getOIDCProvider(response http.ResponseWriter, request *http.Request) (*handlers.OIDCProvider, bool) {
+	params := mux.Vars(request)
+
+	provider, err := api.handlers.GetOIDCProvider(request.Context(), params["provider"])
+	if err != nil {
+		SendError(response, err)
+		return nil, false
+	}
+
+	return provider, true
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExportDataEndpoint downloads everything we hold about the logged in user.
+func (c UsersController) ExportDataEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	c.sendUserDataExport(response, request, user)
+}
+
+// EraseDataEndpoint permanently erases the logged in user's personal data.
+func (c UsersController) EraseDataEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body deleteAccountBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if ok := c.checkCurrentPassword(response, request, user, body.Password); !ok {
+		return
+	}
+
+	// recorded first, so it is erased along with the rest of the changes
+	// they made
+	c.recordAudit(request, auditUserErase, "users", user.ID.Hex(), nil, nil)
+
+	if err := c.handlers.EraseUserData(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// ExportUserDataEndpoint downloads everything we hold about a user, for
+// data requests that come in through support.
+func (c AdminController) ExportUserDataEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, ok := c.getUserFromParams(response, request)
+	if !ok {
+		return
+	}
+
+	c.sendUserDataExport(response, request, user)
+}
+
+// EraseUserDataEndpoint permanently erases a user's personal data.
+func (c AdminController) EraseUserDataEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, ok := c.getUserFromParams(response, request)
+	if !ok {
+		return
+	}
+
+	if err := c.handlers.EraseUserData(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	// the diff would only repeat the data that was just erased
+	c.recordAudit(request, auditUserErase, "users", user.ID.Hex(), nil, nil)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+func (api *API) sendUserDataExport(response http.ResponseWriter, request *http.Request, user models.User) {
+	// exports don't change anything, but who took personal data matters
+	api.recordAudit(request, auditUserExport, "users", user.ID.Hex(), nil, nil)
+
+	filename := fmt.Sprintf("mrkt-data-%s.zip", user.ID.Hex())
+	sendDownload(response, request, "application/zip", filename, func(w io.Writer) error {
+		return api.handlers.ExportUserData(request.Context(), user, w)
+	})
+}
+
+// getUserFromParams loads the user in the {id} route param, including
+// deleted ones.
+func (api *API) getUserFromParams(response http.ResponseWriter, request *http.Request) (models.User, bool) {
+	params := mux.Vars(request)
+
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("user ID"), defaultRes)
+		return models.User{}, false
+	}
+
+	isAdmin := request.URL.Query().Get("isAdmin") == "true"
+	user, err := api.handlers.FindUser(request.Context(), bson.M{"_id": id, "isAdmin": isAdmin})
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return user, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/models"
+)
+
+// profileBody lists the fields users can change on their own profile.
+// Changing the email needs the current password.
+type profileBody struct {
+	Username *string `json:"username" validate:"omitempty,min=1"`
+	Email    *string `json:"email" validate:"omitempty,email"`
+	Password string  `json:"password"`
+}
+
+type changePasswordBody struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword" validate:"required,min=8"`
+}
+
+type verifyEmailBody struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type deleteAccountBody struct {
+	Password string `json:"password"`
+}
+
+// GetProfileEndpoint ...
+func (c UsersController) GetProfileEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	user.Password = ""
+	SendSuccessResponse(response, user)
+}
+
+// UpdateProfileEndpoint changes the username straight away. A new email has
+// to be verified first, so it only starts the change.
+func (c UsersController) UpdateProfileEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body profileBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	// the email is what accounts are recovered and linked to login providers
+	// by, so whoever has the token can't take the account with it
+	changingEmail := body.Email != nil && *body.Email != user.Email
+	if changingEmail && !c.checkCurrentPassword(response, request, user, body.Password) {
+		return
+	}
+
+	data := make(map[string]interface{})
+
+	if body.Username != nil && *body.Username != user.Username {
+		if err := c.handlers.ChangeUsername(request.Context(), user, *body.Username); err != nil {
+			SendError(response, err)
+			return
+		}
+		data["username"] = *body.Username
+	}
+
+	if changingEmail {
+		if err := c.handlers.StartEmailChange(request.Context(), user, *body.Email); err != nil {
+			SendError(response, err)
+			return
+		}
+		data["emailVerificationSent"] = true
+	}
+
+	if len(data) > 0 {
+		c.recordUserAudit(request, auditUserUpdate, user)
+	}
+
+	SendSuccessResponse(response, data)
+}
+
+// VerifyEmailEndpoint confirms a change of email with the token that was sent
+// to the new address.
+func (c UsersController) VerifyEmailEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body verifyEmailBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if err := c.handlers.ConfirmEmailChange(request.Context(), user, body.Token); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordUserAudit(request, auditUserUpdate, user)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// ChangePasswordEndpoint ...
+func (c UsersController) ChangePasswordEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body changePasswordBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := c.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if ok := c.checkCurrentPassword(response, request, user, body.CurrentPassword); !ok {
+		return
+	}
+
+	// the user's other sessions end, so this one carries on with a new token
+	token, err := c.handlers.ChangePassword(request.Context(), user, body.NewPassword)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordUserAudit(request, auditUserUpdate, user)
+
+	SendSuccessResponse(response, map[string]interface{}{"token": token})
+}
+
+// DeleteAccountEndpoint lets users delete their own account.
+func (c UsersController) DeleteAccountEndpoint(response http.ResponseWriter, request *http.Request) {
+	var body deleteAccountBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	user, err := c.getRequestUser(request, false)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return
+	}
+
+	if ok := c.checkCurrentPassword(response, request, user, body.Password); !ok {
+		return
+	}
+
+	result, err := c.handlers.DeleteUserByID(request.Context(), user)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordUserAudit(request, auditUserDelete, user)
+
+	SendSuccessResponse(response, result)
+}
+
+// checkCurrentPassword makes sensitive changes require the user's password.
+// Users who signed up through a login provider don't have one, so they have
+// to have logged in recently instead, which someone who only has their token
+// hasn't. Wrong passwords count towards the same limits as failed logins, so
+// a stolen token can't be used to guess the password.
+func (api *API) checkCurrentPassword(response http.ResponseWriter, request *http.Request, user models.User, password string) bool {
+	if user.Password == "" {
+		issued, _ := request.Context().Value("TokenIssuedAt").(time.Time)
+		if time.Since(issued) > api.conf.Tokens.RecentLogin {
+			SendError(response, constants.UnauthorizedError(constants.RecentLoginRequired))
+			return false
+		}
+		return true
+	}
+
+	ip := api.getClientIP(request)
+	if ok := api.checkLoginAllowed(response, request, user.Email, user.IsAdmin, ip); !ok {
+		return false
+	}
+
+	if correct := handlers.ComparePasswords(user.Password, []byte(password)); !correct {
+		api.recordFailedLogin(request, user, user.Email, user.IsAdmin, ip)
+		SendErrorResponse(response, http.StatusUnauthorized, constants.IncorrectCredentials, defaultRes)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter limits how often each client, by IP, can make a request. A
+// client can make burst requests at once, and gets them back at one every
+// interval. Limits are kept in memory, so each replica of the API has its own.
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mu        sync.Mutex
+	clients   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{interval: interval, burst: burst, clients: make(map[string]*rate.Limiter)}
+}
+
+// reserve takes one of the client's requests. If they have none left, it
+// returns how long until they do.
+func (l *rateLimiter) reserve(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	limiter, ok := l.clients[client]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Every(l.interval), l.burst)
+		l.clients[client] = limiter
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if wait := reservation.DelayFrom(now); wait > 0 {
+		reservation.CancelAt(now)
+		return wait, false
+	}
+	return 0, true
+}
+
+// sweep forgets clients who have all their requests back, since they are no
+// different from new ones. The lock must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.interval {
+		return
+	}
+	for client, limiter := range l.clients {
+		if limiter.TokensAt(now) >= float64(l.burst) {
+			delete(l.clients, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// checkRateLimit writes a 429 and returns false if the client has used up
+// their requests. A nil limiter doesn't limit.
+func (api *API) checkRateLimit(response http.ResponseWriter, request *http.Request, limiter *rateLimiter) bool {
+	if limiter == nil {
+		return true
+	}
+
+	wait, ok := limiter.reserve(api.getClientIP(request))
+	if !ok {
+		response.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		SendError(response, constants.RateLimitedError(constants.TooManyRequests(wait)))
+	}
+	return ok
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type restrictionBody struct {
+	Reason string     `json:"reason" validate:"required"`
+	Until  *time.Time `json:"until"`
+}
+
+// SuspendUserEndpoint stops a user from using their account until a given
+// time.
+func (c AdminController) SuspendUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.restrictUser(response, request, constants.RESTRICTION_SUSPENDED)
+}
+
+// BanUserEndpoint stops a user from using their account for good.
+func (c AdminController) BanUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.restrictUser(response, request, constants.RESTRICTION_BANNED)
+}
+
+// ShadowBanUserEndpoint hides a user's entries from everyone else, without
+// telling them.
+func (c AdminController) ShadowBanUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.restrictUser(response, request, constants.RESTRICTION_SHADOW_BANNED)
+}
+
+// ReinstateUserEndpoint lifts a user's suspension, ban or shadow-ban.
+func (c AdminController) ReinstateUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, ok := c.getRestrictableUser(response, request)
+	if !ok {
+		return
+	}
+
+	if err := c.handlers.LiftRestriction(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordUserAudit(request, auditUserReinstate, user)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// LogoutUserEndpoint ends all of a user's sessions.
+func (c AdminController) LogoutUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, ok := c.getRestrictableUser(response, request)
+	if !ok {
+		return
+	}
+
+	if err := c.handlers.ForceLogout(request.Context(), user); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordUserAudit(request, auditUserLogout, user)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// ImpersonateUserEndpoint issues a read-only token to see the API as the user
+// does, for support. Every request made with it is audited.
+func (c AdminController) ImpersonateUserEndpoint(response http.ResponseWriter, request *http.Request) {
+	user, ok := c.getRestrictableUser(response, request)
+	if !ok {
+		return
+	}
+
+	adminID, _ := request.Context().Value("AdminID").(primitive.ObjectID)
+
+	token, err := c.handlers.GenerateImpersonationToken(user, adminID)
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+
+	c.recordAudit(request, auditUserImpersonate, "users", user.ID.Hex(), nil, nil)
+
+	data := map[string]interface{}{
+		"token":   token,
+		"expires": time.Now().Add(c.conf.Tokens.Impersonation),
+	}
+	SendSuccessResponse(response, data)
+}
+
+func (api *API) restrictUser(response http.ResponseWriter, request *http.Request, state string) {
+	var body restrictionBody
+
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
+		return
+	}
+
+	if ok, errors := api.validateRequest(request, body); !ok {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
+		return
+	}
+
+	// only suspensions end on their own
+	if state == constants.RESTRICTION_SUSPENDED {
+		if body.Until == nil || body.Until.Before(time.Now()) {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("until"), defaultRes)
+			return
+		}
+	} else {
+		body.Until = nil
+	}
+
+	user, ok := api.getRestrictableUser(response, request)
+	if !ok {
+		return
+	}
+
+	adminID, _ := request.Context().Value("AdminID").(primitive.ObjectID)
+
+	restriction := models.Restriction{
+		State:        state,
+		Reason:       body.Reason,
+		Until:        body.Until,
+		RestrictedBy: adminID,
+	}
+
+	if err := api.handlers.RestrictUser(request.Context(), user, restriction); err != nil {
+		SendError(response, err)
+		return
+	}
+
+	api.recordUserAudit(request, auditUserRestrict, user)
+
+	SendSuccessResponse(response, defaultRes)
+}
+
+// getRestrictableUser loads the user in the {id} route param. Admins can't be
+// restricted or impersonated.
+func (api *API) getRestrictableUser(response http.ResponseWriter, request *http.Request) (models.User, bool) {
+	params := mux.Vars(request)
+
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("user ID"), defaultRes)
+		return models.User{}, false
+	}
+
+	user, err := api.handlers.GetUser(request.Context(), bson.M{"_id": id, "isAdmin": false})
+	if err != nil {
+		SendQueryErrorResponse(response, err, "user")
+		return user, false
+	}
+
+	return user, true
+}
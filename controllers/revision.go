@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetEntryRevisionsEndpoint lists the versions of an entry, oldest first.
+func (c EntriesController) GetEntryRevisionsEndpoint(response http.ResponseWriter, request *http.Request) {
+	entry, isOwner, ok := c.getViewableEntry(response, request)
+	if !ok {
+		return
+	}
+
+	revisions, err := c.handlers.GetEntryRevisions(request.Context(), entry.ID)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "revision")
+		return
+	}
+
+	if !isOwner {
+		for i := range revisions {
+			revisions[i] = revisions[i].Public(entry)
+		}
+	}
+
+	SendSuccessResponse(response, revisions)
+}
+
+// GetEntryRevisionDiffEndpoint shows what changed between two versions of an
+// entry. By default it compares the latest version with the one before.
+func (c EntriesController) GetEntryRevisionDiffEndpoint(response http.ResponseWriter, request *http.Request) {
+	entry, _, ok := c.getViewableEntry(response, request)
+	if !ok {
+		return
+	}
+
+	to, ok := getVersionParam(response, request.URL.Query().Get("to"), entry.Version)
+	if !ok {
+		return
+	}
+
+	from, ok := getVersionParam(response, request.URL.Query().Get("from"), to-1)
+	if !ok {
+		return
+	}
+
+	changes, err := c.handlers.DiffEntryRevisions(request.Context(), entry.ID, from, to)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "revision")
+		return
+	}
+
+	data := map[string]interface{}{"from": from, "to": to, "changes": changes}
+	SendSuccessResponse(response, data)
+}
+
+// GetEntryRevisionsEndpoint lists the versions of any entry, with who made
+// each one.
+func (c AdminController) GetEntryRevisionsEndpoint(response http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("entry ID"), defaultRes)
+		return
+	}
+
+	revisions, err := c.handlers.GetEntryRevisions(request.Context(), id)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "revision")
+		return
+	}
+
+	SendSuccessResponse(response, revisions)
+}
+
+// RollbackEntryEndpoint restores an earlier version of an entry.
+func (c AdminController) RollbackEntryEndpoint(response http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+
+	entry, err := c.handlers.GetEntryByID(request.Context(), params["id"])
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return
+	}
+
+	version, ok := getVersionParam(response, params["version"], 0)
+	if !ok {
+		return
+	}
+
+	before := entry
+	entry, err = c.handlers.RollbackEntry(request.Context(), entry, version, getAuditActor(request))
+	if err != nil {
+		SendQueryErrorResponse(response, err, "revision")
+		return
+	}
+
+	c.recordAudit(request, auditEntryRollback, "entries", entry.ID.Hex(), before, entry)
+
+	SendSuccessResponse(response, entry)
+}
+
+// getViewableEntry loads the entry in the {id} route param if the request can
+// see it. Logged in users can only see their own entries, everyone else only
+// public ones. It writes the error response itself.
+func (api *API) getViewableEntry(response http.ResponseWriter, request *http.Request) (entry models.Entry, isOwner bool, ok bool) {
+	params := mux.Vars(request)
+	entry, err := api.handlers.GetEntryByID(request.Context(), params["id"])
+	if err != nil {
+		SendQueryErrorResponse(response, err, "entry")
+		return entry, false, false
+	}
+
+	if userID, ok := request.Context().Value("UserID").(primitive.ObjectID); ok {
+		if !entry.IsUploadedBy(userID) {
+			msg := "You don't have permission to access this resource."
+			SendErrorResponse(response, http.StatusForbidden, msg, defaultRes)
+			return entry, false, false
+		}
+		return entry, true, true
+	}
+
+	if !entry.IsPublic() {
+		SendQueryErrorResponse(response, mongo.ErrNoDocuments, "entry")
+		return entry, false, false
+	}
+
+	return entry, false, true
+}
+
+// getVersionParam parses a version number, falling back to def if it is
+// empty.
+func getVersionParam(response http.ResponseWriter, value string, def int) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("version"), defaultRes)
+		return 0, false
+	}
+	return version, true
+}
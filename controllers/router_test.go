@@ -0,0 +1,581 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/controllers"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/router"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testAPI is the whole API, routes and middleware, in front of in-memory
+// stores.
+type testAPI struct {
+	t       *testing.T
+	handler http.Handler
+	stores  store.Stores
+	h       *handlers.Handlers
+}
+
+func newTestAPI(t *testing.T, configure ...func(*config.Config)) *testAPI {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.JWTKey = "test"
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	stores := store.NewMemory()
+	h := handlers.New(cfg, stores)
+	return &testAPI{t: t, handler: router.GetRouter(controllers.NewAPI(cfg, h)), stores: stores, h: h}
+}
+
+// response is the envelope every JSON response is sent in.
+type response struct {
+	Status  string          `json:"status"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func (api *testAPI) request(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	api.t.Helper()
+
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			api.t.Fatal(err)
+		}
+	}
+	request := httptest.NewRequest(method, path, &b)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// call makes a request that should get status, and decodes the data sent
+// back into data if it isn't nil.
+func (api *testAPI) call(method, path, token string, body interface{}, status int, data interface{}) response {
+	api.t.Helper()
+
+	recorder := api.request(method, path, token, body)
+	var res response
+	if err := json.Unmarshal(recorder.Body.Bytes(), &res); err != nil {
+		api.t.Fatalf("%s %s: %v in %q", method, path, err, recorder.Body.String())
+	}
+	if recorder.Code != status {
+		api.t.Fatalf("%s %s: status = %d (%s), want %d", method, path, recorder.Code, res.Message, status)
+	}
+	if data != nil {
+		if err := json.Unmarshal(res.Data, data); err != nil {
+			api.t.Fatalf("%s %s: %v in %s", method, path, err, res.Data)
+		}
+	}
+	return res
+}
+
+func (api *testAPI) signUp(email, username string) string {
+	api.t.Helper()
+
+	var data struct{ Token string }
+	body := map[string]string{"email": email, "username": username, "password": "correct horse"}
+	api.call("POST", "/users/sign-up", "", body, http.StatusOK, &data)
+	return data.Token
+}
+
+func (api *testAPI) addAdmin(email string) (models.User, string) {
+	api.t.Helper()
+
+	admin := models.GetDefaultUser()
+	admin.Email = email
+	admin.Username = "admin"
+	admin.Password = "correct horse"
+	admin.IsAdmin = true
+	admin.AdminRole = constants.ADMIN_ROLE_SUPER
+	if _, err := api.h.CreateUser(context.Background(), admin); err != nil {
+		api.t.Fatal(err)
+	}
+
+	var data struct{ Token string }
+	body := map[string]string{"email": email, "password": "correct horse"}
+	api.call("POST", "/admin/login", "", body, http.StatusOK, &data)
+	return *admin, data.Token
+}
+
+func (api *testAPI) addEntry(title string) models.Entry {
+	api.t.Helper()
+
+	alertType := models.AlertType{ID: primitive.NewObjectID(), Name: "Flood", Level: 3}
+	if _, err := api.stores.AlertTypes.InsertOne(context.Background(), alertType); err != nil {
+		api.t.Fatal(err)
+	}
+
+	entry := *models.GetDefaultEntry()
+	entry.Title = title
+	entry.Description = "Water up to the knees"
+	entry.ContentURL = "https://example.com/flood.jpg"
+	entry.AlertType = alertType.ID
+	entry.Location.Coordinates = [2]float64{6.5244, 3.3792}
+	if _, err := api.stores.Entries.InsertOne(context.Background(), entry); err != nil {
+		api.t.Fatal(err)
+	}
+	return entry
+}
+
+func TestRouterWelcome(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+
+	var data struct{ Message string }
+	api.call("GET", "/", "", nil, http.StatusOK, &data)
+	if data.Message != constants.WELCOME_MESSAGE {
+		t.Errorf("message = %q, want the welcome message", data.Message)
+	}
+
+	recorder := api.request("GET", "/no/such/route", "", nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown route: status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestRouterRequestID(t *testing.T) {
+	t.Parallel()
+	// httptest requests come from 192.0.2.1
+	api := newTestAPI(t, func(cfg *config.Config) { cfg.TrustedProxies = []string{"192.0.2.0/24"} })
+	untrusted := newTestAPI(t)
+
+	tests := []struct {
+		name string
+		api  *testAPI
+		id   string
+		kept bool
+	}{
+		{"from a proxy", api, "abc-123", true},
+		{"from anyone else", untrusted, "abc-123", false},
+		{"with a newline", api, "abc\nlevel=ERROR", false},
+		{"too long", api, strings.Repeat("a", 129), false},
+		{"not sent", api, "", false},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("X-Request-ID", tt.id)
+		recorder := httptest.NewRecorder()
+		tt.api.handler.ServeHTTP(recorder, request)
+
+		id := recorder.Header().Get("X-Request-ID")
+		if kept := id == tt.id; kept != tt.kept || id == "" {
+			t.Errorf("%s: request ID = %q, sent %q", tt.name, id, tt.id)
+		}
+	}
+}
+
+func TestRouterValidationLanguage(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "title is required."},
+		{"fr", "title est obligatoire."},
+		// without its region
+		{"fr-CA", "title est obligatoire."},
+		// the most preferred one we have
+		{"de, fr;q=0.8, en;q=0.5", "title est obligatoire."},
+		{"en;q=0.3, fr;q=0.9", "title est obligatoire."},
+		// q=0 means not at all
+		{"fr;q=0, de", "title is required."},
+		{"*", "title is required."},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest("POST", "/entry", strings.NewReader("{}"))
+		request.Header.Set("Accept-Language", tt.acceptLanguage)
+		recorder := httptest.NewRecorder()
+		api.handler.ServeHTTP(recorder, request)
+
+		var res struct {
+			Data struct{ Title string }
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v in %q", err, recorder.Body.String())
+		}
+		if recorder.Code != http.StatusBadRequest || res.Data.Title != tt.want {
+			t.Errorf("Accept-Language %q: status = %d, title = %q, want %q", tt.acceptLanguage, recorder.Code, res.Data.Title, tt.want)
+		}
+	}
+}
+
+func TestRouterRequestDeadlines(t *testing.T) {
+	t.Parallel()
+	cfg := config.Default()
+	cfg.Timeouts.Request = 30 * time.Second
+	cfg.Timeouts.Routes = map[string]time.Duration{"GET /entry/{id}": 10 * time.Minute}
+	api := controllers.NewAPI(cfg, handlers.New(cfg, store.NewMemory()))
+
+	// each route says how long it was given
+	router := mux.NewRouter()
+	router.Use(api.RequestDeadlines)
+	timeout := func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			t.Errorf("%s %s has no deadline", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(time.Until(deadline).Round(time.Second).String()))
+	}
+	router.HandleFunc("/entry/{id}", timeout).Methods("GET", "PUT")
+	router.HandleFunc("/entry", timeout).Methods("GET")
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/entry/123", "10m0s"},
+		// only the method it was set for
+		{"PUT", "/entry/123", "30s"},
+		{"GET", "/entry", "30s"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+		if got := recorder.Body.String(); got != tt.want {
+			t.Errorf("%s %s: timeout = %s, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouterSignUpAndLogIn(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+
+	token := api.signUp("ada@example.com", "ada")
+
+	var profile struct {
+		Username string
+		Email    string
+		Password string
+	}
+	api.call("GET", "/users/me", token, nil, http.StatusOK, &profile)
+	if profile.Username != "ada" || profile.Email != "ada@example.com" {
+		t.Errorf("profile = %+v, want ada's", profile)
+	}
+	if profile.Password != "" {
+		t.Error("the profile has the password hash in it")
+	}
+
+	var login struct{ Token string }
+	body := map[string]string{"email": "ada@example.com", "password": "correct horse"}
+	api.call("POST", "/users/login", "", body, http.StatusOK, &login)
+	if login.Token == "" {
+		t.Error("logging in didn't return a token")
+	}
+
+	body["password"] = "wrong horse"
+	api.call("POST", "/users/login", "", body, http.StatusUnauthorized, nil)
+
+	// the same email can't sign up twice, and passwords need 8 characters
+	body = map[string]string{"email": "ada@example.com", "username": "ada2", "password": "correct horse"}
+	api.call("POST", "/users/sign-up", "", body, http.StatusConflict, nil)
+	body = map[string]string{"email": "bola@example.com", "username": "bola", "password": "short"}
+	api.call("POST", "/users/sign-up", "", body, http.StatusBadRequest, nil)
+}
+
+func TestRouterRequiresAuthentication(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	userToken := api.signUp("ada@example.com", "ada")
+
+	api.call("GET", "/users/me", "", nil, http.StatusForbidden, nil)
+	api.call("GET", "/users/me", "not-a-token", nil, http.StatusForbidden, nil)
+
+	// user tokens don't work for admin routes
+	api.call("GET", "/admin/users", userToken, nil, http.StatusForbidden, nil)
+}
+
+func TestRouterFlagEntryOnce(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	token := api.signUp("ada@example.com", "ada")
+	entry := api.addEntry("Flooded road")
+
+	path := "/users/entry/" + entry.ID.Hex() + "/flag"
+	body := map[string]string{"reason": "fake"}
+	api.call("POST", path, token, body, http.StatusOK, nil)
+
+	res := api.call("POST", path, token, body, http.StatusConflict, nil)
+	if res.Message != constants.AlreadyFlagged {
+		t.Errorf("message = %q, want %q", res.Message, constants.AlreadyFlagged)
+	}
+
+	count, err := api.stores.Flags.Count(context.Background(), bson.M{"entry": entry.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d flags saved, want 1", count)
+	}
+}
+
+func TestRouterBanEndsSessions(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	userToken := api.signUp("ada@example.com", "ada")
+	_, adminToken := api.addAdmin("admin@example.com")
+
+	var user struct {
+		ID string `json:"_id"`
+	}
+	api.call("GET", "/users/me", userToken, nil, http.StatusOK, &user)
+
+	api.call("POST", "/admin/users/"+user.ID+"/ban", adminToken, map[string]string{"reason": "spam"}, http.StatusOK, nil)
+
+	api.call("GET", "/users/me", userToken, nil, http.StatusUnauthorized, nil)
+	body := map[string]string{"email": "ada@example.com", "password": "correct horse"}
+	api.call("POST", "/users/login", "", body, http.StatusForbidden, nil)
+
+	logs, err := api.stores.AuditLogs.Count(context.Background(), bson.M{"targetID": user.ID, "action": "user.restrict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs != 1 {
+		t.Errorf("%d audit logs of the ban, want 1", logs)
+	}
+}
+
+func TestRouterImpersonation(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	userToken := api.signUp("ada@example.com", "ada")
+	admin, adminToken := api.addAdmin("admin@example.com")
+
+	var user struct {
+		ID string `json:"_id"`
+	}
+	api.call("GET", "/users/me", userToken, nil, http.StatusOK, &user)
+
+	var impersonation struct{ Token string }
+	api.call("POST", "/admin/users/"+user.ID+"/impersonate", adminToken, nil, http.StatusOK, &impersonation)
+
+	var profile struct{ Username string }
+	api.call("GET", "/users/me", impersonation.Token, nil, http.StatusOK, &profile)
+	if profile.Username != "ada" {
+		t.Errorf("impersonating, username = %q, want ada", profile.Username)
+	}
+	api.call("PATCH", "/users/me", impersonation.Token, map[string]string{"username": "x"}, http.StatusForbidden, nil)
+
+	// the token stops working once the admin can't use it
+	update := bson.M{"$set": bson.M{"status": "deleted"}}
+	if _, err := api.stores.Users.UpdateOne(context.Background(), bson.M{"_id": admin.ID}, update); err != nil {
+		t.Fatal(err)
+	}
+	api.call("GET", "/users/me", impersonation.Token, nil, http.StatusUnauthorized, nil)
+}
+
+func TestRouterExport(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t, func(cfg *config.Config) { cfg.RateLimits.Exports = 2 })
+	entry := api.addEntry("Flooded road")
+
+	recorder := api.request("GET", "/entry/export?format=csv", "", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], entry.ID.Hex()+",Flooded road,") {
+		t.Errorf("export = %q, want a header and the entry", lines)
+	}
+
+	// bad parameters are turned away before anything is sent
+	api.call("GET", "/entry/export?format=xml", "", nil, http.StatusBadRequest, nil)
+
+	res := api.call("GET", "/entry/export", "", nil, http.StatusTooManyRequests, nil)
+	if res.Code != constants.CodeRateLimited {
+		t.Errorf("code = %q, want %q", res.Code, constants.CodeRateLimited)
+	}
+	if recorder := api.request("GET", "/entry/export", "", nil); recorder.Header().Get("Retry-After") == "" {
+		t.Error("a rate limited export has no Retry-After")
+	}
+}
+
+func TestRouterStats(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	userToken := api.signUp("ada@example.com", "ada")
+	_, adminToken := api.addAdmin("admin@example.com")
+	entry := api.addEntry("Flooded road")
+
+	var user struct {
+		ID string `json:"_id"`
+	}
+	api.call("GET", "/users/me", userToken, nil, http.StatusOK, &user)
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := bson.M{"$set": bson.M{"uploadedBy": userID}}
+	if _, err := api.stores.Entries.UpdateOne(context.Background(), bson.M{"_id": entry.ID}, update); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []models.EntryStat
+	api.call("GET", "/admin/stats/entries", adminToken, nil, http.StatusOK, &entries)
+	if len(entries) != 1 || entries[0].AlertType != "Flood" || entries[0].Count != 1 {
+		t.Errorf("entry stats = %+v, want one flood", entries)
+	}
+
+	var users models.UserStats
+	api.call("GET", "/admin/stats/users", adminToken, nil, http.StatusOK, &users)
+	if len(users.Signups) != 1 || users.Signups[0].Count != 1 || len(users.ActiveReporters) != 1 {
+		t.Errorf("user stats = %+v, want ada signing up and reporting", users)
+	}
+
+	api.call("GET", "/admin/stats/locations", adminToken, nil, http.StatusOK, nil)
+	api.call("GET", "/admin/stats/resolution", adminToken, nil, http.StatusOK, nil)
+
+	// ada reported the most, so ada is the top alpha
+	if _, err := api.h.RecomputeRankings(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var ranks []models.RankStat
+	api.call("GET", "/admin/stats/ranks", adminToken, nil, http.StatusOK, &ranks)
+	if len(ranks) != 1 || ranks[0].Rank != constants.ALPHA_RANK || ranks[0].Count != 1 {
+		t.Errorf("rank stats = %+v, want one alpha", ranks)
+	}
+}
+
+func TestRouterLoginDelay(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	api.signUp("ada@example.com", "ada")
+
+	body := map[string]string{"email": "ada@example.com", "password": "wrong horse"}
+	for i := 0; i < constants.LOGIN_FREE_ATTEMPTS; i++ {
+		api.call("POST", "/users/login", "", body, http.StatusUnauthorized, nil)
+	}
+
+	// even the right password has to wait once the free attempts are used up
+	body["password"] = "correct horse"
+	recorder := api.request("POST", "/users/login", "", body)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("a delayed login has no Retry-After")
+	}
+}
+
+func TestRouterChangePasswordEndsSessions(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	token := api.signUp("ada@example.com", "ada")
+
+	var user struct {
+		ID string `json:"_id"`
+	}
+	api.call("GET", "/users/me", token, nil, http.StatusOK, &user)
+
+	body := map[string]string{"currentPassword": "wrong horse", "newPassword": "battery staple"}
+	api.call("PUT", "/users/me/password", token, body, http.StatusUnauthorized, nil)
+
+	var changed struct{ Token string }
+	body["currentPassword"] = "correct horse"
+	api.call("PUT", "/users/me/password", token, body, http.StatusOK, &changed)
+	api.call("GET", "/users/me", changed.Token, nil, http.StatusOK, nil)
+
+	// sessions started before the change have ended
+	id, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &handlers.JwtClaim{UserID: id}
+	old.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	if err := api.h.CheckSession(context.Background(), old); err == nil {
+		t.Error("a session from before the change still works")
+	}
+
+	login := map[string]string{"email": "ada@example.com", "password": "battery staple"}
+	api.call("POST", "/users/login", "", login, http.StatusOK, nil)
+}
+
+func TestRouterEmailChangeNeedsPassword(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	token := api.signUp("ada@example.com", "ada")
+
+	api.call("PATCH", "/users/me", token, map[string]string{"email": "mallory@example.com"}, http.StatusUnauthorized, nil)
+
+	var data struct{ EmailVerificationSent bool }
+	body := map[string]string{"email": "ada@example.org", "password": "correct horse"}
+	api.call("PATCH", "/users/me", token, body, http.StatusOK, &data)
+	if !data.EmailVerificationSent {
+		t.Error("no verification was sent to the new address")
+	}
+
+	// the old address hears about the change once it is made
+	user, err := api.h.GetUserByEmail(context.Background(), "ada@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.h.ChangeEmail(context.Background(), user, "ada@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	var notifications []models.Notification
+	api.call("GET", "/users/notifications", token, nil, http.StatusOK, &notifications)
+	if len(notifications) != 1 || notifications[0].Type != constants.NOTIFICATION_EMAIL_CHANGED {
+		t.Errorf("notifications = %+v, want one about the email changing", notifications)
+	}
+}
+
+func TestRouterPasswordChecksAreLimited(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	token := api.signUp("ada@example.com", "ada")
+
+	body := map[string]string{"password": "wrong horse"}
+	for i := 0; i < constants.LOGIN_FREE_ATTEMPTS; i++ {
+		api.call("DELETE", "/users/me", token, body, http.StatusUnauthorized, nil)
+	}
+
+	// guesses made with the token count like failed logins
+	body["password"] = "correct horse"
+	api.call("DELETE", "/users/me", token, body, http.StatusTooManyRequests, nil)
+	api.call("POST", "/users/login", "", map[string]string{"email": "ada@example.com", "password": "correct horse"}, http.StatusTooManyRequests, nil)
+}
+
+func TestRouterDeleteAccountFreesEmail(t *testing.T) {
+	t.Parallel()
+	api := newTestAPI(t)
+	token := api.signUp("ada@example.com", "ada")
+
+	api.call("DELETE", "/users/me", token, map[string]string{"password": "correct horse"}, http.StatusOK, nil)
+
+	api.call("GET", "/users/me", token, nil, http.StatusUnauthorized, nil)
+	body := map[string]string{"email": "ada@example.com", "password": "correct horse"}
+	api.call("POST", "/users/login", "", body, http.StatusUnauthorized, nil)
+
+	// the address can be used for a new account
+	api.signUp("ada@example.com", "ada2")
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+)
+
+const (
+	// stats cover the last statsDefaultDays days unless a range is given
+	statsDefaultDays      = 30
+	statsDefaultLocations = 10
+	statsMaxLocations     = 100
+)
+
+// GetEntryStatsEndpoint counts entries per day or week by alert type and
+// level.
+func (c AdminController) GetEntryStatsEndpoint(response http.ResponseWriter, request *http.Request) {
+	filter, ok := c.getStatsFilter(response, request)
+	if !ok {
+		return
+	}
+
+	sendStats(response, func() (interface{}, error) {
+		return c.handlers.GetEntryStats(request.Context(), filter)
+	})
+}
+
+// GetTopLocationsEndpoint lists the suburbs, cities, states or countries with
+// the most entries.
+func (c AdminController) GetTopLocationsEndpoint(response http.ResponseWriter, request *http.Request) {
+	filter, ok := c.getStatsFilter(response, request)
+	if !ok {
+		return
+	}
+
+	field := request.URL.Query().Get("by")
+	if field == "" {
+		field = "suburb"
+	}
+	if !handlers.IsStatsLocationField(field) {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("by"), defaultRes)
+		return
+	}
+
+	limit := statsDefaultLocations
+	if value := request.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > statsMaxLocations {
+			SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("limit"), defaultRes)
+			return
+		}
+		limit = n
+	}
+
+	sendStats(response, func() (interface{}, error) {
+		return c.handlers.GetTopLocations(request.Context(), filter, field, limit)
+	})
+}
+
+// GetUserStatsEndpoint counts signups and active reporters per day or week.
+func (c AdminController) GetUserStatsEndpoint(response http.ResponseWriter, request *http.Request) {
+	filter, ok := c.getStatsFilter(response, request)
+	if !ok {
+		return
+	}
+
+	sendStats(response, func() (interface{}, error) {
+		return c.handlers.GetUserStats(request.Context(), filter)
+	})
+}
+
+// GetResolutionStatsEndpoint returns the median time entries wait for a
+// moderator's decision.
+func (c AdminController) GetResolutionStatsEndpoint(response http.ResponseWriter, request *http.Request) {
+	filter, ok := c.getStatsFilter(response, request)
+	if !ok {
+		return
+	}
+
+	sendStats(response, func() (interface{}, error) {
+		return c.handlers.GetResolutionStats(request.Context(), filter)
+	})
+}
+
+// GetRankStatsEndpoint counts users by rank.
+func (c AdminController) GetRankStatsEndpoint(response http.ResponseWriter, request *http.Request) {
+	sendStats(response, func() (interface{}, error) {
+		return c.handlers.GetRankDistribution(request.Context())
+	})
+}
+
+func sendStats(response http.ResponseWriter, get func() (interface{}, error)) {
+	stats, err := get()
+	if err != nil {
+		SendError(response, err)
+		return
+	}
+	SendSuccessResponse(response, stats)
+}
+
+// getStatsFilter reads the date range, interval and area stats are filtered
+// by. It writes the error response itself.
+func (api *API) getStatsFilter(response http.ResponseWriter, request *http.Request) (handlers.StatsFilter, bool) {
+	query := request.URL.Query()
+	filter := handlers.StatsFilter{Interval: query.Get("interval")}
+
+	from, to, ok := parseDateRange(response, query)
+	if !ok {
+		return filter, false
+	}
+
+	// default to whole days so the same request hits the cache all day
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if to.IsZero() {
+		to = today.Add(24*time.Hour - time.Nanosecond)
+	}
+	if from.IsZero() {
+		from = today.AddDate(0, 0, -statsDefaultDays)
+	}
+	if from.After(to) {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("from"), defaultRes)
+		return filter, false
+	}
+	filter.From, filter.To = from, to
+
+	if filter.Interval == "" {
+		filter.Interval = "day"
+	}
+	if !handlers.IsStatsInterval(filter.Interval) {
+		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParam("interval"), defaultRes)
+		return filter, false
+	}
+
+	if filter.Near, filter.Radius, ok = api.parseArea(response, query); !ok {
+		return filter, false
+	}
+
+	return filter, true
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/OpeOnikute/mrkt-api/constants"
-	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/metrics"
 	"github.com/OpeOnikute/mrkt-api/models"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,7 +17,9 @@ import (
 )
 
 // UsersController ...
-type UsersController struct{}
+type UsersController struct {
+	*API
+}
 
 // SignupEndpoint ...
 func (c UsersController) SignupEndpoint(response http.ResponseWriter, request *http.Request) {
@@ -22,27 +27,30 @@ func (c UsersController) SignupEndpoint(response http.ResponseWriter, request *h
 	user := models.GetDefaultUser()
 
 	if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendErrorResponse(response, http.StatusBadRequest, err.Error(), defaultRes)
 		return
 	}
 
 	user.IsAdmin = false
 
-	if ok, errors := validateRequest(user); !ok {
+	if ok, errors := c.validateRequest(request, user); !ok {
 		SendErrorResponse(response, http.StatusBadRequest, constants.InvalidParams, errors)
 		return
 	}
 
-	if _, err := handlers.CreateUser(user); err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+	if _, err := c.handlers.CreateUser(request.Context(), user); err != nil {
+		SendError(response, err)
 		return
 	}
 
+	metrics.SignedUp("password")
+	c.recordAudit(withAuditUser(request, user.ID), auditUserCreate, "users", user.ID.Hex(), nil, user)
+
 	// generate jwt token and send
-	token, err := handlers.GenerateJWTToken(user)
+	token, err := c.handlers.GenerateJWTToken(user)
 
 	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
+		SendError(response, err)
 		return
 	}
 
@@ -62,32 +70,32 @@ func (c UsersController) LoginEndpoint(response http.ResponseWriter, request *ht
 		return
 	}
 
-	user, err := handlers.GetUserByEmail(body.Email, false)
-	if err != nil {
-		SendQueryErrorResponse(response, err, "user")
-		return
-	}
-
-	// compare passwords
-	if correct := handlers.ComparePasswords(user.Password, []byte(body.Password)); correct != true {
-		SendErrorResponse(response, http.StatusUnauthorized, constants.IncorrectCredentials, defaultRes)
+	user, ok := c.authenticateLogin(response, request, body, false)
+	if !ok {
 		return
 	}
 
-	// generate jwt token and send
-	token, err := handlers.GenerateJWTToken(&user)
+	c.sendLoginResponse(response, user)
+}
 
-	if err != nil {
-		SendErrorResponse(response, http.StatusInternalServerError, err.Error(), defaultRes)
-		return
-	}
+// TwoFactorLoginEndpoint exchanges a login challenge and a 2FA code for a token
+func (c UsersController) TwoFactorLoginEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.twoFactorLogin(response, request, false)
+}
 
-	data := map[string]string{"token": token}
+// SetupTwoFactorEndpoint ...
+func (c UsersController) SetupTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.setupTwoFactor(response, request, false)
+}
 
-	// data := make(map[string]string)
-	// data["token"] = token
+// ConfirmTwoFactorEndpoint ...
+func (c UsersController) ConfirmTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.confirmTwoFactor(response, request, false)
+}
 
-	SendSuccessResponse(response, data)
+// DisableTwoFactorEndpoint ...
+func (c UsersController) DisableTwoFactorEndpoint(response http.ResponseWriter, request *http.Request) {
+	c.disableTwoFactor(response, request, false)
 }
 
 // DashboardEndpoint ...
@@ -107,14 +115,14 @@ func (c UsersController) DashboardEndpoint(response http.ResponseWriter, request
 		return
 	}
 
-	user, err := handlers.GetUserByID(id.Hex(), false)
+	user, err := c.handlers.GetUserByID(request.Context(), id.Hex(), false)
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "user")
 		return
 	}
 
-	entries, err := handlers.GetAllEntries(bson.M{"uploadedBy": id})
+	entries, err := c.handlers.GetAllEntries(request.Context(), bson.M{"uploadedBy": id})
 
 	if err != nil {
 		SendQueryErrorResponse(response, err, "entry")
@@ -128,16 +136,33 @@ func (c UsersController) DashboardEndpoint(response http.ResponseWriter, request
 	SendSuccessResponse(response, data)
 }
 
+// GetNotificationsEndpoint ...
+func (c UsersController) GetNotificationsEndpoint(response http.ResponseWriter, request *http.Request) {
+	id, ok := request.Context().Value("UserID").(primitive.ObjectID)
+	if !ok {
+		SendErrorResponse(response, http.StatusInternalServerError, "Something went wrong whilst fetching your data. Please try again.", defaultRes)
+		return
+	}
+
+	notifications, err := c.handlers.GetUserNotifications(request.Context(), id)
+	if err != nil {
+		SendQueryErrorResponse(response, err, "notification")
+		return
+	}
+
+	SendSuccessResponse(response, notifications)
+}
+
 // UserAuthenticationMiddleware is a Middleware function, which will be called for each request
 func (c UsersController) UserAuthenticationMiddleware(next http.Handler) http.Handler {
 
-	unauthenticated := []string{"/users/login", "/users/sign-up"}
+	unauthenticated := []string{"/users/login", "/users/login/2fa", "/users/sign-up"}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// ensure we are not validating an unauthenticated route
 		url := r.URL.String()
-		if yes := contains(unauthenticated, url); yes {
+		if yes := contains(unauthenticated, url) || strings.HasPrefix(r.URL.Path, "/users/oidc/"); yes {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -149,9 +174,34 @@ func (c UsersController) UserAuthenticationMiddleware(next http.Handler) http.Ha
 			return
 		}
 
-		if valid, claim := handlers.VerifyJWTToken(token, false); valid {
+		if valid, claim := c.handlers.VerifyPurposeToken(token, constants.TOKEN_PURPOSE_IMPERSONATION, false); valid && claim.Impersonator != nil {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				SendErrorResponse(w, http.StatusForbidden, constants.ImpersonationReadOnly, defaultRes)
+				return
+			}
+			if ok := c.checkImpersonation(w, r, claim); !ok {
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "UserID", claim.UserID)       // nolint
+			ctx = context.WithValue(ctx, "ImpersonatorID", *claim.Impersonator) // nolint
+			r = r.WithContext(ctx)
+			logging.With(ctx, "userId", claim.UserID.Hex(), "impersonatorId", claim.Impersonator.Hex())
+
+			c.recordAudit(r, auditImpersonatedView, "users", claim.UserID.Hex(), nil, nil)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if valid, claim := c.handlers.VerifyJWTToken(token, false); valid {
+			if ok := c.checkSession(w, r, claim); !ok {
+				return
+			}
+
 			// Pass down the request to the next middleware (or final handler)
-			ctx := context.WithValue(r.Context(), "UserID", claim.UserID) // nolint
+			ctx := context.WithValue(r.Context(), "UserID", claim.UserID)               // nolint
+			ctx = context.WithValue(ctx, "TokenIssuedAt", time.Unix(claim.IssuedAt, 0)) // nolint
+			logging.With(ctx, "userId", claim.UserID.Hex())
 			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			// Write an error and stop the handler chain
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// validationMessages are the messages for each validation tag, by locale. {0}
+// is the field and {1} the tag's param. min has a message for each kind of
+// field it can be on. invalid is for tags without a message of their own.
+var validationMessages = map[string]map[string]string{
+	"en": {
+		"required":    "{0} is required.",
+		"email":       "{0} must be a valid email address.",
+		"min":         "{0} must be at least {1} characters long.",
+		"min-items":   "{0} must have at least {1} items.",
+		"min-number":  "{0} must be {1} or more.",
+		"oneof":       "{0} must be one of {1}.",
+		"coordinates": "{0} must be a latitude between -90 and 90 and a longitude between -180 and 180.",
+		"contentType": "{0} must be one of {1}.",
+		"alertType":   "{0} must be the ID of an alert type.",
+		"invalid":     "{0} is not valid.",
+	},
+	"fr": {
+		"required":    "{0} est obligatoire.",
+		"email":       "{0} doit être une adresse e-mail valide.",
+		"min":         "{0} doit contenir au moins {1} caractères.",
+		"min-items":   "{0} doit contenir au moins {1} éléments.",
+		"min-number":  "{0} doit être supérieur ou égal à {1}.",
+		"oneof":       "{0} doit être l'une des valeurs suivantes : {1}.",
+		"coordinates": "{0} doit être une latitude entre -90 et 90 et une longitude entre -180 et 180.",
+		"contentType": "{0} doit être l'une des valeurs suivantes : {1}.",
+		"alertType":   "{0} doit être l'identifiant d'un type d'alerte.",
+		"invalid":     "{0} n'est pas valide.",
+	},
+}
+
+var translations = newTranslations()
+
+func newValidator(h *handlers.Handlers) *validator.Validate {
+	v := validator.New()
+
+	// name fields the way clients send them
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	_ = v.RegisterValidation("coordinates", func(fl validator.FieldLevel) bool {
+		coordinates, ok := fl.Field().Interface().([2]float64)
+		if !ok {
+			return false
+		}
+		lat, long := coordinates[0], coordinates[1]
+		return lat >= -90 && lat <= 90 && long >= -180 && long <= 180
+	})
+
+	_ = v.RegisterValidation("contentType", func(fl validator.FieldLevel) bool {
+		return handlers.IsContentType(fl.Field().String())
+	})
+
+	// Only a missing alert type fails validation. Any other error is left
+	// for the endpoint to run into when it loads the alert type itself.
+	_ = v.RegisterValidationCtx("alertType", func(ctx context.Context, fl validator.FieldLevel) bool {
+		id, ok := fl.Field().Interface().(primitive.ObjectID)
+		if !ok || id.IsZero() {
+			return false
+		}
+		_, err := h.AlertTypes().FindByID(ctx, id.Hex())
+		return !errors.Is(err, mongo.ErrNoDocuments)
+	})
+
+	return v
+}
+
+func newTranslations() *ut.UniversalTranslator {
+	uni := ut.New(en.New(), en.New(), fr.New())
+	for locale, messages := range validationMessages {
+		trans, _ := uni.GetTranslator(locale)
+		for key, text := range messages {
+			_ = trans.Add(key, text, false)
+		}
+	}
+	return uni
+}
+
+// validateRequest validates b with the tags on its fields. If it isn't valid,
+// it returns a message for each field that failed, keyed by the field's JSON
+// path, in the language the request asked for.
+func (api *API) validateRequest(request *http.Request, b interface{}) (bool, map[string]interface{}) {
+	errs := make(map[string]interface{})
+
+	err := api.validate.StructCtx(request.Context(), b)
+	if err == nil {
+		return true, errs
+	}
+
+	trans := requestTranslator(request)
+	for _, e := range err.(validator.ValidationErrors) {
+		// the namespace starts with the name of the struct
+		field := e.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		errs[field] = validationMessage(trans, e)
+	}
+
+	return false, errs
+}
+
+func validationMessage(trans ut.Translator, e validator.FieldError) string {
+	key, param := e.Tag(), e.Param()
+
+	switch key {
+	case "min":
+		switch e.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Array:
+			key = "min-items"
+		case reflect.String:
+		default:
+			key = "min-number"
+		}
+	case "oneof":
+		param = strings.Join(strings.Fields(param), ", ")
+	case "contentType":
+		param = strings.Join(constants.ContentTypes, ", ")
+	}
+
+	if msg, err := trans.T(key, e.Field(), param); err == nil {
+		return msg
+	}
+	msg, _ := trans.T("invalid", e.Field())
+	return msg
+}
+
+// requestTranslator picks the translator for the languages in the request's
+// Accept-Language header, most preferred first. It falls back to English.
+func requestTranslator(request *http.Request) ut.Translator {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []language
+	for _, part := range strings.Split(request.Header.Get("Accept-Language"), ",") {
+		tag, quality := strings.TrimSpace(part), 1.0
+		if i := strings.Index(tag, ";"); i >= 0 {
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(tag[i+1:]), "q="), 64); err == nil {
+				quality = q
+			}
+			tag = strings.TrimSpace(tag[:i])
+		}
+		if tag != "" && tag != "*" && quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	// try each language as it is, then without its region, e.g. fr-CA as fr
+	var locales []string
+	for _, l := range languages {
+		tag := strings.Replace(l.tag, "-", "_", -1)
+		locales = append(locales, tag, strings.SplitN(tag, "_", 2)[0])
+	}
+
+	trans, _ := translations.FindTranslator(locales...)
+	return trans
+}
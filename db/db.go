@@ -2,67 +2,60 @@ package db
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/OpeOnikute/mrkt-api/config"
+
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"gopkg.in/mgo.v2/bson"
 )
 
-// Database ...
+// Database is the database the app keeps its data in. Handlers reach it
+// through the stores made by store.NewMongo.
 var Database *mongo.Database
 
-// DBCollection ...
-type dBCollection struct {
-	Entries    *mongo.Collection
-	Users      *mongo.Collection
-	AlertTypes *mongo.Collection
-}
-
-// Collections ...
-var Collections dBCollection
-
-// Connect ...
-func Connect() {
+var client *mongo.Client
 
-	var mongoURL = os.Getenv("MONGO_URL")
-	var mongoDB = os.Getenv("MONGO_DATABASE")
-
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURL))
+// Connect connects to the database and checks it can be reached.
+func Connect(cfg config.MongoConfig) error {
+	c, err := mongo.NewClient(options.Client().ApplyURI(cfg.URL).SetMonitor(CommandMonitor()))
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("db: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	err = client.Connect(context.TODO())
-	if err != nil {
-		panic(err)
+	if err := c.Connect(ctx); err != nil {
+		return fmt.Errorf("db: connecting: %w", err)
 	}
 
-	Database = client.Database(mongoDB)
+	client = c
+	Database = c.Database(cfg.Database)
 
-	Collections.Entries = Database.Collection("entries")
-	Collections.AlertTypes = Database.Collection("alertTypes")
-	Collections.Users = Database.Collection("users")
-
-	// Create indexes
-	mod := mongo.IndexModel{
-		Keys: bson.M{
-			"location": "2dsphere", // index in ascending order
-		}, Options: nil,
+	// confirm we can connect to the db
+	if err := Ping(ctx); err != nil {
+		c.Disconnect(context.Background())
+		return fmt.Errorf("db: %w", err)
 	}
-	Collections.Entries.Indexes().CreateOne(ctx, mod)
-
-	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	return nil
+}
 
-	// confirm we can connect to the db
-	err = client.Ping(ctx, readpref.Primary())
+// Disconnect closes the connections to the database, waiting until ctx is
+// done for operations in progress to finish.
+func Disconnect(ctx context.Context) error {
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
 
-	if err != nil {
-		panic(err)
+// Ping checks the primary can be reached.
+func Ping(ctx context.Context) error {
+	if client == nil {
+		return errors.New("not connected")
 	}
+	return client.Ping(ctx, readpref.Primary())
 }
@@ -0,0 +1,288 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Migration changes the database from the version before it to its own.
+// Migrations are applied in order, and recorded in the migrations collection
+// once they have been.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, database *mongo.Database) error
+	// Down undoes Up. Migrations without one can't be reverted.
+	Down func(ctx context.Context, database *mongo.Database) error
+}
+
+// MigrationStatus is a migration and when it was applied, nil if it hasn't
+// been.
+type MigrationStatus struct {
+	Migration
+	Applied *time.Time
+}
+
+// appliedMigration is how an applied migration is recorded. The lock is kept
+// in the same collection, with the ID "lock".
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	Applied     time.Time `bson:"applied"`
+}
+
+const (
+	migrationsCollection = "migrations"
+	migrationLockID      = "lock"
+)
+
+// variables so tests don't have to wait as long
+var (
+	// a lock that isn't renewed for this long, e.g. because whoever had it
+	// crashed, can be taken
+	migrationLockTTL = time.Minute
+	// how often to try again for a lock someone else has
+	migrationLockRetry = 5 * time.Second
+)
+
+// set once every migration is known to have been applied, since the API
+// relies on their indexes
+var migrated atomic.Bool
+
+// Migrated reports whether every migration has been applied.
+func Migrated() bool {
+	return migrated.Load()
+}
+
+// LatestVersion is the version of the newest migration.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Prepare gets the database ready for the API. With migrate, it applies the
+// migrations that haven't been. Otherwise it checks they all have been.
+func Prepare(ctx context.Context, migrate bool) error {
+	if migrate {
+		_, err := MigrateTo(ctx, LatestVersion())
+		return err
+	}
+
+	statuses, err := MigrationStatuses(ctx)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, status := range statuses {
+		if status.Applied == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("db: %d migrations haven't been applied, run mrkt migrate", pending)
+	}
+	migrated.Store(true)
+	return nil
+}
+
+// MigrateTo brings the database to version. Migrations up to it that haven't
+// been applied are, oldest first, and applied ones after it are reverted,
+// newest first. It returns the migrations applied or reverted, in the order
+// they were.
+//
+// Only one process migrates at a time. If another one is, MigrateTo waits for
+// it to finish.
+func MigrateTo(ctx context.Context, version int) ([]Migration, error) {
+	// ctx is canceled if the lock is lost, which stops the migration in
+	// progress and any after it
+	ctx, unlock, err := lockMigrations(ctx, migrationLocks())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	collection := Database.Collection(migrationsCollection)
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok || m.Version <= version {
+			continue
+		}
+		if m.Down == nil {
+			return done, fmt.Errorf("db: migration %d can't be reverted", m.Version)
+		}
+
+		if err := context.Cause(ctx); err != nil {
+			return done, err
+		}
+		slog.Info("Reverting migration", "version", m.Version, "description", m.Description)
+		if err := m.Down(ctx, Database); err != nil {
+			return done, fmt.Errorf("db: reverting migration %d: %w", m.Version, err)
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": m.Version}); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Version > version {
+			continue
+		}
+
+		if err := context.Cause(ctx); err != nil {
+			return done, err
+		}
+		slog.Info("Applying migration", "version", m.Version, "description", m.Description)
+		if err := m.Up(ctx, Database); err != nil {
+			return done, fmt.Errorf("db: applying migration %d: %w", m.Version, err)
+		}
+		record := appliedMigration{Version: m.Version, Description: m.Description, Applied: time.Now()}
+		if _, err := collection.InsertOne(ctx, record); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+
+	migrated.Store(version >= LatestVersion())
+	return done, nil
+}
+
+// MigrationStatuses returns every migration, oldest first, with when it was
+// applied.
+func MigrationStatuses(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i].Migration = m
+		if record, ok := applied[m.Version]; ok {
+			statuses[i].Applied = &record.Applied
+		}
+	}
+	return statuses, nil
+}
+
+func appliedMigrations(ctx context.Context) (map[int]appliedMigration, error) {
+	cursor, err := Database.Collection(migrationsCollection).Find(ctx, bson.M{"_id": bson.M{"$ne": migrationLockID}})
+	if err != nil {
+		return nil, err
+	}
+	var records []appliedMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// migrationLock is the document holding the lock on migrating.
+type migrationLock struct {
+	ID      string             `bson:"_id"`
+	Owner   primitive.ObjectID `bson:"owner"`
+	Expires time.Time          `bson:"expires"`
+}
+
+// migrationLocks is where the lock is kept: in the migrations collection,
+// with the ID "lock".
+func migrationLocks() store.Collection[migrationLock] {
+	return store.MongoCollection[migrationLock](Database.Collection(migrationsCollection))
+}
+
+// lockMigrations takes the lock on migrating, waiting until whoever has it is
+// done. The lock is renewed until the function it returns is called to
+// release it. If a renewal fails, someone else could take the lock once it
+// expires, so the context it returns is canceled and migrating has to stop.
+func lockMigrations(ctx context.Context, collection store.Collection[migrationLock]) (context.Context, func(), error) {
+	owner := primitive.NewObjectID()
+
+	// Takes the lock if it is free, has expired or is already ours. If
+	// someone else has it, the filter doesn't match, so a second lock is
+	// inserted and fails on the ID.
+	take := func(ctx context.Context) error {
+		now := time.Now()
+		filter := bson.M{
+			"_id": migrationLockID,
+			"$or": []bson.M{{"owner": owner}, {"expires": bson.M{"$lt": now}}},
+		}
+		update := bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(migrationLockTTL)}}
+		_, err := collection.FindOneAndUpdate(ctx, filter, update, true)
+		return err
+	}
+
+	for waiting := false; ; {
+		err := take(ctx)
+		if err == nil {
+			break
+		}
+		if !store.IsDuplicateKey(err) {
+			return nil, nil, err
+		}
+
+		if !waiting {
+			slog.Info("Waiting for another process to finish migrating")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(migrationLockRetry):
+		}
+	}
+
+	locked, lost := context.WithCancelCause(ctx)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := take(locked); err != nil {
+					slog.Error("Failed to renew the migration lock, so migrating stops", logging.Error(err))
+					lost(fmt.Errorf("db: lost the migration lock: %w", err))
+					return
+				}
+			}
+		}
+	}()
+
+	return locked, func() {
+		// renewing after this would take the lock again
+		close(stop)
+		<-stopped
+		lost(nil)
+
+		// released even if ctx is done, so no one has to wait for it to
+		// expire
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner}); err != nil {
+			slog.Warn("Failed to release the migration lock", logging.Error(err))
+		}
+	}, nil
+}
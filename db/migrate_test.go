@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// shortenMigrationLock makes the lock expire and be retried quickly. Tests
+// that use it can't run in parallel.
+func shortenMigrationLock(t *testing.T) {
+	ttl, retry := migrationLockTTL, migrationLockRetry
+	migrationLockTTL, migrationLockRetry = 300*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { migrationLockTTL, migrationLockRetry = ttl, retry })
+}
+
+func TestLockMigrationsWaits(t *testing.T) {
+	shortenMigrationLock(t)
+	ctx := context.Background()
+	locks := store.MemoryCollection[migrationLock]()
+
+	_, unlock, err := lockMigrations(ctx, locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := make(chan func())
+	go func() {
+		_, unlock, err := lockMigrations(ctx, locks)
+		if err != nil {
+			t.Error(err)
+			unlock = func() {}
+		}
+		taken <- unlock
+	}()
+
+	// renewed for longer than it would take to expire
+	select {
+	case <-taken:
+		t.Fatal("the lock was taken while it was held")
+	case <-time.After(2 * migrationLockTTL):
+	}
+
+	unlock()
+	select {
+	case unlock := <-taken:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("the lock wasn't taken once it was released")
+	}
+
+	if n, err := locks.Count(ctx, bson.M{}); err != nil || n != 0 {
+		t.Errorf("%d locks left, err = %v, want none", n, err)
+	}
+}
+
+func TestLockMigrationsTakesExpiredLock(t *testing.T) {
+	shortenMigrationLock(t)
+	ctx := context.Background()
+	locks := store.MemoryCollection[migrationLock]()
+
+	// left by a process that crashed
+	crashed := migrationLock{ID: migrationLockID, Owner: primitive.NewObjectID(), Expires: time.Now().Add(-time.Second)}
+	if _, err := locks.InsertOne(ctx, crashed); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrationLockRetry/2)
+	defer cancel()
+	_, unlock, err := lockMigrations(ctx, locks)
+	if err != nil {
+		t.Fatalf("lockMigrations: %v", err)
+	}
+	unlock()
+}
+
+func TestLockMigrationsStopsWhenLost(t *testing.T) {
+	shortenMigrationLock(t)
+	locks := store.MemoryCollection[migrationLock]()
+
+	ctx, unlock, err := lockMigrations(context.Background(), locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else takes it, as if it had expired while we couldn't renew it
+	update := bson.M{"$set": bson.M{"owner": primitive.NewObjectID()}}
+	if _, err := locks.UpdateOne(context.Background(), bson.M{"_id": migrationLockID}, update); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * migrationLockTTL):
+		t.Fatal("still migrating after the lock was lost")
+	}
+	if err := context.Cause(ctx); err == nil || errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "lost the migration lock") {
+		t.Errorf("cause = %v, want the lock to have been lost", err)
+	}
+
+	// releasing it leaves the other process's lock alone
+	unlock()
+	if n, err := locks.Count(context.Background(), bson.M{}); err != nil || n != 1 {
+		t.Errorf("%d locks left, err = %v, want the other process's", n, err)
+	}
+}
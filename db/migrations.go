@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// migrations are every change made to the database, oldest first. New ones
+// go at the end with the next version. Don't change one that has been
+// released, since databases it was applied to won't see the change: add
+// another migration instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Index entries by location, audit logs by time, and revisions and flags by entry",
+		Up:          createIndexes(migrationIndexes[1]),
+		Down:        dropIndexes(migrationIndexes[1]),
+	},
+	{
+		Version:     2,
+		Description: "Index users by email and status, and entries by status, time, alert type and reporter",
+		Up:          createIndexes(migrationIndexes[2]),
+		Down:        dropIndexes(migrationIndexes[2]),
+	},
+	{
+		Version:     3,
+		Description: "Store the reporter of every entry as a user ID",
+		Up:          normalizeUploadedBy,
+	},
+	{
+		Version:     4,
+		Description: "Expire the nonces of used ID tokens",
+		Up:          createIndexes(migrationIndexes[4]),
+		Down:        dropIndexes(migrationIndexes[4]),
+	},
+	{
+		Version:     5,
+		Description: "Make usernames unique, renaming the users who share one",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			if err := renameDuplicateUsernames(ctx, database); err != nil {
+				return err
+			}
+			return createIndexes(migrationIndexes[5])(ctx, database)
+		},
+		Down: dropIndexes(migrationIndexes[5]),
+	},
+}
+
+// the indexes each migration creates, by version, for RebuildIndexes
+var migrationIndexes = map[int][]index{
+	1: initialIndexes,
+	2: lookupIndexes,
+	4: {
+		// removed by MongoDB once their ID tokens have expired
+		{
+			collection: "usedNonces",
+			keys:       primitive.D{{Key: "expires", Value: 1}},
+			options:    options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	5: {
+		// admins and users share usernames with each other. Erased users
+		// don't have one.
+		{
+			collection: "users",
+			keys:       primitive.D{{Key: "username", Value: 1}},
+			options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"username": bson.M{"$exists": true}}),
+		},
+	},
+}
+
+// RebuildIndexes creates the indexes of the migrations that have been applied
+// again, in case they were dropped or changed by hand. With drop, they are
+// dropped first so they are built from scratch.
+func RebuildIndexes(ctx context.Context, drop bool) error {
+	ctx, unlock, err := lockMigrations(ctx, migrationLocks())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		indexes := migrationIndexes[m.Version]
+		if _, ok := applied[m.Version]; !ok || indexes == nil {
+			continue
+		}
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		if drop {
+			if err := dropIndexes(indexes)(ctx, Database); err != nil {
+				return err
+			}
+		}
+		if err := createIndexes(indexes)(ctx, Database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index is an index on a collection. It is named the way MongoDB names
+// indexes by default, from its keys.
+type index struct {
+	collection string
+	keys       primitive.D
+	options    *options.IndexOptions
+}
+
+func (i index) name() string {
+	parts := make([]string, len(i.keys))
+	for j, key := range i.keys {
+		parts[j] = fmt.Sprintf("%s_%v", key.Key, key.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+// the indexes the API created for itself before there were migrations
+var initialIndexes = []index{
+	{collection: "entries", keys: primitive.D{{Key: "location", Value: "2dsphere"}}},
+	{collection: "auditLogs", keys: primitive.D{{Key: "created", Value: -1}}},
+	{
+		collection: "entryRevisions",
+		keys:       primitive.D{{Key: "entry", Value: 1}, {Key: "version", Value: 1}},
+		options:    options.Index().SetUnique(true),
+	},
+	// a user can only flag an entry once
+	{
+		collection: "flags",
+		keys:       primitive.D{{Key: "entry", Value: 1}, {Key: "reportedBy", Value: 1}},
+		options:    options.Index().SetUnique(true),
+	},
+}
+
+var lookupIndexes = []index{
+	// Admins and users are separate accounts, so they can share an email.
+	// Erased users don't have one.
+	{
+		collection: "users",
+		keys:       primitive.D{{Key: "email", Value: 1}, {Key: "isAdmin", Value: 1}},
+		options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"email": bson.M{"$exists": true}}),
+	},
+	{collection: "users", keys: primitive.D{{Key: "status", Value: 1}}},
+	{collection: "entries", keys: primitive.D{{Key: "status", Value: 1}}},
+	{collection: "entries", keys: primitive.D{{Key: "created", Value: -1}}},
+	{collection: "entries", keys: primitive.D{{Key: "alertType", Value: 1}}},
+	{collection: "entries", keys: primitive.D{{Key: "uploadedBy", Value: 1}}},
+}
+
+func createIndexes(indexes []index) func(context.Context, *mongo.Database) error {
+	return func(ctx context.Context, database *mongo.Database) error {
+		for _, i := range indexes {
+			opts := i.options
+			if opts == nil {
+				opts = options.Index()
+			}
+			model := mongo.IndexModel{Keys: i.keys, Options: opts.SetName(i.name())}
+			if _, err := database.Collection(i.collection).Indexes().CreateOne(ctx, model); err != nil {
+				return fmt.Errorf("creating %s on %s: %w", i.name(), i.collection, err)
+			}
+		}
+		return nil
+	}
+}
+
+// codeIndexNotFound is the code of the error MongoDB returns for dropping an
+// index that doesn't exist.
+const codeIndexNotFound = 27
+
+func dropIndexes(indexes []index) func(context.Context, *mongo.Database) error {
+	return func(ctx context.Context, database *mongo.Database) error {
+		for _, i := range indexes {
+			_, err := database.Collection(i.collection).Indexes().DropOne(ctx, i.name())
+			if commandErr, ok := err.(mongo.CommandError); ok && commandErr.Code == codeIndexNotFound {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("dropping %s on %s: %w", i.name(), i.collection, err)
+			}
+		}
+		return nil
+	}
+}
+
+// normalizeUploadedBy makes the reporter of every entry a user ID. It used to
+// be a string: the user's ID in hex, or "anonymous" for anonymous entries,
+// which are now flagged instead and have no reporter.
+func normalizeUploadedBy(ctx context.Context, database *mongo.Database) error {
+	entries := database.Collection("entries")
+
+	cursor, err := entries.Find(ctx, bson.M{"uploadedBy": bson.M{"$type": "string"}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			UploadedBy interface{}        `bson:"uploadedBy"`
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		// changed already, if the cursor comes across it again
+		uploadedBy, ok := entry.UploadedBy.(string)
+		if !ok {
+			continue
+		}
+
+		update := bson.M{"$unset": bson.M{"uploadedBy": ""}, "$set": bson.M{"anonymous": true}}
+		if id, err := primitive.ObjectIDFromHex(uploadedBy); err == nil {
+			update = bson.M{"$set": bson.M{"uploadedBy": id}}
+		}
+		if _, err := entries.UpdateOne(ctx, bson.M{"_id": entry.ID}, update); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	// a null reporter is no reporter
+	_, err = entries.UpdateMany(ctx,
+		bson.M{"uploadedBy": bson.M{"$type": "null"}},
+		bson.M{"$unset": bson.M{"uploadedBy": ""}},
+	)
+	return err
+}
+
+// renameDuplicateUsernames leaves a username with the first user to sign up
+// with it, and adds their ID to the others' so they are unique. Users can
+// change it afterwards.
+func renameDuplicateUsernames(ctx context.Context, database *mongo.Database) error {
+	users := database.Collection("users")
+
+	cursor, err := users.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"username": bson.M{"$exists": true}}},
+		{"$sort": bson.M{"created": 1}},
+		{"$group": bson.M{"_id": "$username", "ids": bson.M{"$push": "$_id"}}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var duplicate struct {
+			Username string               `bson:"_id"`
+			IDs      []primitive.ObjectID `bson:"ids"`
+		}
+		if err := cursor.Decode(&duplicate); err != nil {
+			return err
+		}
+		for _, id := range duplicate.IDs[1:] {
+			update := bson.M{"$set": bson.M{"username": duplicate.Username + "_" + id.Hex()}}
+			if _, err := users.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+				return err
+			}
+		}
+	}
+	return cursor.Err()
+}
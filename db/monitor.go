@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/metrics"
+	"github.com/OpeOnikute/mrkt-api/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type startedCommand struct {
+	collection string
+	span       trace.Span
+}
+
+// CommandMonitor records metrics and a span for every command sent to
+// MongoDB. Spans are children of the span in the context the command was run
+// with.
+func CommandMonitor() *event.CommandMonitor {
+	// commands are matched up with how they finished by request ID
+	var commands sync.Map
+
+	finished := func(e event.CommandFinishedEvent, failure string) {
+		c, ok := commands.LoadAndDelete(e.RequestID)
+		if !ok {
+			return
+		}
+		command := c.(startedCommand)
+
+		metrics.ObserveMongoCommand(command.collection, e.CommandName, time.Duration(e.DurationNanos), failure != "")
+		if failure != "" {
+			command.span.SetStatus(codes.Error, failure)
+		}
+		command.span.End()
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			collection := commandCollection(e.Command)
+			name := e.CommandName + " " + e.DatabaseName
+			if collection != "" {
+				name += "." + collection
+			}
+
+			_, span := tracing.Tracer().Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBName(e.DatabaseName),
+					semconv.DBOperation(e.CommandName),
+					semconv.DBMongoDBCollection(collection),
+				),
+			)
+			commands.Store(e.RequestID, startedCommand{collection: collection, span: span})
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finished(e.CommandFinishedEvent, "")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finished(e.CommandFinishedEvent, e.Failure)
+		},
+	}
+}
+
+// commandCollection returns the collection a command is run on, or "" if it
+// isn't run on one. Most commands name it first, like {"find": "entries"},
+// but getMore has it in its collection field.
+func commandCollection(command bson.Raw) string {
+	elements, err := command.Elements()
+	if err != nil || len(elements) == 0 {
+		return ""
+	}
+	if collection, ok := elements[0].Value().StringValueOK(); ok {
+		return collection
+	}
+	if collection, ok := command.Lookup("collection").StringValueOK(); ok {
+		return collection
+	}
+	return ""
+}
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"context"
+	"time"
+
 	"github.com/OpeOnikute/mrkt-api/constants"
 	"github.com/OpeOnikute/mrkt-api/models"
 
@@ -10,40 +13,79 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-var model models.AlertModel
-
 // AlertTypeHandler ...
-type AlertTypeHandler struct{}
+type AlertTypeHandler struct {
+	*Handlers
+}
 
 // CreateAlertType ...
-func (a AlertTypeHandler) CreateAlertType(alertType models.AlertType) (*mongo.InsertOneResult, error) {
-	if existingType, _ := model.FindByName(alertType.Name); existingType.Name == alertType.Name {
-		var newErr constants.CustomError
-		newErr.Msg = constants.ResourceExists("alert type")
-		return nil, &newErr
+func (a AlertTypeHandler) CreateAlertType(ctx context.Context, alertType models.AlertType) (*mongo.InsertOneResult, error) {
+	if existingType, _ := a.FindByName(ctx, alertType.Name); existingType.Name == alertType.Name {
+		return nil, constants.ConflictError(constants.ResourceExists("alert type"))
 	}
-	return model.Create(alertType)
+
+	alertType.ID = primitive.NewObjectID()
+	alertType.Status = constants.Enabled
+	alertType.Created = time.Now()
+	alertType.Updated = time.Now()
+
+	return a.stores.AlertTypes.InsertOne(ctx, alertType)
 }
 
 // FindByID ...
-func (a AlertTypeHandler) FindByID(requestID string) (models.AlertType, error) {
+func (a AlertTypeHandler) FindByID(ctx context.Context, requestID string) (models.AlertType, error) {
 	id, _ := primitive.ObjectIDFromHex(requestID)
-	return model.FindByID(id)
+	return a.stores.AlertTypes.FindOne(ctx, bson.M{"_id": id, "status": constants.Enabled})
+}
+
+// FindByName ...
+func (a AlertTypeHandler) FindByName(ctx context.Context, name string) (models.AlertType, error) {
+	return a.stores.AlertTypes.FindOne(ctx, bson.M{"name": name, "status": constants.Enabled})
 }
 
 // DeleteByID ...
-func (a AlertTypeHandler) DeleteByID(requestID string) (*mongo.UpdateResult, error) {
+func (a AlertTypeHandler) DeleteByID(ctx context.Context, requestID string) (*mongo.UpdateResult, error) {
 	id, _ := primitive.ObjectIDFromHex(requestID)
-	return model.DeleteByID(id)
+	update := bson.M{"$set": bson.M{"status": "deleted", "updated": time.Now()}}
+
+	return a.stores.AlertTypes.UpdateOne(ctx, bson.M{"_id": id}, update)
 }
 
 // GetMultiple ...
-func (a AlertTypeHandler) GetMultiple(query bson.M) ([]models.AlertType, error) {
-	return model.FindMany(query)
+func (a AlertTypeHandler) GetMultiple(ctx context.Context, query bson.M) ([]models.AlertType, error) {
+	query["status"] = constants.Enabled
+	return a.stores.AlertTypes.Find(ctx, query)
 }
 
 // UpdateByID ...
-func (a AlertTypeHandler) UpdateByID(requestID string, alertType models.AlertType) (*mongo.UpdateResult, error) {
+func (a AlertTypeHandler) UpdateByID(ctx context.Context, requestID string, alertType models.AlertType) (*mongo.UpdateResult, error) {
 	id, _ := primitive.ObjectIDFromHex(requestID)
-	return model.UpdateByID(id, alertType)
+	alertType.Updated = time.Now()
+
+	return a.stores.AlertTypes.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": alertType})
+}
+
+// defaultAlertTypes are the alert types a new install starts with
+var defaultAlertTypes = []models.AlertType{
+	{Name: "potential harm", Level: 2},
+	{Name: "emergency", Level: 4},
+	{Name: "accident", Level: 4},
+	{Name: "fire", Level: 5},
+	{Name: "robbery", Level: 5},
+}
+
+// SeedAlertTypes creates the default alert types that don't exist yet. It
+// returns how many were created.
+func (a AlertTypeHandler) SeedAlertTypes(ctx context.Context) (int, error) {
+	created := 0
+	for _, alertType := range defaultAlertTypes {
+		if _, err := a.CreateAlertType(ctx, alertType); err != nil {
+			if _, ok := err.(*constants.CustomError); ok {
+				continue
+			}
+			return created, err
+		}
+		created++
+	}
+	return created, nil
 }
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Fields that are never written to the audit log. Changes to them are still
+// recorded, just not their values.
+var redactedFields = map[string]bool{
+	"password":    true,
+	"twoFactor":   true,
+	"editToken":   true,
+	"emailChange": true,
+}
+
+const redacted = "[redacted]"
+
+// auditCSVHeader is the header row of audit log CSV exports
+var auditCSVHeader = []string{"created", "actorType", "actorID", "action", "collection", "targetID", "route", "ip", "requestID", "changes"}
+
+// RecordAudit appends an entry to the audit log, with the changes worked out
+// from the document before and after. If they can't be, the entry is still
+// recorded without them. There is deliberately no way to update or delete
+// audit logs, other than erasing a user's personal data from them.
+func (h *Handlers) RecordAudit(ctx context.Context, log models.AuditLog, before, after interface{}) error {
+	changes, err := DiffDocuments(before, after)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Failed to diff for the audit log", "collection", log.Collection, "targetId", log.TargetID, logging.Error(err))
+	}
+
+	log.ID = primitive.NewObjectID()
+	log.Changes = changes
+	log.Created = time.Now()
+
+	_, err = h.stores.AuditLogs.InsertOne(ctx, log)
+	return err
+}
+
+// DiffDocuments compares two versions of a document field by field, using
+// their bson representation. Either side can be nil for documents that are
+// being created or removed.
+func DiffDocuments(before, after interface{}) (map[string]models.FieldChange, error) {
+	beforeDoc, err := toDocument(before)
+	if err != nil {
+		return nil, err
+	}
+
+	afterDoc, err := toDocument(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]models.FieldChange)
+
+	for key, value := range beforeDoc {
+		if other, ok := afterDoc[key]; !ok || !reflect.DeepEqual(value, other) {
+			changes[key] = models.FieldChange{Before: value, After: other}
+		}
+	}
+
+	for key, value := range afterDoc {
+		if _, ok := beforeDoc[key]; !ok {
+			changes[key] = models.FieldChange{After: value}
+		}
+	}
+
+	// every change bumps the timestamp, so it isn't worth recording
+	delete(changes, "updated")
+
+	for key, change := range changes {
+		if redactedFields[key] {
+			changes[key] = redactChange(change)
+		}
+	}
+
+	return changes, nil
+}
+
+// redactChanges redacts the values of every change.
+func redactChanges(changes map[string]models.FieldChange) map[string]models.FieldChange {
+	redactedChanges := make(map[string]models.FieldChange, len(changes))
+	for key, change := range changes {
+		redactedChanges[key] = redactChange(change)
+	}
+	return redactedChanges
+}
+
+func redactChange(change models.FieldChange) models.FieldChange {
+	if change.Before != nil {
+		change.Before = redacted
+	}
+	if change.After != nil {
+		change.After = redacted
+	}
+	return change
+}
+
+// AuditFilter narrows down audit log queries. Empty fields match anything.
+type AuditFilter struct {
+	ActorID    *primitive.ObjectID
+	Action     string
+	Collection string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+	Limit      int64
+}
+
+func (f AuditFilter) query() bson.M {
+	q := bson.M{}
+
+	if f.ActorID != nil {
+		q["actor.id"] = *f.ActorID
+	}
+	if f.Action != "" {
+		q["action"] = f.Action
+	}
+	if f.Collection != "" {
+		q["collection"] = f.Collection
+	}
+	if f.TargetID != "" {
+		q["targetID"] = f.TargetID
+	}
+
+	created := bson.M{}
+	if !f.From.IsZero() {
+		created["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		created["$lte"] = f.To
+	}
+	if len(created) > 0 {
+		q["created"] = created
+	}
+
+	return q
+}
+
+// GetAuditLogs returns audit logs matching the filter, newest first.
+func (h *Handlers) GetAuditLogs(ctx context.Context, filter AuditFilter) ([]models.AuditLog, error) {
+	opts := store.FindOptions{Sort: "-created", Limit: filter.Limit}
+	return h.stores.AuditLogs.Find(ctx, filter.query(), opts)
+}
+
+// ExportAuditLogsCSV streams the audit logs matching the filter as CSV, one
+// row at a time. Changes are written as a JSON object.
+func (h *Handlers) ExportAuditLogsCSV(ctx context.Context, filter AuditFilter, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(auditCSVHeader); err != nil {
+		return err
+	}
+
+	opts := store.FindOptions{Sort: "-created", Limit: filter.Limit}
+	err := h.stores.AuditLogs.Each(ctx, filter.query(), opts, func(log models.AuditLog) error {
+		actorID := ""
+		if log.Actor.ID != nil {
+			actorID = log.Actor.ID.Hex()
+		}
+
+		changes, err := json.Marshal(log.Changes)
+		if err != nil {
+			return err
+		}
+
+		row := []string{
+			log.Created.Format(time.RFC3339),
+			log.Actor.Type,
+			actorID,
+			log.Action,
+			log.Collection,
+			log.TargetID,
+			log.Route,
+			log.IP,
+			log.RequestID,
+			string(changes),
+		}
+		return writer.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func toDocument(v interface{}) (bson.M, error) {
+	doc := bson.M{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return doc, nil
+	}
+
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/store"
+)
+
+// Handlers holds the settings handlers run with and where they keep their
+// data. Each has its own caches, so any number can run side by side, e.g.
+// one per test.
+type Handlers struct {
+	conf   *config.Config
+	stores store.Stores
+
+	// providers are discovered the first time they are used
+	oidcProvidersMu sync.Mutex
+	oidcProviders   map[string]*OIDCProvider
+
+	statsCache statsCache
+}
+
+// New returns handlers that run with cfg and keep their data in stores,
+// e.g. store.NewMongo for the app or store.NewMemory for tests.
+func New(cfg *config.Config, stores store.Stores) *Handlers {
+	return &Handlers{
+		conf:          cfg,
+		stores:        stores,
+		oidcProviders: make(map[string]*OIDCProvider),
+		statsCache:    statsCache{stats: make(map[string]cachedStat)},
+	}
+}
+
+// AlertTypes returns the handler for alert types.
+func (h *Handlers) AlertTypes() AlertTypeHandler {
+	return AlertTypeHandler{h}
+}
@@ -2,14 +2,18 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
-	"os"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/OpeOnikute/mrkt-api/constants"
-	"github.com/OpeOnikute/mrkt-api/db"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/metrics"
 	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+	"github.com/OpeOnikute/mrkt-api/tracing"
 
 	geo "github.com/codingsince1985/geo-golang"
 
@@ -17,96 +21,77 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// ClearEntries ...
-func ClearEntries() (*mongo.DeleteResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	return db.Collections.Entries.DeleteMany(ctx, bson.M{})
-}
-
 // CreateEntry ...
-func CreateEntry(entry *models.Entry) (*mongo.InsertOneResult, error) {
+func (h *Handlers) CreateEntry(ctx context.Context, entry *models.Entry) (*mongo.InsertOneResult, error) {
 
 	latFR := entry.Location.Coordinates[0]
 	lngFR := entry.Location.Coordinates[1]
 
-	address, err := GetAddressFromCoordinates(latFR, lngFR)
+	address, err := h.GetAddressFromCoordinates(ctx, latFR, lngFR)
 
 	if err == nil {
 		entry.Address = address
 	} else {
-		// disable logger till I can figure out nil pointer error
-		// lg := new(Logger)
-		// lg.Error(err.Error())
+		// the entry is still worth saving, it can be geocoded later
+		logging.FromContext(ctx).Warn("Failed to geocode entry", "entryId", entry.ID.Hex(), logging.Error(err))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	return db.Collections.Entries.InsertOne(ctx, entry)
+	return h.stores.Entries.InsertOne(ctx, *entry)
 }
 
-// GetAddressFromCoordinates ...
-func GetAddressFromCoordinates(lat, long float64) (*geo.Address, error) {
-	// TODO: Cache results and fetch from cache
-	geocoder := google.Geocoder(os.Getenv("GOOGLE_MAPS_KEY"))
-	return geocoder.ReverseGeocode(lat, long)
+// NewEditToken gives an anonymous entry a secret token its reporter can
+// manage it with. Only a hash of the token is stored.
+func NewEditToken(entry *models.Entry) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	entry.EditToken = hashToken(token)
+	return token, nil
 }
 
-// CreateMultipleEntries ...
-func CreateMultipleEntries(entries []models.Entry) (*mongo.InsertManyResult, error) {
-	// convert to an interface
-	data := make([]interface{}, len(entries))
-	def := models.GetDefaultEntry()
-
-	for i, entry := range entries {
-
-		latFR := entry.Location.Coordinates[0]
-		lngFR := entry.Location.Coordinates[1]
-
-		address, err := GetAddressFromCoordinates(latFR, lngFR)
-
-		if err == nil {
-			entry.Address = address
-		}
+// CheckEditToken reports whether token is the entry's edit token.
+func CheckEditToken(entry models.Entry, token string) bool {
+	if entry.EditToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(entry.EditToken), []byte(hashToken(token))) == 1
+}
 
-		entry.Status = def.Status
-		entry.Created = def.Created
-		entry.Updated = def.Updated
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-		data[i] = entry
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	return db.Collections.Entries.InsertMany(ctx, data)
+// GetAddressFromCoordinates ...
+func (h *Handlers) GetAddressFromCoordinates(ctx context.Context, lat, long float64) (*geo.Address, error) {
+	// TODO: Cache results and fetch from cache
+	_, span := tracing.Tracer().Start(ctx, "geocoder.ReverseGeocode", trace.WithSpanKind(trace.SpanKindClient))
+	geocoder := google.Geocoder(h.conf.GoogleMapsKey)
+	start := time.Now()
+	address, err := geocoder.ReverseGeocode(lat, long)
+	metrics.ObserveGeocode(time.Since(start), err)
+	tracing.End(span, err)
+	return address, err
 }
 
 // GetAllEntries gets all entries
-func GetAllEntries(query bson.M) ([]models.Entry, error) {
-	// init empty array so we don't send null as json response
-	results := []models.Entry{}
-	cursor, err := db.Collections.Entries.Find(context.Background(), query)
-	if err != nil {
-		return results, err
-	}
-	err = cursor.All(context.TODO(), &results)
-	return results, err
+func (h *Handlers) GetAllEntries(ctx context.Context, query bson.M) ([]models.Entry, error) {
+	return h.stores.Entries.Find(ctx, query)
 }
 
 // GetEntryByID exposes a function to retrieve an entry by it's ID
-func GetEntryByID(requestID string) (models.Entry, error) {
+func (h *Handlers) GetEntryByID(ctx context.Context, requestID string) (models.Entry, error) {
 	id, _ := primitive.ObjectIDFromHex(requestID)
-	var entry models.Entry
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	err := db.Collections.Entries.FindOne(ctx, bson.M{"_id": id}).Decode(&entry)
-	return entry, err
+	return h.stores.Entries.FindOne(ctx, bson.M{"_id": id})
 }
 
 // UpdateEntryByID exposes a function to update an entry by it's ID
-func UpdateEntryByID(requestID string, entry models.Entry) (*mongo.UpdateResult, error) {
+func (h *Handlers) UpdateEntryByID(ctx context.Context, requestID string, entry models.Entry) (*mongo.UpdateResult, error) {
 
 	entry.Updated = time.Now()
 
@@ -115,15 +100,12 @@ func UpdateEntryByID(requestID string, entry models.Entry) (*mongo.UpdateResult,
 
 	id, _ := primitive.ObjectIDFromHex(requestID)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	result, err := db.Collections.Entries.UpdateOne(ctx, bson.M{"_id": id}, update)
+	result, err := h.stores.Entries.UpdateOne(ctx, bson.M{"_id": id}, update)
 	return result, err
 }
 
 // DeleteEntryByID ...
-func DeleteEntryByID(entry models.Entry) (*mongo.UpdateResult, error) {
+func (h *Handlers) DeleteEntryByID(ctx context.Context, entry models.Entry) (*mongo.UpdateResult, error) {
 
 	entry.Status = "deleted"
 	entry.Updated = time.Now()
@@ -131,118 +113,129 @@ func DeleteEntryByID(entry models.Entry) (*mongo.UpdateResult, error) {
 	update := make(map[string]interface{})
 	update["$set"] = entry
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	result, err := db.Collections.Entries.UpdateOne(ctx, bson.M{"_id": entry.ID}, update)
+	result, err := h.stores.Entries.UpdateOne(ctx, bson.M{"_id": entry.ID}, update)
 	return result, err
 }
 
-// GetLocationRanking houses the core logic to classify how safe a location is.
-func GetLocationRanking(lat, long float64) (models.LocationRanking, error) {
+// geocodeEntries looks up the addresses of entries at the same time. It
+// returns the error for each entry whose address couldn't be found, if any.
+func (h *Handlers) geocodeEntries(ctx context.Context, entries []models.Entry) []error {
+	errs := make([]error, len(entries))
+
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry := &entries[i]
+			address, err := h.GetAddressFromCoordinates(ctx, entry.Location.Coordinates[0], entry.Location.Coordinates[1])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			entry.Address = address
+		}(i)
+	}
+	wg.Wait()
 
-	var result float64
-	var text string
-	var ranking models.LocationRanking
-	var newErr constants.CustomError
+	return errs
+}
 
-	// 5km
-	maxDistance := 5000
+// BackfillAddresses looks up the addresses of entries that don't have one,
+// in batches. limit caps how many entries are looked up, or 0 for all of
+// them. It returns how many addresses were found and how many weren't.
+func (h *Handlers) BackfillAddresses(ctx context.Context, limit int64) (found, missing int, err error) {
+	// matches entries whose address is null as well as missing
+	q := bson.M{"address": nil}
+	opts := store.FindOptions{Sort: "_id", Limit: limit}
+
+	save := func(batch []models.Entry) error {
+		errs := h.geocodeEntries(ctx, batch)
+		for i, entry := range batch {
+			if errs[i] != nil || entry.Address == nil {
+				missing++
+				continue
+			}
+			update := bson.M{"$set": bson.M{"address": entry.Address}}
+			if _, err := h.stores.Entries.UpdateOne(ctx, bson.M{"_id": entry.ID, "address": nil}, update); err != nil {
+				return err
+			}
+			found++
+		}
+		return nil
+	}
 
-	dayAvg := 5
+	var batch []models.Entry
+	err = h.stores.Entries.Each(ctx, q, opts, func(entry models.Entry) error {
+		batch = append(batch, entry)
+		if len(batch) < constants.GEOCODE_BATCH_SIZE {
+			return nil
+		}
+		err := save(batch)
+		batch = nil
+		return err
+	})
+	if err != nil {
+		return found, missing, err
+	}
 
-	// get x days ago as date. we only care about incidents reported
-	// up to x days ago.
-	xDaysAgo := time.Now().AddDate(0, 0, -dayAvg)
+	if len(batch) > 0 {
+		err = save(batch)
+	}
+	return found, missing, err
+}
 
-	// toDate := time.Date(2014, time.November, 5, 0, 0, 0, 0, time.UTC)
+// GetLocationRanking houses the core logic to classify how safe a location is.
+func (h *Handlers) GetLocationRanking(ctx context.Context, lat, long float64) (models.LocationRanking, error) {
 
-	results := []bson.M{}
+	var text string
+	var ranking models.LocationRanking
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	geoNearStage := bson.M{
-		"$geoNear": bson.M{
-			"near": bson.M{
-				"type":        "Point",
-				"coordinates": []float64{lat, long},
-			},
-			"distanceField": "dist.calculated",
-			"maxDistance":   maxDistance,
-			"query": bson.M{
-				"status":  constants.Enabled,
-				"created": bson.M{"$gte": xDaysAgo},
-			},
-			"includeLocs": "dist.location",
-			"spherical":   false,
-		},
-	}
+	dayAvg := h.conf.Location.WindowDays
 
-	lookupStage := bson.M{
-		"$lookup": bson.M{
-			"from":         "alertTypes",
-			"localField":   "alertType",
-			"foreignField": "_id",
-			"as":           "alertType",
-		},
-	}
-	unwindStage := bson.M{
-		"$unwind": bson.M{
-			"path":                       "$alertType",
-			"preserveNullAndEmptyArrays": false,
-		},
-	}
-	matchStage := bson.M{
-		"$match": bson.M{
-			"alertType.level": bson.M{
-				"$gte": 3,
-			},
-		},
+	// only incidents serious enough to make a place unsafe count
+	alertTypes, err := h.stores.AlertTypes.Find(ctx, bson.M{"level": bson.M{"$gte": h.conf.Location.MinLevel}})
+	if err != nil {
+		return ranking, err
 	}
-	groupStage := bson.M{
-		"$group": bson.M{
-			"_id": "",
-			"count": bson.M{
-				"$sum": 1,
-			},
-		},
+	alertTypeIDs := make([]primitive.ObjectID, len(alertTypes))
+	for i, alertType := range alertTypes {
+		alertTypeIDs[i] = alertType.ID
 	}
 
-	projectStage := bson.M{
-		"$project": bson.M{
-			"_id": 0,
-			"avg": bson.M{
-				"$divide": []interface{}{"$count", dayAvg},
+	// we only care about incidents reported in the last x days, within
+	// the radius of the location
+	q := PublicEntryQuery(bson.M{
+		"created":   bson.M{"$gte": time.Now().AddDate(0, 0, -dayAvg)},
+		"alertType": bson.M{"$in": alertTypeIDs},
+		"location": bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{[]float64{lat, long}, h.conf.Location.Radius / earthRadius},
 			},
-			"count": 1,
 		},
-	}
-
-	pipeline := []bson.M{geoNearStage, lookupStage, unwindStage, matchStage, groupStage, projectStage}
+	})
 
-	cursor, _ := db.Collections.Entries.Aggregate(ctx, pipeline)
-	_ = cursor.All(context.TODO(), &results)
+	count, err := h.stores.Entries.Count(ctx, q)
+	if err != nil {
+		return ranking, err
+	}
 
 	// If there are no results, no incident was found. Location is safe.
-	if len(results) <= 0 {
+	if count == 0 {
 		ranking.Average = 0
 		ranking.Text = constants.LOCATION_SAFE
 		ranking.NumIncidents = 0
-		newErr.Msg = "Aggregation failed."
+		metrics.LocationRanked(ranking.Text)
 		return ranking, nil
 	}
 
-	result, ok := results[0]["avg"].(float64)
+	result := float64(count) / float64(dayAvg)
 
-	if !ok {
-		newErr.Msg = "Failed to convert aggregation result to float."
-		return ranking, &newErr
-	}
-
-	if 0 <= result && result <= 0.4 {
+	if 0 <= result && result < h.conf.Location.WarningAverage {
 		text = constants.LOCATION_SAFE
-	} else if 0.5 <= result && result <= 0.9 {
+	} else if h.conf.Location.WarningAverage <= result && result < h.conf.Location.UnsafeAverage {
 		text = constants.LOCATION_WARNING
-	} else if result >= 1 {
+	} else if result >= h.conf.Location.UnsafeAverage {
 		text = constants.LOCATION_UNSAFE
 	} else {
 		// handle negative cases
@@ -251,35 +244,8 @@ func GetLocationRanking(lat, long float64) (models.LocationRanking, error) {
 
 	ranking.Text = text
 	ranking.Average = result
-	ranking.NumIncidents = results[0]["count"].(int32)
+	ranking.NumIncidents = int32(count)
 
+	metrics.LocationRanked(text)
 	return ranking, nil
 }
-
-// Seed ...
-func Seed() (*mongo.InsertManyResult, error) {
-	jsonFile, err := os.Open("./seed_entries.json")
-	// if we os.Open returns an error then handle it
-	if err != nil {
-		panic(err)
-	}
-	defer jsonFile.Close()
-
-	byteValue, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		panic(err)
-	}
-
-	var entries []models.Entry
-	// json.NewDecoder(byteValue).Decode(&entries)
-
-	json.Unmarshal(byteValue, &entries)
-
-	// clear the entries collection
-	_, err = ClearEntries()
-	if err != nil {
-		panic(err)
-	}
-
-	return CreateMultipleEntries(entries)
-}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExportFilter narrows down the entries that are exported. Empty fields match
+// anything.
+type ExportFilter struct {
+	From      time.Time
+	To        time.Time
+	AlertType *primitive.ObjectID
+	// area around Near, in the same [lat, long] order as entry locations
+	Near   *[2]float64
+	Radius float64
+	// decimal places coordinates are rounded to, or 0 to keep them exact.
+	// Street addresses are left out of rounded exports.
+	Precision int
+}
+
+func (f ExportFilter) query() bson.M {
+	q := PublicEntryQuery(bson.M{})
+
+	created := bson.M{}
+	if !f.From.IsZero() {
+		created["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		created["$lte"] = f.To
+	}
+	if len(created) > 0 {
+		q["created"] = created
+	}
+
+	if f.AlertType != nil {
+		q["alertType"] = *f.AlertType
+	}
+
+	if f.Near != nil {
+		q["location"] = bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{f.Near[:], f.Radius / earthRadius},
+			},
+		}
+	}
+
+	return q
+}
+
+// ExportedEntry is an entry as it is shared outside the app. It never says
+// who reported the entry.
+type ExportedEntry struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	ContentURL  string    `json:"contentURL"`
+	ContentType string    `json:"contentType"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	Address     string    `json:"address,omitempty"`
+	City        string    `json:"city,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	AlertType   string    `json:"alertType"`
+	Level       int       `json:"level"`
+	Created     time.Time `json:"created"`
+	Edited      bool      `json:"edited"`
+}
+
+// exportWriter writes exported entries in one format.
+type exportWriter interface {
+	begin() error
+	write(entry ExportedEntry) error
+	end() error
+}
+
+// IsExportFormat reports whether entries can be exported in the format.
+func IsExportFormat(format string) bool {
+	switch format {
+	case constants.EXPORT_FORMAT_GEOJSON, constants.EXPORT_FORMAT_CSV, constants.EXPORT_FORMAT_KML:
+		return true
+	}
+	return false
+}
+
+// ExportEntries streams the public entries matching the filter in the given
+// format, in the order they were added. Entries are written as they are read,
+// so exports of any size use the same memory.
+func (h *Handlers) ExportEntries(ctx context.Context, filter ExportFilter, format string, w io.Writer) error {
+	var writer exportWriter
+	switch format {
+	case constants.EXPORT_FORMAT_GEOJSON:
+		writer = &geoJSONExportWriter{w: w}
+	case constants.EXPORT_FORMAT_CSV:
+		writer = &csvExportWriter{w: csv.NewWriter(w)}
+	case constants.EXPORT_FORMAT_KML:
+		writer = &kmlExportWriter{w: w, enc: xml.NewEncoder(w)}
+	default:
+		return constants.ValidationError(constants.InvalidParam("format"))
+	}
+
+	// there are few alert types, so they're looked up once instead of
+	// joined onto every entry
+	alertTypes, err := h.AlertTypes().GetMultiple(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	alertTypesByID := make(map[primitive.ObjectID]models.AlertType)
+	for _, alertType := range alertTypes {
+		alertTypesByID[alertType.ID] = alertType
+	}
+
+	if err := writer.begin(); err != nil {
+		return err
+	}
+
+	opts := store.FindOptions{Sort: "_id"}
+	err = h.stores.Entries.Each(ctx, filter.query(), opts, func(entry models.Entry) error {
+		return writer.write(exportEntry(entry, alertTypesByID[entry.AlertType], filter.Precision))
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.end()
+}
+
+func exportEntry(entry models.Entry, alertType models.AlertType, precision int) ExportedEntry {
+	exported := ExportedEntry{
+		ID:          entry.ID.Hex(),
+		Title:       entry.Title,
+		Description: entry.Description,
+		ContentURL:  entry.ContentURL,
+		ContentType: entry.ContentType,
+		Latitude:    entry.Location.Coordinates[0],
+		Longitude:   entry.Location.Coordinates[1],
+		AlertType:   alertType.Name,
+		Level:       alertType.Level,
+		Created:     entry.Created,
+		Edited:      entry.Edited,
+	}
+
+	if entry.Address != nil {
+		exported.City = entry.Address.City
+		exported.State = entry.Address.State
+		exported.Country = entry.Address.Country
+	}
+
+	if precision > 0 {
+		exported.Latitude = roundTo(exported.Latitude, precision)
+		exported.Longitude = roundTo(exported.Longitude, precision)
+	} else if entry.Address != nil {
+		exported.Address = entry.Address.FormattedAddress
+	}
+
+	return exported
+}
+
+func roundTo(n float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(n*scale) / scale
+}
+
+type geoJSONExportWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (g *geoJSONExportWriter) begin() error {
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJSONExportWriter) write(entry ExportedEntry) error {
+	feature := map[string]interface{}{
+		"type": "Feature",
+		"id":   entry.ID,
+		"geometry": map[string]interface{}{
+			"type": "Point",
+			// GeoJSON puts longitude first
+			"coordinates": []float64{entry.Longitude, entry.Latitude},
+		},
+		"properties": entry,
+	}
+
+	b, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+
+	if g.wrote {
+		if _, err := io.WriteString(g.w, ","); err != nil {
+			return err
+		}
+	}
+	g.wrote = true
+
+	_, err = g.w.Write(b)
+	return err
+}
+
+func (g *geoJSONExportWriter) end() error {
+	_, err := io.WriteString(g.w, "]}")
+	return err
+}
+
+// exportCSVHeader is the header row of entry CSV exports
+var exportCSVHeader = []string{"id", "title", "description", "contentURL", "contentType", "latitude", "longitude", "address", "city", "state", "country", "alertType", "level", "created", "edited"}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) begin() error {
+	return c.w.Write(exportCSVHeader)
+}
+
+func (c *csvExportWriter) write(entry ExportedEntry) error {
+	return c.w.Write([]string{
+		entry.ID,
+		entry.Title,
+		entry.Description,
+		entry.ContentURL,
+		entry.ContentType,
+		strconv.FormatFloat(entry.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(entry.Longitude, 'f', -1, 64),
+		entry.Address,
+		entry.City,
+		entry.State,
+		entry.Country,
+		entry.AlertType,
+		strconv.Itoa(entry.Level),
+		entry.Created.Format(time.RFC3339),
+		strconv.FormatBool(entry.Edited),
+	})
+}
+
+func (c *csvExportWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type kmlPlacemark struct {
+	XMLName     xml.Name  `xml:"Placemark"`
+	ID          string    `xml:"id,attr"`
+	Name        string    `xml:"name"`
+	Description string    `xml:"description"`
+	When        string    `xml:"TimeStamp>when"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlExportWriter struct {
+	w   io.Writer
+	enc *xml.Encoder
+}
+
+func (k *kmlExportWriter) begin() error {
+	_, err := io.WriteString(k.w, xml.Header+`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>Mrkt entries</name>`)
+	return err
+}
+
+func (k *kmlExportWriter) write(entry ExportedEntry) error {
+	placemark := kmlPlacemark{
+		ID:          entry.ID,
+		Name:        entry.Title,
+		Description: entry.Description,
+		When:        entry.Created.Format(time.RFC3339),
+		Data: []kmlData{
+			{Name: "alertType", Value: entry.AlertType},
+			{Name: "level", Value: strconv.Itoa(entry.Level)},
+			{Name: "contentURL", Value: entry.ContentURL},
+			{Name: "contentType", Value: entry.ContentType},
+			{Name: "address", Value: entry.Address},
+			{Name: "city", Value: entry.City},
+			{Name: "state", Value: entry.State},
+			{Name: "country", Value: entry.Country},
+			{Name: "edited", Value: strconv.FormatBool(entry.Edited)},
+		},
+		// KML puts longitude first too
+		Coordinates: strconv.FormatFloat(entry.Longitude, 'f', -1, 64) + "," + strconv.FormatFloat(entry.Latitude, 'f', -1, 64),
+	}
+	return k.enc.Encode(placemark)
+}
+
+func (k *kmlExportWriter) end() error {
+	if err := k.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(k.w, "</Document></kml>")
+	return err
+}
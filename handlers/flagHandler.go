@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FlagEntry records a user's flag on an entry. Each flag adds the reporter's
+// rank to the entry's flag score, and an entry whose score reaches
+// FLAG_HIDE_THRESHOLD is hidden until an admin reviews it. Entries an admin
+// has already approved stay up, but still show up for review.
+func (h *Handlers) FlagEntry(ctx context.Context, entry models.Entry, user models.User, flag models.Flag) (models.Flag, error) {
+	var err error
+	flag.ID = primitive.NewObjectID()
+	flag.Entry = entry.ID
+	flag.ReportedBy = user.ID
+	flag.Weight = flagWeight(user)
+	flag.Created = time.Now()
+
+	// the unique index on entry and reporter catches flagging twice, even
+	// at the same time
+	if _, err := h.stores.Flags.InsertOne(ctx, flag); err != nil {
+		if store.IsDuplicateKey(err) {
+			return flag, constants.ConflictError(constants.AlreadyFlagged)
+		}
+		return flag, err
+	}
+
+	update := bson.M{"$inc": bson.M{"flagScore": flag.Weight}}
+	if entry, err = h.stores.Entries.FindOneAndUpdate(ctx, bson.M{"_id": entry.ID}, update, false); err != nil {
+		return flag, err
+	}
+
+	state := entry.Moderation.State
+	if entry.FlagScore >= constants.FLAG_HIDE_THRESHOLD && (state == "" || state == constants.MODERATION_NEW) {
+		update := bson.M{"$set": bson.M{"moderation.state": constants.MODERATION_FLAGGED, "updated": time.Now()}}
+		_, err = h.stores.Entries.UpdateOne(ctx, bson.M{"_id": entry.ID}, update)
+	}
+
+	return flag, err
+}
+
+// GetFlaggedEntries returns entries that have been flagged, most flagged
+// first.
+func (h *Handlers) GetFlaggedEntries(ctx context.Context) ([]models.Entry, error) {
+	q := bson.M{"status": constants.Enabled, "flagScore": bson.M{"$gt": 0}}
+	return h.stores.Entries.Find(ctx, q, store.FindOptions{Sort: "-flagScore"})
+}
+
+// GetFlags returns flags matching the query, newest first.
+func (h *Handlers) GetFlags(ctx context.Context, q bson.M) ([]models.Flag, error) {
+	return h.stores.Flags.Find(ctx, q, store.FindOptions{Sort: "-created"})
+}
+
+// flagWeight is how much a user's flag counts for. Users who haven't been
+// ranked yet count as pups.
+func flagWeight(user models.User) int {
+	if user.Ranking.Rank < constants.PUP_RANK {
+		return constants.PUP_RANK
+	}
+	return user.Ranking.Rank
+}
@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ImportFields are the entry fields an import can set. Unless mapped to
+// something else, each is read from the column or property of the same name.
+// GeoJSON features take their coordinates from their geometry instead.
+var ImportFields = []string{"title", "description", "contentURL", "contentType", "latitude", "longitude", "alertType", "created"}
+
+// fields every row needs a value for
+var requiredImportFields = []string{"title", "description", "contentURL", "alertType", "latitude", "longitude"}
+
+// ImportOptions controls how a file of entries is imported.
+type ImportOptions struct {
+	Format     string
+	Mapping    map[string]string // entry field to the column or property it is read from
+	DryRun     bool              // validate every row without saving anything
+	ImportedBy models.AuditActor
+}
+
+type importRow struct {
+	row    int
+	values map[string]string // by entry field
+	err    string            // the row couldn't be read at all
+}
+
+// IsImportFormat reports whether entries can be imported from the format.
+func IsImportFormat(format string) bool {
+	return format == constants.IMPORT_FORMAT_CSV || format == constants.IMPORT_FORMAT_GEOJSON
+}
+
+// ImportEntries adds the entries in a CSV or GeoJSON file, such as historical
+// incidents. Alert types are matched by name. Each row is validated on its
+// own, and rows with errors are skipped rather than failing the whole import.
+// Existing entries are never touched. Imported entries don't go through
+// moderation, and are reverse geocoded in batches unless it is a dry run.
+// An error is only returned if the file can't be read at all.
+func (h *Handlers) ImportEntries(ctx context.Context, r io.Reader, opts ImportOptions) (models.ImportReport, error) {
+	report := models.ImportReport{DryRun: opts.DryRun, Rows: []models.ImportRowResult{}}
+
+	mapping, err := importMapping(opts.Mapping)
+	if err != nil {
+		return report, err
+	}
+
+	var rows []importRow
+	switch opts.Format {
+	case constants.IMPORT_FORMAT_CSV:
+		rows, err = readImportCSV(r, mapping)
+	case constants.IMPORT_FORMAT_GEOJSON:
+		rows, err = readImportGeoJSON(r, mapping)
+	default:
+		err = constants.ValidationError(constants.InvalidParam("format"))
+	}
+	if err != nil {
+		return report, err
+	}
+
+	alertTypes, err := h.AlertTypes().GetMultiple(ctx, bson.M{})
+	if err != nil {
+		return report, err
+	}
+	alertTypesByName := make(map[string]models.AlertType)
+	for _, alertType := range alertTypes {
+		alertTypesByName[strings.ToLower(alertType.Name)] = alertType
+	}
+
+	// entries that passed validation, and the results they belong to
+	var entries []models.Entry
+	var results []*models.ImportRowResult
+
+	report.Rows = make([]models.ImportRowResult, len(rows))
+	for i, row := range rows {
+		result := &report.Rows[i]
+		result.Row = row.row
+
+		if row.err != "" {
+			result.Errors = []string{row.err}
+			continue
+		}
+
+		entry, errs := buildImportEntry(row.values, alertTypesByName)
+		if len(errs) > 0 {
+			result.Errors = errs
+			continue
+		}
+
+		entries = append(entries, entry)
+		results = append(results, result)
+	}
+
+	if !opts.DryRun {
+		for start := 0; start < len(entries); start += constants.GEOCODE_BATCH_SIZE {
+			end := start + constants.GEOCODE_BATCH_SIZE
+			if end > len(entries) {
+				end = len(entries)
+			}
+			h.saveImportBatch(ctx, entries[start:end], results[start:end], opts.ImportedBy)
+		}
+	}
+
+	report.Total = len(rows)
+	for _, result := range report.Rows {
+		if len(result.Errors) > 0 {
+			report.Failed++
+		} else {
+			report.Imported++
+		}
+	}
+
+	return report, nil
+}
+
+// importMapping fills in the default column for every field that isn't
+// mapped to anything else.
+func importMapping(custom map[string]string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, field := range ImportFields {
+		mapping[field] = field
+	}
+
+	for field, column := range custom {
+		if _, ok := mapping[field]; !ok || column == "" {
+			return nil, constants.ValidationError(constants.InvalidParam("mapping for " + field))
+		}
+		mapping[field] = column
+	}
+
+	return mapping, nil
+}
+
+func readImportCSV(r io.Reader, mapping map[string]string) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, constants.ValidationError("The file could not be read as CSV: " + err.Error())
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, field := range requiredImportFields {
+		if _, ok := columns[mapping[field]]; !ok {
+			return nil, constants.ValidationError(fmt.Sprintf("The file has no %s column for %s.", mapping[field], field))
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// after a parse error there's no telling where the next row
+			// starts, so the rest of the file can't be trusted
+			return nil, constants.ValidationError("The file could not be read as CSV: " + err.Error())
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := importRow{row: line}
+
+		if len(record) != len(header) {
+			row.err = fmt.Sprintf("expected %d columns, found %d", len(header), len(record))
+			rows = append(rows, row)
+			continue
+		}
+
+		row.values = make(map[string]string)
+		for field, column := range mapping {
+			if i, ok := columns[column]; ok {
+				row.values[field] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Type     string `json:"type"`
+		Geometry *struct {
+			Type        string    `json:"type"`
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"features"`
+}
+
+func readImportGeoJSON(r io.Reader, mapping map[string]string) ([]importRow, error) {
+	var collection geoJSONFeatureCollection
+	if err := json.NewDecoder(r).Decode(&collection); err != nil {
+		return nil, constants.ValidationError("The file could not be read as GeoJSON: " + err.Error())
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, constants.ValidationError("The file must be a GeoJSON FeatureCollection.")
+	}
+
+	rows := make([]importRow, len(collection.Features))
+	for i, feature := range collection.Features {
+		row := importRow{row: i + 1}
+
+		geometry := feature.Geometry
+		if feature.Type != "Feature" || geometry == nil || geometry.Type != "Point" || len(geometry.Coordinates) < 2 {
+			row.err = "expected a Feature with a Point geometry"
+			rows[i] = row
+			continue
+		}
+
+		row.values = make(map[string]string)
+		for field, property := range mapping {
+			if value, ok := feature.Properties[property]; ok {
+				row.values[field] = propertyString(value)
+			}
+		}
+
+		// GeoJSON puts longitude first
+		row.values["longitude"] = strconv.FormatFloat(geometry.Coordinates[0], 'f', -1, 64)
+		row.values["latitude"] = strconv.FormatFloat(geometry.Coordinates[1], 'f', -1, 64)
+
+		rows[i] = row
+	}
+
+	return rows, nil
+}
+
+func propertyString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// buildImportEntry turns a row's values into an entry, or says everything
+// that is wrong with them.
+func buildImportEntry(values map[string]string, alertTypes map[string]models.AlertType) (models.Entry, []string) {
+	entry := *models.GetDefaultEntry()
+	var errs []string
+
+	for _, field := range requiredImportFields {
+		if values[field] == "" {
+			errs = append(errs, field+" is required")
+		}
+	}
+
+	entry.Title = values["title"]
+	entry.Description = values["description"]
+	entry.ContentURL = values["contentURL"]
+	if values["contentType"] != "" {
+		entry.ContentType = values["contentType"]
+		if !IsContentType(entry.ContentType) {
+			errs = append(errs, "contentType must be one of "+strings.Join(constants.ContentTypes, ", "))
+		}
+	}
+
+	if name := values["alertType"]; name != "" {
+		alertType, ok := alertTypes[strings.ToLower(name)]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("there is no alert type called %q", name))
+		}
+		entry.AlertType = alertType.ID
+	}
+
+	coordinate := func(field string, limit float64) float64 {
+		value := values[field]
+		if value == "" {
+			return 0
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < -limit || n > limit {
+			errs = append(errs, fmt.Sprintf("%s must be a number between -%g and %g", field, limit, limit))
+		}
+		return n
+	}
+	// stored latitude first, like every other entry
+	entry.Location.Coordinates = [2]float64{coordinate("latitude", 90), coordinate("longitude", 180)}
+
+	if value := values["created"]; value != "" {
+		created, err := parseImportTime(value)
+		switch {
+		case err != nil:
+			errs = append(errs, "created must be a date or an RFC 3339 time")
+		case created.After(time.Now()):
+			errs = append(errs, "created can't be in the future")
+		default:
+			entry.Created = created
+		}
+	}
+
+	// an admin is vouching for the data, so it doesn't need moderating.
+	// No decision time is recorded, to keep it out of resolution stats.
+	entry.Moderation = models.Moderation{State: constants.MODERATION_APPROVED}
+	// historical incidents don't have a reporter
+	entry.Anonymous = true
+
+	return entry, errs
+}
+
+func parseImportTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// saveImportBatch geocodes a batch of entries at the same time, then inserts
+// them in one go. Failures are recorded against the rows they came from.
+func (h *Handlers) saveImportBatch(ctx context.Context, entries []models.Entry, results []*models.ImportRowResult, importedBy models.AuditActor) {
+	for i, err := range h.geocodeEntries(ctx, entries) {
+		if err != nil {
+			results[i].Warnings = append(results[i].Warnings, "the address could not be looked up: "+err.Error())
+		}
+	}
+
+	// one bad row doesn't stop the rest of the batch
+	_, err := h.stores.Entries.InsertMany(ctx, entries)
+
+	// the reason each row that wasn't saved wasn't
+	failed := make(map[int]string)
+	if insertErr, ok := err.(*store.InsertManyError); ok {
+		for i, rowErr := range insertErr.Failed {
+			failed[i] = "the entry could not be saved: " + rowErr.Error()
+		}
+	} else if err != nil {
+		// Some or all of the batch may have been saved anyway, e.g. if the
+		// connection dropped after the write, so look for the entries.
+		saved, lookupErr := h.savedEntries(ctx, entries)
+		for i, entry := range entries {
+			switch {
+			case lookupErr != nil:
+				failed[i] = "the entry may or may not have been saved: " + err.Error()
+			case !saved[entry.ID]:
+				failed[i] = "the entry could not be saved: " + err.Error()
+			}
+		}
+	}
+
+	for i, entry := range entries {
+		if msg, ok := failed[i]; ok {
+			results[i].Errors = append(results[i].Errors, msg)
+			continue
+		}
+
+		id := entry.ID
+		results[i].EntryID = &id
+
+		// dated when it was imported, not when the incident happened
+		if _, err := h.SaveEntryRevision(ctx, entry, importedBy, 0); err != nil {
+			results[i].Warnings = append(results[i].Warnings, "its first revision could not be saved: "+err.Error())
+		}
+	}
+}
+
+// savedEntries returns which of the entries are in the database, by ID.
+func (h *Handlers) savedEntries(ctx context.Context, entries []models.Entry) (map[primitive.ObjectID]bool, error) {
+	ids := make([]primitive.ObjectID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+
+	found, err := h.stores.Entries.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+
+	saved := make(map[primitive.ObjectID]bool, len(found))
+	for _, entry := range found {
+		saved[entry.ID] = true
+	}
+	return saved, nil
+}
+
+// IsContentType reports whether entries can have the content type.
+func IsContentType(contentType string) bool {
+	for _, known := range constants.ContentTypes {
+		if contentType == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CheckLoginAllowed returns how long the caller has to wait before the next
+// login attempt for this account and IP is allowed. Zero means go ahead.
+func (h *Handlers) CheckLoginAllowed(ctx context.Context, email string, isAdmin bool, ip string) (time.Duration, error) {
+	account, err := h.getLoginAttempt(ctx, accountAttemptKey(email, isAdmin))
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := h.getLoginAttempt(ctx, ipAttemptKey(ip))
+	if err != nil {
+		return 0, err
+	}
+
+	// Only accounts get progressive delays. An IP may be shared by a lot of
+	// people (mobile carriers, offices), so it is only ever locked out.
+	wait := attemptWait(account, true)
+	if ipWait := attemptWait(client, false); ipWait > wait {
+		wait = ipWait
+	}
+	return wait, nil
+}
+
+// RecordFailedLogin registers a failed attempt against both the account and
+// the IP. It returns true if this attempt caused the account to be locked.
+func (h *Handlers) RecordFailedLogin(ctx context.Context, email string, isAdmin bool, ip string) (bool, error) {
+	locked, err := h.incrementLoginAttempt(ctx, accountAttemptKey(email, isAdmin), constants.ACCOUNT_LOCKOUT_THRESHOLD)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := h.incrementLoginAttempt(ctx, ipAttemptKey(ip), constants.IP_LOCKOUT_THRESHOLD); err != nil {
+		return false, err
+	}
+
+	return locked, nil
+}
+
+// ResetLoginAttempts clears the failures recorded against an account. The IP
+// counter is left alone so one valid login can't be used to reset it.
+func (h *Handlers) ResetLoginAttempts(ctx context.Context, email string, isAdmin bool) error {
+	_, err := h.stores.LoginAttempts.DeleteOne(ctx, bson.M{"_id": accountAttemptKey(email, isAdmin)})
+	return err
+}
+
+// UnlockAccount lifts a lockout on a user's account.
+func (h *Handlers) UnlockAccount(ctx context.Context, user models.User) error {
+	return h.ResetLoginAttempts(ctx, user.Email, user.IsAdmin)
+}
+
+// NotifyAccountLocked lets the owner of an account know that it has been
+// locked because of repeated failed logins.
+func (h *Handlers) NotifyAccountLocked(ctx context.Context, user models.User) error {
+	msg := "Your account was temporarily locked after too many failed login attempts. " +
+		"If this wasn't you, we recommend you change your password."
+	return h.NotifyUser(ctx, user, constants.NOTIFICATION_ACCOUNT_LOCKED, "Your account has been locked", msg)
+}
+
+// incrementLoginAttempt counts a failure against key, locking it once it
+// has lockoutThreshold of them. It returns true if this failure locked it.
+// Failures are counted in the database, so ones made in parallel all count.
+func (h *Handlers) incrementLoginAttempt(ctx context.Context, key string, lockoutThreshold int) (bool, error) {
+	now := time.Now()
+
+	// Failures expire once the key has been quiet for a whole lockout window.
+	expired := bson.M{
+		"_id":         key,
+		"$or":         notLockedAt(now),
+		"lastFailure": bson.M{"$lt": now.Add(-constants.LOCKOUT_DURATION)},
+	}
+	if _, err := h.stores.LoginAttempts.UpdateOne(ctx, expired, bson.M{"$set": bson.M{"failures": 0}}); err != nil {
+		return false, err
+	}
+
+	update := bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"lastFailure": now}}
+	attempt, err := h.stores.LoginAttempts.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, true)
+	if err != nil || attempt.Failures < lockoutThreshold {
+		return false, err
+	}
+
+	// Failures made in parallel can all pass the threshold, but only the one
+	// that finds the key unlocked locks it.
+	unlocked := bson.M{"_id": key, "$or": notLockedAt(now)}
+	lock := bson.M{"$set": bson.M{"lockedUntil": now.Add(constants.LOCKOUT_DURATION)}}
+	result, err := h.stores.LoginAttempts.UpdateOne(ctx, unlocked, lock)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// notLockedAt matches keys that aren't locked at t, including ones that
+// have never been.
+func notLockedAt(t time.Time) []bson.M {
+	return []bson.M{
+		{"lockedUntil": bson.M{"$exists": false}},
+		{"lockedUntil": bson.M{"$lte": t}},
+	}
+}
+
+func (h *Handlers) getLoginAttempt(ctx context.Context, key string) (models.LoginAttempt, error) {
+	attempt, err := h.stores.LoginAttempts.FindOne(ctx, bson.M{"_id": key})
+	if err == mongo.ErrNoDocuments {
+		return models.LoginAttempt{Key: key}, nil
+	}
+	return attempt, err
+}
+
+func attemptWait(attempt models.LoginAttempt, progressive bool) time.Duration {
+	now := time.Now()
+
+	if attempt.LockedUntil.After(now) {
+		return attempt.LockedUntil.Sub(now)
+	}
+
+	if !progressive || attempt.Failures < constants.LOGIN_FREE_ATTEMPTS {
+		return 0
+	}
+
+	delay := constants.LOGIN_MAX_DELAY
+	if shift := attempt.Failures - constants.LOGIN_FREE_ATTEMPTS; shift < 16 {
+		if d := time.Second << uint(shift); d < delay {
+			delay = d
+		}
+	}
+
+	if next := attempt.LastFailure.Add(delay); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func accountAttemptKey(email string, isAdmin bool) string {
+	kind := "user"
+	if isAdmin {
+		kind = "admin"
+	}
+	return "account:" + kind + ":" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+)
+
+func TestRecordFailedLoginLocksAccount(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	h := New(config.Default(), store.NewMemory())
+
+	for i := 1; i <= constants.ACCOUNT_LOCKOUT_THRESHOLD; i++ {
+		locked, err := h.RecordFailedLogin(ctx, "Ada@example.com", false, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i == constants.ACCOUNT_LOCKOUT_THRESHOLD; locked != want {
+			t.Errorf("failure %d: locked = %v, want %v", i, locked, want)
+		}
+
+		wait, err := h.CheckLoginAllowed(ctx, "ada@example.com", false, "10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case i < constants.LOGIN_FREE_ATTEMPTS && wait != 0:
+			t.Errorf("failure %d: wait = %v, want none yet", i, wait)
+		case i >= constants.LOGIN_FREE_ATTEMPTS && wait == 0:
+			t.Errorf("failure %d: no wait, want a delay", i)
+		}
+	}
+
+	wait, err := h.CheckLoginAllowed(ctx, "ada@example.com", false, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= constants.LOGIN_MAX_DELAY || wait > constants.LOCKOUT_DURATION {
+		t.Errorf("wait = %v, want the account locked for %v", wait, constants.LOCKOUT_DURATION)
+	}
+
+	// admins and users with the same email are counted apart
+	if wait, err := h.CheckLoginAllowed(ctx, "ada@example.com", true, "10.0.0.2"); err != nil || wait != 0 {
+		t.Errorf("admin account: wait = %v, err = %v, want no wait", wait, err)
+	}
+
+	if err := h.ResetLoginAttempts(ctx, "ada@example.com", false); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := h.CheckLoginAllowed(ctx, "ada@example.com", false, "10.0.0.2"); err != nil || wait != 0 {
+		t.Errorf("after a reset: wait = %v, err = %v, want no wait", wait, err)
+	}
+}
+
+func TestRecordFailedLoginInParallel(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	h := New(config.Default(), store.NewMemory())
+
+	const attempts = 3 * constants.ACCOUNT_LOCKOUT_THRESHOLD
+	var wg sync.WaitGroup
+	locks := make(chan bool, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			locked, err := h.RecordFailedLogin(ctx, "ada@example.com", false, "10.0.0.1")
+			if err != nil {
+				t.Error(err)
+			}
+			locks <- locked
+		}()
+	}
+	wg.Wait()
+	close(locks)
+
+	// every failure counts, and exactly one of them locks the account
+	lockedBy := 0
+	for locked := range locks {
+		if locked {
+			lockedBy++
+		}
+	}
+	if lockedBy != 1 {
+		t.Errorf("%d failures locked the account, want 1", lockedBy)
+	}
+
+	account, err := h.getLoginAttempt(ctx, accountAttemptKey("ada@example.com", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Failures != attempts {
+		t.Errorf("account failures = %d, want %d", account.Failures, attempts)
+	}
+	if !account.LockedUntil.After(time.Now()) {
+		t.Error("the account isn't locked")
+	}
+
+	client, err := h.getLoginAttempt(ctx, ipAttemptKey("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Failures != attempts || !client.LockedUntil.IsZero() {
+		t.Errorf("IP attempt = %+v, want %d failures and no lock", client, attempts)
+	}
+}
+
+func TestRecordFailedLoginExpires(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	h := New(config.Default(), store.NewMemory())
+
+	key := accountAttemptKey("ada@example.com", false)
+	long := time.Now().Add(-2 * constants.LOCKOUT_DURATION)
+	old := []models.LoginAttempt{
+		// one failure short of a lock, but quiet for a whole window
+		{Key: key, Failures: constants.ACCOUNT_LOCKOUT_THRESHOLD - 1, LastFailure: long},
+		// a lock that has run out
+		{Key: ipAttemptKey("10.0.0.1"), Failures: constants.IP_LOCKOUT_THRESHOLD, LastFailure: long, LockedUntil: long.Add(constants.LOCKOUT_DURATION)},
+	}
+	if _, err := h.stores.LoginAttempts.InsertMany(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := h.RecordFailedLogin(ctx, "ada@example.com", false, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Error("an expired failure counted towards a lock")
+	}
+	for _, key := range []string{key, ipAttemptKey("10.0.0.1")} {
+		attempt, err := h.getLoginAttempt(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Failures != 1 {
+			t.Errorf("%s failures = %d, want to start again from 1", key, attempt.Failures)
+		}
+	}
+}
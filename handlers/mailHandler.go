@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+)
+
+// SendMail sends a plain text email through the configured SMTP server.
+// If no SMTP host is configured the email is written to the log instead, so
+// local setups don't need a mail server.
+func (h *Handlers) SendMail(to, subject, body string) error {
+	host := h.conf.SMTP.Host
+	if host == "" {
+		slog.Info("No SMTP host, so the email was not sent", "to", to, "subject", subject, "body", body)
+		return nil
+	}
+
+	port := h.conf.SMTP.Port
+	from := h.conf.SMTP.From
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", from, to, subject, body)
+
+	var auth smtp.Auth
+	if username := h.conf.SMTP.Username; username != "" {
+		auth = smtp.PlainAuth("", username, h.conf.SMTP.Password, host)
+	}
+
+	return smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg))
+}
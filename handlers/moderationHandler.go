@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PublicEntryQuery restricts an entry query to what the public can see.
+func PublicEntryQuery(q bson.M) bson.M {
+	q["status"] = constants.Enabled
+	q["moderation.state"] = bson.M{"$nin": constants.HiddenModerationStates}
+	q["hidden"] = bson.M{"$ne": true}
+	return q
+}
+
+// GetModerationQueue returns the entries waiting for an admin, oldest first.
+func (h *Handlers) GetModerationQueue(ctx context.Context) ([]models.Entry, error) {
+	q := bson.M{
+		"status":           constants.Enabled,
+		"moderation.state": bson.M{"$in": constants.QueuedModerationStates},
+	}
+	return h.stores.Entries.Find(ctx, q, store.FindOptions{Sort: "created"})
+}
+
+// ModerateEntry applies an admin's decision to an entry. Reporters are told
+// when their entry is rejected.
+func (h *Handlers) ModerateEntry(ctx context.Context, entry models.Entry, action, reason string, adminID primitive.ObjectID) (models.Entry, error) {
+	state, ok := constants.ModerationActions[action]
+	if !ok {
+		return entry, constants.ValidationError(constants.InvalidParam("moderation action"))
+	}
+
+	if state != constants.MODERATION_APPROVED && reason == "" {
+		return entry, constants.ValidationError("Please give a reason for this decision.")
+	}
+
+	now := time.Now()
+	entry.Moderation = models.Moderation{
+		State:       state,
+		Reason:      reason,
+		ModeratedBy: &adminID,
+		ModeratedAt: &now,
+	}
+
+	update := bson.M{"$set": bson.M{"moderation": entry.Moderation, "updated": now}}
+	if _, err := h.stores.Entries.UpdateOne(ctx, bson.M{"_id": entry.ID}, update); err != nil {
+		return entry, err
+	}
+
+	if state == constants.MODERATION_REJECTED && entry.UploadedBy != nil {
+		if err := h.notifyEntryRejected(ctx, entry); err != nil {
+			slog.Error("Failed to notify reporter of rejected entry", "entryId", entry.ID.Hex(), logging.Error(err))
+		}
+	}
+
+	return entry, nil
+}
+
+// BulkModerateEntries applies the same decision to several entries. done is
+// called with each entry before and after it was moderated. It returns the
+// error for each entry that couldn't be moderated, by ID.
+func (h *Handlers) BulkModerateEntries(ctx context.Context, ids []string, action, reason string, adminID primitive.ObjectID, done func(before, after models.Entry)) map[string]string {
+	failed := make(map[string]string)
+
+	for _, id := range ids {
+		entry, err := h.GetEntryByID(ctx, id)
+		if err != nil {
+			failed[id] = err.Error()
+			continue
+		}
+
+		moderated, err := h.ModerateEntry(ctx, entry, action, reason, adminID)
+		if err != nil {
+			failed[id] = err.Error()
+			continue
+		}
+		done(entry, moderated)
+	}
+
+	return failed
+}
+
+func (h *Handlers) notifyEntryRejected(ctx context.Context, entry models.Entry) error {
+	user, err := h.GetUser(ctx, bson.M{"_id": *entry.UploadedBy})
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Your report \"%s\" was rejected by a moderator: %s", entry.Title, entry.Moderation.Reason)
+	return h.NotifyUser(ctx, user, constants.NOTIFICATION_ENTRY_REJECTED, "Your report was rejected", msg)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/logging"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NotifyUser stores an in-app notification for the user and emails it to
+// them. A failed email doesn't fail the notification.
+func (h *Handlers) NotifyUser(ctx context.Context, user models.User, notificationType, subject, message string) error {
+	notification := models.Notification{
+		ID:      primitive.NewObjectID(),
+		User:    user.ID,
+		Type:    notificationType,
+		Message: message,
+		Created: time.Now(),
+	}
+
+	if _, err := h.stores.Notifications.InsertOne(ctx, notification); err != nil {
+		return err
+	}
+
+	if err := h.SendMail(user.Email, subject, message); err != nil {
+		slog.Error("Failed to email notification", "userId", user.ID.Hex(), logging.Error(err))
+	}
+	return nil
+}
+
+// GetUserNotifications returns a user's notifications, newest first.
+func (h *Handlers) GetUserNotifications(ctx context.Context, userID primitive.ObjectID) ([]models.Notification, error) {
+	return h.stores.Notifications.Find(ctx, bson.M{"user": userID}, store.FindOptions{Sort: "-created"})
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Issuers for the providers we know about. Any other provider has to have its
+// issuer configured, which is also how to point a provider at a mock issuer.
+var defaultIssuers = map[string]string{
+	"google": "https://accounts.google.com",
+	"apple":  "https://appleid.apple.com",
+}
+
+// OIDCProvider is an OpenID Connect provider users can log in with.
+type OIDCProvider struct {
+	Name      string
+	provider  *oidc.Provider
+	verifier  *oidc.IDTokenVerifier
+	oauth     oauth2.Config
+	audiences []string
+	h         *Handlers
+}
+
+// OIDCClaims are the ID token claims we use.
+type OIDCClaims struct {
+	Subject           string     `json:"sub"`
+	Email             string     `json:"email"`
+	EmailVerified     stringBool `json:"email_verified"`
+	Name              string     `json:"name"`
+	PreferredUsername string     `json:"preferred_username"`
+	Nonce             string     `json:"nonce"`
+}
+
+// stringBool accepts both true and "true". Apple sends booleans as strings.
+type stringBool bool
+
+func (b *stringBool) UnmarshalJSON(data []byte) error {
+	*b = stringBool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+type oidcStateClaim struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Purpose  string `json:"purpose"`
+	jwt.StandardClaims
+}
+
+var usernameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// GetOIDCProvider returns a configured provider. Providers are discovered the
+// first time they are used, so an issuer that is down doesn't stop the API
+// from starting.
+func (h *Handlers) GetOIDCProvider(ctx context.Context, name string) (*OIDCProvider, error) {
+	h.oidcProvidersMu.Lock()
+	defer h.oidcProvidersMu.Unlock()
+
+	if p, ok := h.oidcProviders[name]; ok {
+		return p, nil
+	}
+
+	settings, ok := h.conf.OIDCProviders[name]
+	if !ok {
+		return nil, constants.NotFoundError(constants.ResourceNotFound("login provider"))
+	}
+
+	issuer := settings.Issuer
+	if issuer == "" {
+		issuer = defaultIssuers[name]
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// native apps sign in with their own client IDs, which end up as the
+	// audience of the ID tokens they send us
+	audiences := append([]string{settings.ClientID}, settings.Audiences...)
+
+	p := &OIDCProvider{
+		Name:     name,
+		provider: provider,
+		// the audience is checked against all our client IDs in VerifyIDToken
+		verifier: provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+		oauth: oauth2.Config{
+			ClientID:     settings.ClientID,
+			ClientSecret: settings.ClientSecret,
+			RedirectURL:  settings.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		audiences: audiences,
+		h:         h,
+	}
+	h.oidcProviders[name] = p
+
+	return p, nil
+}
+
+// AuthCodeURL returns the provider URL to send the user to, along with the
+// state to expect back on the callback.
+func (p *OIDCProvider) AuthCodeURL() (string, error) {
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &oidcStateClaim{
+		Provider: p.Name,
+		Nonce:    nonce,
+		Purpose:  constants.TOKEN_PURPOSE_OIDC_STATE,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(p.h.conf.Tokens.Challenge).Unix(),
+		},
+	}
+
+	state, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(p.h.conf.JWTKey))
+	if err != nil {
+		return "", err
+	}
+
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange swaps the authorization code from the callback for verified ID
+// token claims. The state has to be the one AuthCodeURL created.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, state string) (OIDCClaims, error) {
+	var claims OIDCClaims
+
+	stateClaim := &oidcStateClaim{}
+	tkn, err := jwt.ParseWithClaims(state, stateClaim, func(token *jwt.Token) (interface{}, error) {
+		return []byte(p.h.conf.JWTKey), nil
+	})
+	if err != nil || !tkn.Valid || stateClaim.Purpose != constants.TOKEN_PURPOSE_OIDC_STATE || stateClaim.Provider != p.Name {
+		return claims, constants.UnauthorizedError(constants.InvalidParam("login state"))
+	}
+
+	token, err := p.oauth.Exchange(ctx, code)
+	if err != nil {
+		return claims, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, fmt.Errorf("%s did not return an ID token", p.Name)
+	}
+
+	return p.VerifyIDToken(ctx, rawIDToken, stateClaim.Nonce)
+}
+
+// VerifyIDToken checks an ID token's signature, issuer, expiry and audience,
+// and that it carries nonce. Each token can only be used once: its nonce is
+// recorded until it expires, so a token someone got hold of can't be used to
+// log in again.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (OIDCClaims, error) {
+	var claims OIDCClaims
+	invalid := constants.UnauthorizedError(constants.InvalidParam("ID token"))
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return claims, invalid
+	}
+
+	audienceOK := false
+	for _, aud := range idToken.Audience {
+		if aud != "" && contains(p.audiences, aud) {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return claims, invalid
+	}
+
+	if err := idToken.Claims(&claims); err != nil {
+		return claims, err
+	}
+
+	if nonce == "" || claims.Nonce != nonce {
+		return claims, invalid
+	}
+
+	used := models.UsedNonce{Key: p.Name + ":" + nonce, Expires: idToken.Expiry}
+	if _, err := p.h.stores.UsedNonces.InsertOne(ctx, used); store.IsDuplicateKey(err) {
+		return claims, invalid
+	} else if err != nil {
+		return claims, err
+	}
+
+	return claims, nil
+}
+
+// What LoginWithOIDC had to do to log the user in.
+const (
+	OIDCUserFound   = "found"
+	OIDCUserLinked  = "linked"
+	OIDCUserCreated = "created"
+)
+
+// LoginWithOIDC finds the user for a verified ID token. Users are matched on
+// their linked identity first, then on a verified email, in which case the
+// identity gets linked to the existing account. Identities are never linked to
+// closed, suspended or banned accounts. Otherwise a new user is created.
+// Admins can't log in this way. It also returns which of those happened.
+func (h *Handlers) LoginWithOIDC(ctx context.Context, provider string, claims OIDCClaims) (models.User, string, error) {
+	// Logging in twice at once can try to create the same user twice, or give
+	// two new users the same username. Whichever is saved second is looked up
+	// again, so it finds the user or picks another username.
+	for attempt := 1; ; attempt++ {
+		user, how, err := h.loginWithOIDC(ctx, provider, claims)
+		if !store.IsDuplicateKey(err) || attempt == oidcLoginAttempts {
+			return user, how, err
+		}
+	}
+}
+
+// oidcLoginAttempts is how many times LoginWithOIDC looks the user up
+const oidcLoginAttempts = 3
+
+func (h *Handlers) loginWithOIDC(ctx context.Context, provider string, claims OIDCClaims) (models.User, string, error) {
+	q := linkedTo(provider, claims.Subject)
+	q["isAdmin"] = false
+	user, err := h.GetUser(ctx, q)
+	if err != mongo.ErrNoDocuments {
+		return user, OIDCUserFound, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return user, "", constants.UnauthorizedError(constants.VerifiedEmailRequired)
+	}
+
+	identity := models.Identity{Provider: provider, Subject: claims.Subject, Linked: time.Now()}
+
+	user, err = h.GetUserByEmail(ctx, claims.Email, false)
+	if err == nil {
+		if user.Status != constants.Enabled {
+			return user, "", constants.ForbiddenError(constants.AccountClosed)
+		}
+		if err := CheckRestriction(user); err != nil {
+			return user, "", err
+		}
+
+		// unless a login made at the same time has linked it already
+		unlinked := bson.M{"_id": user.ID, "$nor": []bson.M{linkedTo(provider, claims.Subject)}}
+		update := bson.M{"$push": bson.M{"identities": identity}, "$set": bson.M{"updated": time.Now()}}
+		if _, err := h.stores.Users.UpdateOne(ctx, unlinked, update); err != nil {
+			return user, "", err
+		}
+		user.Identities = append(user.Identities, identity)
+		return user, OIDCUserLinked, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return user, "", err
+	}
+
+	username, err := h.generateUsername(ctx, claims)
+	if err != nil {
+		return user, "", err
+	}
+
+	// no password, so the account can only be used through the provider
+	user = *models.GetDefaultUser()
+	user.Email = claims.Email
+	user.Username = username
+	user.Identities = []models.Identity{identity}
+
+	_, err = h.stores.Users.InsertOne(ctx, user)
+	return user, OIDCUserCreated, err
+}
+
+// linkedTo matches the user an identity is linked to.
+func linkedTo(provider, subject string) bson.M {
+	return bson.M{
+		"identities": bson.M{
+			"$elemMatch": bson.M{"provider": provider, "subject": subject},
+		},
+	}
+}
+
+// generateUsername makes an unused username out of the name or email the
+// provider gave us. It can be taken by the time the user is saved, in which
+// case saving fails with a duplicate key error.
+func (h *Handlers) generateUsername(ctx context.Context, claims OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	base = strings.Trim(usernameChars.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if base == "" {
+		base = "meerkat"
+	}
+
+	username := base
+	for i := 0; i < 5; i++ {
+		if _, err := h.FindUser(ctx, bson.M{"username": username}); err == mongo.ErrNoDocuments {
+			return username, nil
+		} else if err != nil {
+			return "", err
+		}
+
+		suffix, err := randomToken(2)
+		if err != nil {
+			return "", err
+		}
+		username = base + "_" + suffix
+	}
+
+	return "", constants.ConflictError(constants.ResourceExists("username"))
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func contains(arr []string, str string) bool {
+	for _, a := range arr {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
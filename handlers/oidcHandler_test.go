@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const mockClientID = "mrkt-web"
+
+// mockIssuer is an OpenID Connect provider with discovery, JWKS and token
+// endpoints. Codes are swapped for the ID tokens they were given with.
+type mockIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	codes map[string]string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   encode(key.N.Bytes()),
+				"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idToken, ok := m.codes[r.FormValue("code")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(m.codes, r.FormValue("code"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// idToken signs an ID token for mockClientID with claims on top of the usual
+// ones.
+func (m *mockIssuer) idToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	all := jwt.MapClaims{
+		"iss": m.URL,
+		"aud": mockClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// setupOIDC makes handlers with in-memory stores and the mock issuer as the
+// "mock" provider. The handlers are the provider's.
+func setupOIDC(t *testing.T) (*mockIssuer, *OIDCProvider) {
+	t.Helper()
+
+	issuer := newMockIssuer(t)
+
+	cfg := config.Default()
+	cfg.JWTKey = "test"
+	cfg.OIDCProviders["mock"] = config.OIDCProviderConfig{
+		Issuer:       issuer.URL,
+		ClientID:     mockClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/users/oidc/mock/callback",
+	}
+	h := New(cfg, store.NewMemory())
+
+	provider, err := h.GetOIDCProvider(context.Background(), "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer, provider
+}
+
+func addUser(t *testing.T, h *Handlers, user models.User) models.User {
+	t.Helper()
+	if _, err := h.stores.Users.InsertOne(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func errorCode(err error) string {
+	var custom *constants.CustomError
+	if errors.As(err, &custom) {
+		return custom.ErrorCode()
+	}
+	return ""
+}
+
+func TestOIDCCodeFlowCreatesThenFindsUser(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := mustParseQuery(t, authURL)
+	issuer.codes["code"] = issuer.idToken(t, jwt.MapClaims{
+		"sub":                "subject-1",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "Jane Doe",
+		"nonce":              query.Get("nonce"),
+	})
+
+	claims, err := provider.Exchange(ctx, "code", query.Get("state"))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	user, result, err := provider.h.LoginWithOIDC(ctx, provider.Name, claims)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: %v", err)
+	}
+	if result != OIDCUserCreated {
+		t.Errorf("result = %q, want %q", result, OIDCUserCreated)
+	}
+	if user.Email != "jane@example.com" || user.Username != "jane_doe" || user.Password != "" {
+		t.Errorf("created user = %+v", user)
+	}
+
+	// logging in again with the same identity finds the same user
+	rawIDToken := issuer.idToken(t, jwt.MapClaims{"sub": "subject-1", "nonce": "second"})
+	claims, err = provider.VerifyIDToken(ctx, rawIDToken, "second")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	found, result, err := provider.h.LoginWithOIDC(ctx, provider.Name, claims)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: %v", err)
+	}
+	if result != OIDCUserFound || found.ID != user.ID {
+		t.Errorf("got %q for user %s, want %q for user %s", result, found.ID.Hex(), OIDCUserFound, user.ID.Hex())
+	}
+}
+
+// savedFirst saves rival just before the first user the handler inserts, as
+// if another login had got there at the same time.
+type savedFirst struct {
+	store.Collection[models.User]
+	rival *models.User
+}
+
+func (c *savedFirst) InsertOne(ctx context.Context, user models.User) (*mongo.InsertOneResult, error) {
+	if c.rival != nil {
+		if _, err := c.Collection.InsertOne(ctx, *c.rival); err != nil {
+			return nil, err
+		}
+		c.rival = nil
+	}
+	return c.Collection.InsertOne(ctx, user)
+}
+
+func TestOIDCLoginClashesWithOneSavedAtOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	claims := OIDCClaims{Subject: "subject-1", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "Jane"}
+	identity := models.Identity{Provider: "example", Subject: "subject-1"}
+
+	// the same identity logged in from another tab
+	stores := store.NewMemory()
+	rival := models.User{ID: primitive.NewObjectID(), Email: "jane@example.com", Username: "jane", Status: "enabled", Identities: []models.Identity{identity}}
+	stores.Users = &savedFirst{stores.Users, &rival}
+	user, result, err := New(config.Default(), stores).LoginWithOIDC(ctx, "example", claims)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: %v", err)
+	}
+	if result != OIDCUserFound || user.ID != rival.ID {
+		t.Errorf("got %q for user %s, want %q for user %s", result, user.ID.Hex(), OIDCUserFound, rival.ID.Hex())
+	}
+
+	// someone else took the username
+	stores = store.NewMemory()
+	rival = models.User{ID: primitive.NewObjectID(), Email: "other.jane@example.com", Username: "jane", Status: "enabled"}
+	stores.Users = &savedFirst{stores.Users, &rival}
+	user, result, err = New(config.Default(), stores).LoginWithOIDC(ctx, "example", claims)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: %v", err)
+	}
+	if result != OIDCUserCreated || user.Username == "jane" {
+		t.Errorf("got %q for %q, want a new user with another username", result, user.Username)
+	}
+	if count, err := stores.Users.Count(ctx, bson.M{}); err != nil || count != 2 {
+		t.Errorf("count = %d, err = %v, want 2 users", count, err)
+	}
+}
+
+func TestOIDCExchangeRejectsForgedState(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+
+	issuer.codes["code"] = issuer.idToken(t, jwt.MapClaims{"sub": "subject-1", "nonce": "nonce"})
+	if _, err := provider.Exchange(context.Background(), "code", "not-a-state"); errorCode(err) != constants.CodeUnauthorized {
+		t.Errorf("err = %v, want unauthorized", err)
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+	ctx := context.Background()
+
+	existing := *models.GetDefaultUser()
+	existing.Email = "jane@example.com"
+	existing.Username = "jane"
+	addUser(t, provider.h, existing)
+
+	rawIDToken := issuer.idToken(t, jwt.MapClaims{
+		"sub":            "subject-1",
+		"email":          "jane@example.com",
+		"email_verified": "true", // as Apple sends it
+		"nonce":          "nonce",
+	})
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, "nonce")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+
+	user, result, err := provider.h.LoginWithOIDC(ctx, provider.Name, claims)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: %v", err)
+	}
+	if result != OIDCUserLinked || user.ID != existing.ID {
+		t.Errorf("got %q for user %s, want %q for user %s", result, user.ID.Hex(), OIDCUserLinked, existing.ID.Hex())
+	}
+
+	stored, err := provider.h.FindUser(ctx, bson.M{"_id": existing.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Identities) != 1 || stored.Identities[0].Provider != "mock" || stored.Identities[0].Subject != "subject-1" {
+		t.Errorf("identities = %+v", stored.Identities)
+	}
+}
+
+func TestOIDCRequiresVerifiedEmail(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+	ctx := context.Background()
+
+	existing := *models.GetDefaultUser()
+	existing.Email = "jane@example.com"
+	addUser(t, provider.h, existing)
+
+	for _, verified := range []interface{}{false, "false", nil} {
+		nonce := "nonce-" + time.Now().Format(time.RFC3339Nano)
+		token := jwt.MapClaims{"sub": "subject-1", "email": "jane@example.com", "nonce": nonce}
+		if verified != nil {
+			token["email_verified"] = verified
+		}
+
+		claims, err := provider.VerifyIDToken(ctx, issuer.idToken(t, token), nonce)
+		if err != nil {
+			t.Fatalf("VerifyIDToken: %v", err)
+		}
+		if _, _, err := provider.h.LoginWithOIDC(ctx, provider.Name, claims); errorCode(err) != constants.CodeUnauthorized {
+			t.Errorf("email_verified %v: err = %v, want unauthorized", verified, err)
+		}
+	}
+
+	stored, _ := provider.h.FindUser(ctx, bson.M{"_id": existing.ID})
+	if len(stored.Identities) != 0 {
+		t.Errorf("an unverified email was linked: %+v", stored.Identities)
+	}
+	if n, _ := provider.h.stores.Users.Count(ctx, bson.M{}); n != 1 {
+		t.Errorf("%d users, want no new ones", n)
+	}
+}
+
+func TestOIDCWontLinkClosedOrBannedAccounts(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+	ctx := context.Background()
+
+	deleted := *models.GetDefaultUser()
+	deleted.Email = "deleted@example.com"
+	deleted.Username = "deleted"
+	deleted.Status = "deleted"
+	addUser(t, provider.h, deleted)
+
+	banned := *models.GetDefaultUser()
+	banned.Email = "banned@example.com"
+	banned.Username = "banned"
+	banned.Restriction = &models.Restriction{State: constants.RESTRICTION_BANNED}
+	addUser(t, provider.h, banned)
+
+	for _, user := range []models.User{deleted, banned} {
+		nonce := "nonce-" + user.Email
+		rawIDToken := issuer.idToken(t, jwt.MapClaims{"sub": user.Email, "email": user.Email, "email_verified": true, "nonce": nonce})
+		claims, err := provider.VerifyIDToken(ctx, rawIDToken, nonce)
+		if err != nil {
+			t.Fatalf("VerifyIDToken: %v", err)
+		}
+
+		if _, _, err := provider.h.LoginWithOIDC(ctx, provider.Name, claims); errorCode(err) != constants.CodeForbidden {
+			t.Errorf("%s: err = %v, want forbidden", user.Email, err)
+		}
+		stored, _ := provider.h.FindUser(ctx, bson.M{"_id": user.ID})
+		if len(stored.Identities) != 0 {
+			t.Errorf("%s: identity was linked", user.Email)
+		}
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	t.Parallel()
+	issuer, provider := setupOIDC(t)
+	ctx := context.Background()
+
+	valid := issuer.idToken(t, jwt.MapClaims{"sub": "subject-1", "nonce": "nonce"})
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"no nonce", valid, ""},
+		{"wrong nonce", valid, "other"},
+		{"wrong audience", issuer.idToken(t, jwt.MapClaims{"sub": "s", "nonce": "nonce", "aud": "someone-else"}), "nonce"},
+		{"expired", issuer.idToken(t, jwt.MapClaims{"sub": "s", "nonce": "nonce", "exp": time.Now().Add(-time.Minute).Unix()}), "nonce"},
+		{"wrong issuer", issuer.idToken(t, jwt.MapClaims{"sub": "s", "nonce": "nonce", "iss": "https://evil.example.com"}), "nonce"},
+		{"not a token", "garbage", "nonce"},
+	}
+	for _, test := range tests {
+		if _, err := provider.VerifyIDToken(ctx, test.token, test.nonce); errorCode(err) != constants.CodeUnauthorized {
+			t.Errorf("%s: err = %v, want unauthorized", test.name, err)
+		}
+	}
+
+	if _, err := provider.VerifyIDToken(ctx, valid, "nonce"); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, valid, "nonce"); errorCode(err) != constants.CodeUnauthorized {
+		t.Errorf("reused token: err = %v, want unauthorized", err)
+	}
+}
+
+func mustParseQuery(t *testing.T, rawURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
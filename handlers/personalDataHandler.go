@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// personalDataSection is one file in a user's data export.
+type personalDataSection struct {
+	Name  string
+	Fetch func(h *Handlers, ctx context.Context, user models.User) (interface{}, error)
+}
+
+// personalDataSections lists everything we hold about a user. Anything new
+// that stores data tied to a user should be added here so it is exported.
+var personalDataSections = []personalDataSection{
+	{"profile.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		user.Password = ""
+		return user, nil
+	}},
+	{"ranking.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		return map[string]interface{}{
+			"rank":     models.GetRankName(user.Ranking.Rank),
+			"ranking":  user.Ranking,
+			"computed": user.Ranking.LastUpdated,
+		}, nil
+	}},
+	{"entries.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		return h.GetAllEntries(ctx, bson.M{"uploadedBy": user.ID})
+	}},
+	{"notifications.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		return h.GetUserNotifications(ctx, user.ID)
+	}},
+	{"flags.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		return h.GetFlags(ctx, bson.M{"reportedBy": user.ID})
+	}},
+	{"auditLog.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		logs, err := h.stores.AuditLogs.Find(ctx, personalAuditLogs(user), store.FindOptions{Sort: "-created"})
+		if err != nil {
+			return nil, err
+		}
+		// the admins who made changes to the user aren't theirs to see
+		for i, log := range logs {
+			if !log.Actor.Is(user.ID) {
+				logs[i].Actor.ID = nil
+				logs[i].IP = ""
+			}
+		}
+		return logs, nil
+	}},
+	{"revisions.json", func(h *Handlers, ctx context.Context, user models.User) (interface{}, error) {
+		return h.stores.Revisions.Find(ctx, bson.M{"changedBy.id": user.ID}, store.FindOptions{Sort: "created"})
+	}},
+}
+
+// personalAuditLogs matches the audit logs of changes the user made, and of
+// changes made to them.
+func personalAuditLogs(user models.User) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"actor.id": user.ID},
+		{"collection": "users", "targetID": user.ID.Hex()},
+	}}
+}
+
+// ExportUserData writes a zip archive of everything tied to the user, with
+// one JSON file per kind of data.
+func (h *Handlers) ExportUserData(ctx context.Context, user models.User, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	for _, section := range personalDataSections {
+		data, err := section.Fetch(h, ctx, user)
+		if err != nil {
+			return err
+		}
+
+		f, err := archive.Create(section.Name)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(data); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// EraseUserData removes a user's personal data for good. Their entries stay
+// so they still count towards location rankings, but are detached from them
+// and made anonymous, and so are the revisions of entries they edited. The
+// audit log keeps what was done, but not by them, from where, or the values
+// that changed. The user document is replaced by a tombstone so references
+// to the ID don't dangle.
+func (h *Handlers) EraseUserData(ctx context.Context, user models.User) error {
+	_, err := h.stores.Entries.UpdateMany(ctx,
+		bson.M{"uploadedBy": user.ID},
+		bson.M{
+			"$unset": bson.M{"uploadedBy": "", "editToken": ""},
+			"$set":   bson.M{"anonymous": true, "updated": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.stores.Notifications.DeleteMany(ctx, bson.M{"user": user.ID}); err != nil {
+		return err
+	}
+
+	// the scores their flags added to entries are kept
+	if _, err := h.stores.Flags.DeleteMany(ctx, bson.M{"reportedBy": user.ID}); err != nil {
+		return err
+	}
+
+	if err := h.ResetLoginAttempts(ctx, user.Email, user.IsAdmin); err != nil {
+		return err
+	}
+
+	_, err = h.stores.Revisions.UpdateMany(ctx, bson.M{"changedBy.id": user.ID}, bson.M{"$unset": bson.M{"changedBy.id": ""}})
+	if err != nil {
+		return err
+	}
+
+	if err := h.pseudonymiseAuditLogs(ctx, user); err != nil {
+		return err
+	}
+
+	tombstone := bson.M{
+		"_id":     user.ID,
+		"isAdmin": user.IsAdmin,
+		"status":  constants.Erased,
+		"created": user.Created,
+		"updated": time.Now(),
+	}
+	_, err = h.stores.Users.ReplaceOne(ctx, bson.M{"_id": user.ID}, tombstone, false)
+	return err
+}
+
+// pseudonymiseAuditLogs removes the user from the audit log. Changes they made
+// lose who made them and the IP they were made from, and the values of the
+// fields changed by or for them are redacted. Which fields changed is kept.
+func (h *Handlers) pseudonymiseAuditLogs(ctx context.Context, user models.User) error {
+	logs, err := h.stores.AuditLogs.Find(ctx, personalAuditLogs(user))
+	if err != nil {
+		return err
+	}
+
+	for _, log := range logs {
+		update := bson.M{"$set": bson.M{"changes": redactChanges(log.Changes)}}
+		if log.Actor.Is(user.ID) {
+			update["$unset"] = bson.M{"actor.id": "", "ip": ""}
+		}
+		if _, err := h.stores.AuditLogs.UpdateOne(ctx, bson.M{"_id": log.ID}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UpdateUserFields sets only the given fields on a user, unlike
+// UpdateUserByID which overwrites the whole document.
+func (h *Handlers) UpdateUserFields(ctx context.Context, id primitive.ObjectID, fields bson.M) (*mongo.UpdateResult, error) {
+	fields["updated"] = time.Now()
+	return h.stores.Users.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+}
+
+// ChangeUsername ...
+func (h *Handlers) ChangeUsername(ctx context.Context, user models.User, username string) error {
+	if existing, err := h.FindUser(ctx, bson.M{"username": username}); err == nil && existing.ID != user.ID {
+		return constants.ConflictError(constants.ResourceExists("username"))
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	_, err := h.UpdateUserFields(ctx, user.ID, bson.M{"username": username})
+	if store.IsDuplicateKey(err) {
+		return constants.ConflictError(constants.ResourceExists("username"))
+	}
+	return err
+}
+
+// ChangePassword hashes and stores a new password for the user and ends
+// their sessions, like ForceLogout. It returns a token for a new session.
+func (h *Handlers) ChangePassword(ctx context.Context, user models.User, password string) (string, error) {
+	hash, err := generatePasswordHash(password)
+	if err != nil {
+		return "", err
+	}
+
+	// Tokens only say which second they were issued in, so sessions started
+	// in this one are left alone. Otherwise the new token wouldn't work.
+	fields := bson.M{"password": hash, "tokensValidAfter": time.Now().Add(-time.Second)}
+	if _, err := h.UpdateUserFields(ctx, user.ID, fields); err != nil {
+		return "", err
+	}
+
+	return h.GenerateJWTToken(&user)
+}
+
+// StartEmailChange emails a verification token to the new address. The
+// email on the account only changes once the token is confirmed.
+func (h *Handlers) StartEmailChange(ctx context.Context, user models.User, email string) error {
+	email = strings.TrimSpace(email)
+
+	if existing, err := h.GetUserByEmail(ctx, email, user.IsAdmin); err == nil && existing.ID != user.ID {
+		return constants.ConflictError(constants.UserExists)
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	token, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+
+	change := models.EmailChange{
+		Email:     email,
+		TokenHash: hashToken(token),
+		Expires:   time.Now().Add(h.conf.Tokens.EmailVerification),
+	}
+
+	if _, err := h.UpdateUserFields(ctx, user.ID, bson.M{"emailChange": change}); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nUse this code to confirm your new email address: %s\n\n"+
+		"If you didn't ask to change your email, you can ignore this email.", user.Username, token)
+	return h.SendMail(email, "Confirm your new email address", body)
+}
+
+// ConfirmEmailChange switches the user to their new email if the token
+// matches the one sent to it.
+func (h *Handlers) ConfirmEmailChange(ctx context.Context, user models.User, token string) error {
+	change := user.EmailChange
+	if change == nil || change.Expires.Before(time.Now()) || change.TokenHash != hashToken(token) {
+		return constants.ValidationError(constants.InvalidVerificationToken)
+	}
+
+	// someone else could have taken the address in the meantime
+	return h.ChangeEmail(ctx, user, change.Email)
+}
+
+// ChangeEmail sets the user's email without verifying it, and drops any
+// change they had pending. The old address is told about the change.
+func (h *Handlers) ChangeEmail(ctx context.Context, user models.User, email string) error {
+	if existing, err := h.GetUserByEmail(ctx, email, user.IsAdmin); err == nil && existing.ID != user.ID {
+		return constants.ConflictError(constants.UserExists)
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"email": email, "updated": time.Now()},
+		"$unset": bson.M{"emailChange": ""},
+	}
+	if _, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		return err
+	}
+
+	// user still has the old address, which is told in case someone else
+	// made the change
+	if user.Email == "" || strings.EqualFold(user.Email, email) {
+		return nil
+	}
+	msg := fmt.Sprintf("The email address on your account was changed to %s. "+
+		"If you didn't make this change, contact us straight away.", email)
+	return h.NotifyUser(ctx, user, constants.NOTIFICATION_EMAIL_CHANGED, "Your email address was changed", msg)
+}
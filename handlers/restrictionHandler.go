@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RestrictUser suspends, bans or shadow-bans a user, replacing any restriction
+// they already had. Suspended and banned users are logged out straight away.
+// A shadow-banned user's entries are hidden from everyone else.
+func (h *Handlers) RestrictUser(ctx context.Context, user models.User, restriction models.Restriction) error {
+	restriction.Created = time.Now()
+
+	fields := bson.M{"restriction": restriction, "updated": time.Now()}
+	if restriction.State != constants.RESTRICTION_SHADOW_BANNED {
+		fields["tokensValidAfter"] = time.Now()
+	}
+
+	if _, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": fields}); err != nil {
+		return err
+	}
+
+	return h.setEntriesHidden(ctx, user.ID, restriction.State == constants.RESTRICTION_SHADOW_BANNED)
+}
+
+// LiftRestriction lets a user use their account as normal again.
+func (h *Handlers) LiftRestriction(ctx context.Context, user models.User) error {
+	update := bson.M{
+		"$unset": bson.M{"restriction": ""},
+		"$set":   bson.M{"updated": time.Now()},
+	}
+	if _, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		return err
+	}
+
+	return h.setEntriesHidden(ctx, user.ID, false)
+}
+
+// ForceLogout ends all of a user's sessions. They have to log in again.
+func (h *Handlers) ForceLogout(ctx context.Context, user models.User) error {
+	_, err := h.UpdateUserFields(ctx, user.ID, bson.M{"tokensValidAfter": time.Now()})
+	return err
+}
+
+// IsShadowBanned reports whether the user's entries should be hidden from
+// everyone else.
+func (h *Handlers) IsShadowBanned(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	user, err := h.FindUser(ctx, bson.M{"_id": userID})
+	if err != nil {
+		return false, err
+	}
+	r := user.ActiveRestriction()
+	return r != nil && r.State == constants.RESTRICTION_SHADOW_BANNED, nil
+}
+
+// CheckRestriction returns an error if the user is suspended or banned.
+func CheckRestriction(user models.User) error {
+	r := user.ActiveRestriction()
+	if r == nil {
+		return nil
+	}
+
+	switch {
+	case r.State == constants.RESTRICTION_SUSPENDED && r.Until != nil:
+		return constants.ForbiddenError(constants.AccountSuspended(*r.Until))
+	case r.State != constants.RESTRICTION_SHADOW_BANNED:
+		return constants.ForbiddenError(constants.AccountBanned)
+	}
+	return nil
+}
+
+// CheckSession makes sure the user a session token was issued to can still
+// use it. Tokens stop working when the user is deleted, suspended, banned or
+// logged out by an admin.
+func (h *Handlers) CheckSession(ctx context.Context, claim *JwtClaim) error {
+	user, err := h.FindUser(ctx, bson.M{"_id": claim.UserID})
+	if err != nil {
+		return err
+	}
+
+	if user.Status != constants.Enabled || issuedBefore(claim, user.TokensValidAfter) {
+		return constants.UnauthorizedError(constants.SessionEnded)
+	}
+
+	return CheckRestriction(user)
+}
+
+// CheckImpersonation makes sure an impersonation token can still be used. The
+// user's session has to be, and the admin it was issued to has to still be an
+// enabled admin who hasn't been logged out since.
+func (h *Handlers) CheckImpersonation(ctx context.Context, claim *JwtClaim) error {
+	if err := h.CheckSession(ctx, claim); err != nil {
+		return err
+	}
+
+	admin, err := h.FindUser(ctx, bson.M{"_id": *claim.Impersonator, "isAdmin": true})
+	if err != nil {
+		return err
+	}
+
+	if admin.Status != constants.Enabled || issuedBefore(claim, admin.TokensValidAfter) {
+		return constants.UnauthorizedError(constants.SessionEnded)
+	}
+	return nil
+}
+
+// issuedBefore reports whether the token was issued before t. Tokens only
+// record the second they were issued in, so one from the same second as t
+// counts as before it: it could have been.
+func issuedBefore(claim *JwtClaim, t time.Time) bool {
+	return claim.IssuedAt <= t.Unix()
+}
+
+// GenerateImpersonationToken lets an admin see the API as the user does. The
+// token can only be used to read, and names the admin it was issued to.
+func (h *Handlers) GenerateImpersonationToken(user models.User, adminID primitive.ObjectID) (string, error) {
+	return h.signToken(&user, constants.TOKEN_PURPOSE_IMPERSONATION, h.conf.Tokens.Impersonation, &adminID)
+}
+
+func (h *Handlers) setEntriesHidden(ctx context.Context, userID primitive.ObjectID, hidden bool) error {
+	update := bson.M{"$unset": bson.M{"hidden": ""}}
+	if hidden {
+		update = bson.M{"$set": bson.M{"hidden": true}}
+	}
+
+	_, err := h.stores.Entries.UpdateMany(ctx, bson.M{"uploadedBy": userID}, update)
+	return err
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SaveEntryRevision stores the entry's current content as its current
+// version, dated when the entry was last saved. restoredFrom is the version a
+// rollback went back to, or 0.
+func (h *Handlers) SaveEntryRevision(ctx context.Context, entry models.Entry, changedBy models.AuditActor, restoredFrom int) (models.EntryRevision, error) {
+	revision := models.EntryRevision{
+		ID:           primitive.NewObjectID(),
+		Entry:        entry.ID,
+		Version:      entry.Version,
+		Content:      entry.Content(),
+		ChangedBy:    changedBy,
+		RestoredFrom: restoredFrom,
+		Created:      entry.Updated,
+	}
+
+	_, err := h.stores.Revisions.InsertOne(ctx, revision)
+	return revision, err
+}
+
+// ReviseEntry saves the changes made to an entry. If its content changed, it
+// gets a new version and is marked as edited. The save fails with
+// constants.EntryChanged if the entry has been changed since before was read,
+// rather than overwriting that change.
+func (h *Handlers) ReviseEntry(ctx context.Context, before, after models.Entry, changedBy models.AuditActor) (models.Entry, error) {
+	return h.reviseEntry(ctx, before, after, changedBy, 0)
+}
+
+// RollbackEntry restores the content of one of the entry's revisions. The
+// rollback is saved as a new revision, so it can be undone too.
+func (h *Handlers) RollbackEntry(ctx context.Context, entry models.Entry, version int, changedBy models.AuditActor) (models.Entry, error) {
+	revision, err := h.GetEntryRevision(ctx, entry.ID, version)
+	if err != nil {
+		return entry, err
+	}
+
+	after := entry
+	after.SetContent(revision.Content)
+	return h.reviseEntry(ctx, entry, after, changedBy, version)
+}
+
+func (h *Handlers) reviseEntry(ctx context.Context, before, after models.Entry, changedBy models.AuditActor, restoredFrom int) (models.Entry, error) {
+	// entries from before revisions were kept have no version
+	filter := bson.M{"_id": before.ID, "version": before.Version}
+	if before.Version == 0 {
+		filter["version"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	// Only what the reporter can change is set, so moderation decisions and
+	// flags made since before was read are kept.
+	content := after.Content()
+	fields := bson.M{
+		"title":       content.Title,
+		"description": content.Description,
+		"contentURL":  content.ContentURL,
+		"contentType": content.ContentType,
+		"location":    content.Location,
+		"address":     content.Address,
+		"alertType":   content.AlertType,
+		"anonymous":   after.Anonymous,
+		"version":     before.Version,
+		"updated":     time.Now(),
+	}
+
+	changed := !reflect.DeepEqual(before.Content(), content)
+	if changed {
+		fields["version"] = max(before.Version, 1) + 1
+		fields["edited"] = true
+		fields["editedAt"] = fields["updated"]
+	}
+
+	after, err := h.stores.Entries.FindOneAndUpdate(ctx, filter, bson.M{"$set": fields}, false)
+	if err == mongo.ErrNoDocuments {
+		return after, constants.ConflictError(constants.EntryChanged)
+	}
+	if err != nil {
+		return after, err
+	}
+
+	if !changed {
+		return after, nil
+	}
+
+	if before.Version == 0 {
+		// keep what the reporter first wrote as the first version
+		before.Version = 1
+		if _, err := h.SaveEntryRevision(ctx, before, reporterOf(before), 0); err != nil {
+			return after, err
+		}
+	}
+
+	_, err = h.SaveEntryRevision(ctx, after, changedBy, restoredFrom)
+	return after, err
+}
+
+// GetEntryRevisions returns an entry's revisions, oldest first.
+func (h *Handlers) GetEntryRevisions(ctx context.Context, entryID primitive.ObjectID) ([]models.EntryRevision, error) {
+	return h.stores.Revisions.Find(ctx, bson.M{"entry": entryID}, store.FindOptions{Sort: "version"})
+}
+
+// GetEntryRevision returns one version of an entry.
+func (h *Handlers) GetEntryRevision(ctx context.Context, entryID primitive.ObjectID, version int) (models.EntryRevision, error) {
+	return h.stores.Revisions.FindOne(ctx, bson.M{"entry": entryID, "version": version})
+}
+
+// DiffEntryRevisions compares the content of two versions of an entry. Version
+// 0 is the empty entry, so comparing with it shows the whole first version.
+func (h *Handlers) DiffEntryRevisions(ctx context.Context, entryID primitive.ObjectID, from, to int) (map[string]models.FieldChange, error) {
+	var before interface{}
+	if from > 0 {
+		revision, err := h.GetEntryRevision(ctx, entryID, from)
+		if err != nil {
+			return nil, err
+		}
+		before = revision.Content
+	}
+
+	after, err := h.GetEntryRevision(ctx, entryID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffDocuments(before, after.Content)
+}
+
+// reporterOf is who made the first version of an entry.
+func reporterOf(entry models.Entry) models.AuditActor {
+	if entry.UploadedBy != nil {
+		return models.AuditActor{Type: "user", ID: entry.UploadedBy}
+	}
+	return models.AuditActor{Type: "anonymous"}
+}
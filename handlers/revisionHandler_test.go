@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReviseEntryKeepsModeration(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	h := New(config.Default(), store.NewMemory())
+
+	before := *models.GetDefaultEntry()
+	before.Title = "Flooded road"
+	if _, err := h.stores.Entries.InsertOne(ctx, before); err != nil {
+		t.Fatal(err)
+	}
+
+	// a moderator hides the entry and it is flagged while the reporter edits
+	update := bson.M{"$set": bson.M{"moderation.state": constants.MODERATION_HIDDEN, "flagScore": 3}}
+	if _, err := h.stores.Entries.UpdateOne(ctx, bson.M{"_id": before.ID}, update); err != nil {
+		t.Fatal(err)
+	}
+
+	after := before
+	after.Title = "Flooded bridge"
+	revised, err := h.ReviseEntry(ctx, before, after, models.AuditActor{Type: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revised.Title != "Flooded bridge" || revised.Version != 2 || !revised.Edited || revised.EditedAt == nil {
+		t.Errorf("revised = %+v, want the new title as version 2", revised)
+	}
+
+	saved, err := h.stores.Entries.FindOne(ctx, bson.M{"_id": before.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Moderation.State != constants.MODERATION_HIDDEN || saved.FlagScore != 3 {
+		t.Errorf("saved moderation = %+v and flag score = %d, want the moderator's decision kept", saved.Moderation, saved.FlagScore)
+	}
+
+	// before is now out of date, so saving over it again is a conflict
+	if _, err := h.ReviseEntry(ctx, before, after, models.AuditActor{Type: "user"}); errorCode(err) != constants.CodeConflict {
+		t.Errorf("err = %v, want a conflict", err)
+	}
+}
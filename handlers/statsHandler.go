@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// earthRadius in metres, to turn distances into the radians $centerSphere
+// expects
+const earthRadius = 6378100
+
+// Formats of the periods stats are grouped by, for $dateToString
+var statsIntervals = map[string]string{
+	"day":  "%Y-%m-%d",
+	"week": "%G-W%V",
+}
+
+// Address fields top locations can be grouped by
+var statsLocationFields = []string{"suburb", "city", "state", "country"}
+
+// StatsFilter narrows down the entries and users stats are computed from.
+type StatsFilter struct {
+	From     time.Time
+	To       time.Time
+	Interval string
+	// area around Near, in the same [lat, long] order as entry locations
+	Near   *[2]float64
+	Radius float64
+}
+
+func (f StatsFilter) cacheKey(name string) string {
+	key := fmt.Sprintf("%s:%d:%d:%s", name, f.From.Unix(), f.To.Unix(), f.Interval)
+	if f.Near != nil {
+		key += fmt.Sprintf(":%v:%v", *f.Near, f.Radius)
+	}
+	return key
+}
+
+// entryQuery matches the entries the filter covers. Deleted entries are
+// left out.
+func (f StatsFilter) entryQuery() bson.M {
+	q := bson.M{
+		"status":  bson.M{"$ne": "deleted"},
+		"created": bson.M{"$gte": f.From, "$lte": f.To},
+	}
+
+	if f.Near != nil {
+		q["location"] = bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{f.Near[:], f.Radius / earthRadius},
+			},
+		}
+	}
+
+	return q
+}
+
+// period groups documents by the day or week of their created date.
+func (f StatsFilter) period() bson.M {
+	return bson.M{"$dateToString": bson.M{"format": statsIntervals[f.Interval], "date": "$created"}}
+}
+
+// IsStatsInterval reports whether stats can be grouped by the interval.
+func IsStatsInterval(interval string) bool {
+	_, ok := statsIntervals[interval]
+	return ok
+}
+
+// IsStatsLocationField reports whether top locations can be grouped by the
+// address field.
+func IsStatsLocationField(field string) bool {
+	return contains(statsLocationFields, field)
+}
+
+type cachedStat struct {
+	value   interface{}
+	expires time.Time
+}
+
+// statsCache keeps computed stats for the configured StatsCacheTTL, since the
+// aggregations scan whole collections.
+type statsCache struct {
+	sync.Mutex
+	stats map[string]cachedStat
+}
+
+// cachedStats returns the stats stored under key, computing them if they
+// aren't cached or have expired.
+func (h *Handlers) cachedStats(key string, compute func() (interface{}, error)) (interface{}, error) {
+	h.statsCache.Lock()
+	cached, ok := h.statsCache.stats[key]
+	h.statsCache.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	h.statsCache.Lock()
+	defer h.statsCache.Unlock()
+	for k, stat := range h.statsCache.stats {
+		if now.After(stat.expires) {
+			delete(h.statsCache.stats, k)
+		}
+	}
+	h.statsCache.stats[key] = cachedStat{value: value, expires: now.Add(h.conf.StatsCacheTTL)}
+
+	return value, nil
+}
+
+// GetEntryStats counts entries per day or week, by alert type and level.
+func (h *Handlers) GetEntryStats(ctx context.Context, filter StatsFilter) (interface{}, error) {
+	return h.cachedStats(filter.cacheKey("entries"), func() (interface{}, error) {
+		results := []models.EntryStat{}
+
+		pipeline := []bson.M{
+			{"$match": filter.entryQuery()},
+			{"$lookup": bson.M{
+				"from":         "alertTypes",
+				"localField":   "alertType",
+				"foreignField": "_id",
+				"as":           "alertType",
+			}},
+			{"$unwind": "$alertType"},
+			{"$group": bson.M{
+				"_id": bson.M{
+					"period":    filter.period(),
+					"alertType": "$alertType.name",
+					"level":     "$alertType.level",
+				},
+				"count": bson.M{"$sum": 1},
+			}},
+			{"$project": bson.M{
+				"_id":       0,
+				"period":    "$_id.period",
+				"alertType": "$_id.alertType",
+				"level":     "$_id.level",
+				"count":     1,
+			}},
+			{"$sort": primitive.D{{Key: "period", Value: 1}, {Key: "level", Value: -1}}},
+		}
+
+		err := h.stores.Entries.Aggregate(ctx, pipeline, &results)
+		return results, err
+	})
+}
+
+// GetTopLocations returns the areas with the most entries. Areas are the
+// value of an address field, like the suburb or city.
+func (h *Handlers) GetTopLocations(ctx context.Context, filter StatsFilter, field string, limit int) (interface{}, error) {
+	key := filter.cacheKey(fmt.Sprintf("locations:%s:%d", field, limit))
+	return h.cachedStats(key, func() (interface{}, error) {
+		results := []models.LocationStat{}
+
+		// geo-golang's address has no bson tags, so its fields are lowercase
+		path := "address." + field
+
+		q := filter.entryQuery()
+		q[path] = bson.M{"$nin": []interface{}{nil, ""}}
+
+		pipeline := []bson.M{
+			{"$match": q},
+			{"$group": bson.M{
+				"_id":     "$" + path,
+				"city":    bson.M{"$first": "$address.city"},
+				"country": bson.M{"$first": "$address.country"},
+				"count":   bson.M{"$sum": 1},
+			}},
+			{"$sort": bson.M{"count": -1}},
+			{"$limit": limit},
+			{"$project": bson.M{"_id": 0, "location": "$_id", "city": 1, "country": 1, "count": 1}},
+		}
+
+		err := h.stores.Entries.Aggregate(ctx, pipeline, &results)
+		return results, err
+	})
+}
+
+// GetUserStats counts signups, and users who reported at least one entry,
+// per day or week. Users have no location, so signups ignore the area.
+// Anonymous entries don't count towards active reporters.
+func (h *Handlers) GetUserStats(ctx context.Context, filter StatsFilter) (interface{}, error) {
+	return h.cachedStats(filter.cacheKey("users"), func() (interface{}, error) {
+		stats := models.UserStats{Signups: []models.PeriodStat{}, ActiveReporters: []models.PeriodStat{}}
+
+		signups := []bson.M{
+			{"$match": bson.M{
+				"isAdmin": false,
+				"created": bson.M{"$gte": filter.From, "$lte": filter.To},
+			}},
+			{"$group": bson.M{"_id": filter.period(), "count": bson.M{"$sum": 1}}},
+			{"$project": bson.M{"_id": 0, "period": "$_id", "count": 1}},
+			{"$sort": bson.M{"period": 1}},
+		}
+
+		if err := h.stores.Users.Aggregate(ctx, signups, &stats.Signups); err != nil {
+			return nil, err
+		}
+
+		q := filter.entryQuery()
+		q["anonymous"] = bson.M{"$ne": true}
+		q["uploadedBy"] = bson.M{"$exists": true}
+
+		reporters := []bson.M{
+			{"$match": q},
+			{"$group": bson.M{"_id": filter.period(), "reporters": bson.M{"$addToSet": "$uploadedBy"}}},
+			{"$project": bson.M{"_id": 0, "period": "$_id", "count": bson.M{"$size": "$reporters"}}},
+			{"$sort": bson.M{"period": 1}},
+		}
+
+		err := h.stores.Entries.Aggregate(ctx, reporters, &stats.ActiveReporters)
+		return stats, err
+	})
+}
+
+// GetResolutionStats works out the median time between an entry being
+// reported and a moderator approving, rejecting or hiding it.
+func (h *Handlers) GetResolutionStats(ctx context.Context, filter StatsFilter) (interface{}, error) {
+	return h.cachedStats(filter.cacheKey("resolution"), func() (interface{}, error) {
+		var stats models.ResolutionStats
+
+		q := filter.entryQuery()
+		q["moderation.moderatedAt"] = bson.M{"$exists": true}
+
+		counts := []bson.M{}
+		pipeline := []bson.M{{"$match": q}, {"$count": "resolved"}}
+		if err := h.stores.Entries.Aggregate(ctx, pipeline, &counts); err != nil {
+			return nil, err
+		}
+		if len(counts) == 0 {
+			return stats, nil
+		}
+		stats.Resolved = int(toFloat(counts[0]["resolved"]))
+
+		// sort the waits and read the middle one, or two for an even count
+		skip := (stats.Resolved - 1) / 2
+		limit := 2 - stats.Resolved%2
+
+		middle := []bson.M{}
+		pipeline = []bson.M{
+			{"$match": q},
+			{"$project": bson.M{"wait": bson.M{"$subtract": []string{"$moderation.moderatedAt", "$created"}}}},
+			{"$sort": bson.M{"wait": 1}},
+			{"$skip": skip},
+			{"$limit": limit},
+		}
+		if err := h.stores.Entries.Aggregate(ctx, pipeline, &middle); err != nil {
+			return nil, err
+		}
+
+		var total float64
+		for _, m := range middle {
+			total += toFloat(m["wait"])
+		}
+		stats.MedianSeconds = total / float64(len(middle)) / 1000
+
+		return stats, nil
+	})
+}
+
+// GetRankDistribution counts the users with each rank. Users who haven't
+// been ranked yet have rank 0.
+func (h *Handlers) GetRankDistribution(ctx context.Context) (interface{}, error) {
+	return h.cachedStats("ranks", func() (interface{}, error) {
+		results := []models.RankStat{}
+
+		pipeline := []bson.M{
+			{"$match": bson.M{"isAdmin": false, "status": constants.Enabled}},
+			{"$group": bson.M{"_id": bson.M{"$ifNull": []interface{}{"$ranking.rank", 0}}, "count": bson.M{"$sum": 1}}},
+			{"$sort": bson.M{"_id": 1}},
+		}
+
+		if err := h.stores.Users.Aggregate(ctx, pipeline, &results); err != nil {
+			return nil, err
+		}
+
+		for i := range results {
+			results[i].Name = models.GetRankName(results[i].Rank)
+			if results[i].Name == "" {
+				results[i].Name = "unranked"
+			}
+		}
+
+		return results, nil
+	})
+}
+
+// toFloat reads a number from an aggregation result, whichever type Mongo
+// returned it as.
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
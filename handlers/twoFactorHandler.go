@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/constants"
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AdminTwoFactorRequired reports whether every admin has to use 2FA.
+func (h *Handlers) AdminTwoFactorRequired() bool {
+	return h.conf.AdminRequire2FA
+}
+
+// StartTwoFactorEnrolment generates a new TOTP secret for the user. The secret
+// is kept pending until the user confirms it with a valid code, so a setup
+// that is never finished doesn't lock them out.
+func (h *Handlers) StartTwoFactorEnrolment(ctx context.Context, user models.User) (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      constants.TWO_FACTOR_ISSUER,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.updateTwoFactor(ctx, user, bson.M{"twoFactor.pendingSecret": key.Secret()})
+	return key, err
+}
+
+// ConfirmTwoFactorEnrolment enables 2FA if the code matches the pending
+// secret. It returns the recovery codes, which are only ever shown once.
+func (h *Handlers) ConfirmTwoFactorEnrolment(ctx context.Context, user *models.User, code string) ([]string, error) {
+	if user.TwoFactor.PendingSecret == "" {
+		return nil, constants.ValidationError(constants.TwoFactorNotPending)
+	}
+
+	step, ok := matchTOTP(code, user.TwoFactor.PendingSecret)
+	if !ok {
+		return nil, constants.ValidationError(constants.InvalidTwoFactorCode)
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TwoFactor = models.TwoFactor{
+		Enabled:       true,
+		Secret:        user.TwoFactor.PendingSecret,
+		RecoveryCodes: hashes,
+		LastStep:      step,
+	}
+
+	err = h.updateTwoFactor(ctx, *user, bson.M{"twoFactor": user.TwoFactor})
+	return codes, err
+}
+
+// DisableTwoFactor turns 2FA off and discards the secret and recovery codes.
+func (h *Handlers) DisableTwoFactor(ctx context.Context, user models.User) error {
+	return h.updateTwoFactor(ctx, user, bson.M{"twoFactor": models.TwoFactor{}})
+}
+
+// VerifyTwoFactorCode checks a TOTP code, falling back to the user's recovery
+// codes. Each code can only be used once: a TOTP code, or any code before it,
+// is rejected once one has been accepted, and a recovery code is removed. If
+// two requests use the same code at once, only one of them gets in.
+func (h *Handlers) VerifyTwoFactorCode(ctx context.Context, user models.User, code string) (bool, error) {
+	if !user.TwoFactor.Enabled {
+		return false, nil
+	}
+
+	if step, ok := matchTOTP(code, user.TwoFactor.Secret); ok {
+		filter := bson.M{"_id": user.ID, "$or": []bson.M{
+			{"twoFactor.lastStep": bson.M{"$lt": step}},
+			{"twoFactor.lastStep": bson.M{"$exists": false}},
+		}}
+		update := bson.M{"$set": bson.M{"twoFactor.lastStep": step}}
+		return h.spendCode(ctx, filter, update)
+	}
+
+	normalised := normaliseRecoveryCode(code)
+	for _, hash := range user.TwoFactor.RecoveryCodes {
+		if ComparePasswords(hash, []byte(normalised)) {
+			filter := bson.M{"_id": user.ID, "twoFactor.recoveryCodes": hash}
+			update := bson.M{"$pull": bson.M{"twoFactor.recoveryCodes": hash}}
+			return h.spendCode(ctx, filter, update)
+		}
+	}
+
+	return false, nil
+}
+
+// spendCode marks a code as used, if filter shows it hasn't been already.
+func (h *Handlers) spendCode(ctx context.Context, filter, update bson.M) (bool, error) {
+	result, err := h.stores.Users.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// totpOpts are the settings authenticator apps use. A code is accepted for a
+// step either side of its own, for clocks that are a little off.
+var totpOpts = totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+const totpSkew = 1
+
+// matchTOTP checks a TOTP code against secret, and returns the time step it
+// is for.
+func matchTOTP(code, secret string) (int64, bool) {
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / int64(totpOpts.Period)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		t := time.Unix(step*int64(totpOpts.Period), 0)
+		if ok, err := totp.ValidateCustom(code, secret, t, totpOpts); err == nil && ok {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func (h *Handlers) updateTwoFactor(ctx context.Context, user models.User, fields bson.M) error {
+	fields["updated"] = time.Now()
+	_, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": fields})
+	return err
+}
+
+// generateRecoveryCodes returns the plain codes to show to the user and the
+// hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, constants.RECOVERY_CODE_COUNT)
+	hashes := make([]string, constants.RECOVERY_CODE_COUNT)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		hash, err := generatePasswordHash(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = hash
+	}
+
+	return codes, hashes, nil
+}
+
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
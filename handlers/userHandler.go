@@ -2,14 +2,13 @@ package handlers
 
 import (
 	"context"
-	"log"
-	"os"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/OpeOnikute/mrkt-api/constants"
-	"github.com/OpeOnikute/mrkt-api/db"
 	"github.com/OpeOnikute/mrkt-api/models"
+	"github.com/OpeOnikute/mrkt-api/store"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -19,62 +18,65 @@ import (
 )
 
 type JwtClaim struct {
-	UserID   primitive.ObjectID `json:"userID"`
-	Username string             `json:"username"`
-	IsAdmin  bool               `json:"isAdmin"`
+	UserID       primitive.ObjectID  `json:"userID"`
+	Username     string              `json:"username"`
+	IsAdmin      bool                `json:"isAdmin"`
+	MFA          bool                `json:"mfa,omitempty"`          // the login was verified with a second factor
+	Purpose      string              `json:"purpose,omitempty"`      // empty for session tokens
+	Impersonator *primitive.ObjectID `json:"impersonator,omitempty"` // the admin using an impersonation token
 	jwt.StandardClaims
 }
 
-var jwtKey = []byte(os.Getenv("JWT_KEY"))
+// dummyPasswordHash is compared against when there is no real hash to check,
+// so a missing account takes as long to reject as a wrong password.
+var dummyPasswordHash, _ = generatePasswordHash("mrkt-dummy-password")
 
 // CreateUser allows you create different types of users by initializing outside the function
-func CreateUser(user *models.User) (*mongo.InsertOneResult, error) {
+func (h *Handlers) CreateUser(ctx context.Context, user *models.User) (*mongo.InsertOneResult, error) {
 	// confirm the user doesn't already exist
-	if existingUser, _ := GetUserByEmail(user.Email, user.IsAdmin); existingUser.Email == user.Email {
-		var newErr constants.CustomError
-		newErr.Msg = constants.UserExists
-		return nil, &newErr
+	if existingUser, _ := h.GetUserByEmail(ctx, user.Email, user.IsAdmin); existingUser.Email == user.Email {
+		return nil, constants.ConflictError(constants.UserExists)
+	}
+	if _, err := h.FindUser(ctx, bson.M{"username": user.Username}); err == nil {
+		return nil, constants.ConflictError(constants.ResourceExists("username"))
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
 	}
 
 	hash, _ := generatePasswordHash(user.Password)
 
 	user.Password = hash
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	return db.Collections.Users.InsertOne(ctx, user)
+	// someone could have signed up with the email or username since
+	result, err := h.stores.Users.InsertOne(ctx, *user)
+	if store.IsDuplicateKey(err) {
+		return nil, constants.ConflictError(constants.UserExists)
+	}
+	return result, err
 }
 
-// GetAllUsers gets all entries
-func GetAllUsers(isAdmin bool) ([]models.User, error) {
-	results := []models.User{}
-	cursor, err := db.Collections.Users.Find(context.Background(), bson.M{"isAdmin": isAdmin})
-	if err != nil {
-		return results, err
-	}
-	err = cursor.All(context.TODO(), &results)
-	return results, err
+// GetAllUsers gets all users matching the query
+func (h *Handlers) GetAllUsers(ctx context.Context, query bson.M) ([]models.User, error) {
+	return h.stores.Users.Find(ctx, query)
 }
 
 // GetUser exposes a function to retrieve an user using any query
-func GetUser(q bson.M) (models.User, error) {
+func (h *Handlers) GetUser(ctx context.Context, q bson.M) (models.User, error) {
 	q["status"] = "enabled"
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	err := db.Collections.Users.FindOne(ctx, q).Decode(&user)
-	return user, err
+	return h.stores.Users.FindOne(ctx, q)
+}
+
+// FindUser retrieves a user using any query, whatever their status
+func (h *Handlers) FindUser(ctx context.Context, q bson.M) (models.User, error) {
+	return h.stores.Users.FindOne(ctx, q)
 }
 
 // GetUserByID exposes a function to retrieve an user by it's ID
-func GetUserByID(requestID string, isAdmin bool) (models.User, error) {
+func (h *Handlers) GetUserByID(ctx context.Context, requestID string, isAdmin bool) (models.User, error) {
 	id, _ := primitive.ObjectIDFromHex(requestID)
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	err := db.Collections.Users.FindOne(ctx, bson.M{"_id": id, "isAdmin": isAdmin}).Decode(&user)
+	user, err := h.stores.Users.FindOne(ctx, bson.M{"_id": id, "isAdmin": isAdmin})
 
-	ranking, err := getUserRanking(user)
+	ranking, err := h.getUserRanking(ctx, user)
 	if err != nil {
 		return user, err
 	}
@@ -89,16 +91,12 @@ func GetUserByID(requestID string, isAdmin bool) (models.User, error) {
 }
 
 // GetUserByEmail exposes a function to retrieve an user by it's ID
-func GetUserByEmail(email string, isAdmin bool) (models.User, error) {
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	err := db.Collections.Users.FindOne(ctx, bson.M{"email": email, "isAdmin": isAdmin}).Decode(&user)
-	return user, err
+func (h *Handlers) GetUserByEmail(ctx context.Context, email string, isAdmin bool) (models.User, error) {
+	return h.stores.Users.FindOne(ctx, bson.M{"email": email, "isAdmin": isAdmin})
 }
 
 // UpdateUserByID exposes a function to update an user by it's ID
-func UpdateUserByID(requestID string, user models.User) (*mongo.UpdateResult, error) {
+func (h *Handlers) UpdateUserByID(ctx context.Context, requestID string, user models.User) (*mongo.UpdateResult, error) {
 
 	user.Updated = time.Now()
 
@@ -107,25 +105,20 @@ func UpdateUserByID(requestID string, user models.User) (*mongo.UpdateResult, er
 
 	id, _ := primitive.ObjectIDFromHex(requestID)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	result, err := db.Collections.Users.UpdateOne(ctx, bson.M{"_id": id}, update)
+	result, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": id}, update)
 	return result, err
 }
 
-// DeleteUserByID ...
-func DeleteUserByID(user models.User) (*mongo.UpdateResult, error) {
-
-	user.Status = "deleted"
-	user.Updated = time.Now()
-
-	update := make(map[string]interface{})
-	update["$set"] = user
+// DeleteUserByID closes a user's account. The email, password and linked
+// logins are removed, so nobody can log in to it again and the email is
+// free to sign up with.
+func (h *Handlers) DeleteUserByID(ctx context.Context, user models.User) (*mongo.UpdateResult, error) {
+	update := bson.M{
+		"$set":   bson.M{"status": "deleted", "updated": time.Now()},
+		"$unset": bson.M{"email": "", "password": "", "emailChange": "", "identities": ""},
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	result, err := db.Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, update)
+	result, err := h.stores.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, update)
 	return result, err
 }
 
@@ -141,13 +134,19 @@ func generatePasswordHash(pwd string) (string, error) {
 	return string(hash), nil
 }
 
+// ComparePasswords checks a plain password against a hash. An empty hash
+// never matches.
 func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
+	if hashedPwd == "" {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), plainPwd)
+		return false
+	}
+
 	// Since we'll be getting the hashed password from the DB it
 	// will be a string so we'll need to convert it to a byte slice
 	byteHash := []byte(hashedPwd)
 	err := bcrypt.CompareHashAndPassword(byteHash, plainPwd)
 	if err != nil {
-		log.Println(err)
 		return false
 	}
 
@@ -155,25 +154,43 @@ func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
 }
 
 // GenerateJWTToken ...
-func GenerateJWTToken(user *models.User) (string, error) {
+func (h *Handlers) GenerateJWTToken(user *models.User) (string, error) {
+	return h.generateToken(user, "", h.conf.Tokens.Session)
+}
+
+// GenerateChallengeToken issues a short-lived token that can only be used to
+// finish logging in, e.g. by supplying a 2FA code.
+func (h *Handlers) GenerateChallengeToken(user *models.User, purpose string) (string, error) {
+	return h.generateToken(user, purpose, h.conf.Tokens.Challenge)
+}
+
+func (h *Handlers) generateToken(user *models.User, purpose string, lifetime time.Duration) (string, error) {
+	return h.signToken(user, purpose, lifetime, nil)
+}
+
+func (h *Handlers) signToken(user *models.User, purpose string, lifetime time.Duration, impersonator *primitive.ObjectID) (string, error) {
 
 	// Declare the expiration time of the token
-	expirationTime := time.Now().Add(24 * time.Hour)
+	expirationTime := time.Now().Add(lifetime)
 	// Create the JWT claims, which includes the username and expiry time
 	claims := &JwtClaim{
-		UserID:   user.ID,
-		Username: user.Username,
-		IsAdmin:  user.IsAdmin,
+		UserID:       user.ID,
+		Username:     user.Username,
+		IsAdmin:      user.IsAdmin,
+		MFA:          user.TwoFactor.Enabled,
+		Purpose:      purpose,
+		Impersonator: impersonator,
 		StandardClaims: jwt.StandardClaims{
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  time.Now().Unix(),
 		},
 	}
 
 	// Declare the token with the algorithm used for signing, and the claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	// Create the JWT string
-	return token.SignedString(jwtKey)
+	return token.SignedString([]byte(h.conf.JWTKey))
 }
 
 // ComputeHighestAlphaRanking calculates the top alpha using the
@@ -182,12 +199,10 @@ func GenerateJWTToken(user *models.User) (string, error) {
 // the ranks of other users when we compute them.
 // If two users tie, the user is selected at random as we limit
 // the result to one user.
-func ComputeHighestAlphaRanking() {
+func (h *Handlers) ComputeHighestAlphaRanking(ctx context.Context) error {
 
 	results := []bson.M{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
 	matchStage := bson.M{"$match": bson.M{"status": "enabled"}}
 	lookupStage := bson.M{
 		"$lookup": bson.M{
@@ -239,85 +254,95 @@ func ComputeHighestAlphaRanking() {
 
 	pipeline := []bson.M{matchStage, lookupStage, unwindStage, groupStage, sortStage, limitStage}
 
-	cursor, _ := db.Collections.Users.Aggregate(ctx, pipeline)
-	_ = cursor.All(context.TODO(), &results)
+	if err := h.stores.Users.Aggregate(ctx, pipeline, &results); err != nil {
+		return err
+	}
 
 	if len(results) > 0 {
 		topAlpha := results[0]
 		// make type assertion to convert interface to string and int
 		email := topAlpha["_id"].(string)
 		count := topAlpha["count"].(int32)
-		changeTopAlpha(email, count)
+		return h.changeTopAlpha(ctx, email, count)
 	}
+	return nil
 }
 
-func changeTopAlpha(email string, numIncidents int32) {
+func (h *Handlers) changeTopAlpha(ctx context.Context, email string, numIncidents int32) error {
 	// find and update the current top alpha to false
-	currentAlpha, err := GetUser(bson.M{"ranking.isTopAlpha": true})
+	currentAlpha, err := h.GetUser(ctx, bson.M{"ranking.isTopAlpha": true})
 
 	if (err != nil) && (err != mongo.ErrNoDocuments) {
-		panic(err)
+		return err
 	}
 
 	// if user the same user isn't the new alpha, commot am
 	if currentAlpha.Email != "" && currentAlpha.Email != email {
-		_, err := removeTopAlpha(currentAlpha)
+		_, err := h.removeTopAlpha(ctx, currentAlpha)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		log.Printf("Removed old alpha: %s", currentAlpha.Email)
+		slog.Info("Removed old alpha", "userId", currentAlpha.ID.Hex())
 	}
 
-	newAlpha, err := GetUser(bson.M{"email": email})
+	newAlpha, err := h.GetUser(ctx, bson.M{"email": email})
+	if err != nil {
+		return err
+	}
 
 	// update this top alpha to true and add number of incidents
-	_, err = addNewAlpha(newAlpha, numIncidents)
+	_, err = h.addNewAlpha(ctx, newAlpha, numIncidents)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Printf("New alpha added: %s", email)
+	slog.Info("New alpha added", "userId", newAlpha.ID.Hex())
+	return nil
 }
 
-func addNewAlpha(user models.User, numIncidents int32) (*mongo.UpdateResult, error) {
+func (h *Handlers) addNewAlpha(ctx context.Context, user models.User, numIncidents int32) (*mongo.UpdateResult, error) {
 	user.Ranking.IsTopAlpha = true
 	user.Ranking.NumIncidents = numIncidents
 	user.Ranking.Rank = constants.ALPHA_RANK
 	user.Ranking.LastUpdated = time.Now()
 	stringID := user.ID.Hex()
-	return UpdateUserByID(stringID, user)
+	return h.UpdateUserByID(ctx, stringID, user)
 }
 
-func removeTopAlpha(user models.User) (*mongo.UpdateResult, error) {
+func (h *Handlers) removeTopAlpha(ctx context.Context, user models.User) (*mongo.UpdateResult, error) {
 	user.Ranking.IsTopAlpha = false
 	stringID := user.ID.Hex()
-	return UpdateUserByID(stringID, user)
+	return h.UpdateUserByID(ctx, stringID, user)
 }
 
-func computeUserRanking(user models.User) (*models.Ranking, error) {
+func (h *Handlers) computeUserRanking(ctx context.Context, user models.User) (*models.Ranking, error) {
 
 	var rank int
 
-	currentAlpha, err := GetUser(bson.M{"ranking.isTopAlpha": true})
+	currentAlpha, err := h.GetUser(ctx, bson.M{"ranking.isTopAlpha": true})
 
 	if err != nil {
 		return &user.Ranking, err
 	}
 
 	// calculate where the user lies in the spectrum
-	entries, err := GetAllEntries(bson.M{"uploadedBy": user.ID, "status": "enabled"})
+	entries, err := h.GetAllEntries(ctx, bson.M{"uploadedBy": user.ID, "status": "enabled"})
 
 	if err != nil {
 		return &user.Ranking, err
 	}
 
 	alphaEntries := currentAlpha.Ranking.NumIncidents
-	userEntries := len(entries)
+	userEntries := int32(len(entries))
 
-	percentile := (int32(userEntries) / alphaEntries) * 100
+	// multiply first, or anyone with fewer entries than the alpha gets 0
+	var percentile int32
+	if alphaEntries > 0 {
+		percentile = userEntries * 100 / alphaEntries
+	}
 
-	if percentile >= 80 {
+	if percentile >= int32(h.conf.Ranking.AlphaPercentile) {
 		rank = constants.ALPHA_RANK
-	} else if 40 <= percentile && percentile <= 79 {
+	} else if percentile >= int32(h.conf.Ranking.BetaPercentile) {
 		rank = constants.BETA_RANK
 	} else {
 		rank = constants.PUP_RANK
@@ -328,15 +353,34 @@ func computeUserRanking(user models.User) (*models.Ranking, error) {
 	user.Ranking.Rank = rank
 	stringID := user.ID.Hex()
 
-	if _, err = UpdateUserByID(stringID, user); err != nil {
+	if _, err = h.UpdateUserByID(ctx, stringID, user); err != nil {
 		return &user.Ranking, err
 	}
 
 	return &user.Ranking, nil
 }
 
+// RecomputeRankings works out the top alpha again, then the rank of every
+// other enabled user. It returns how many users were ranked.
+func (h *Handlers) RecomputeRankings(ctx context.Context) (int, error) {
+	if err := h.ComputeHighestAlphaRanking(ctx); err != nil {
+		return 0, err
+	}
+
+	q := bson.M{"status": constants.Enabled, "isAdmin": false, "ranking.isTopAlpha": bson.M{"$ne": true}}
+	ranked := 0
+	err := h.stores.Users.Each(ctx, q, store.FindOptions{}, func(user models.User) error {
+		if _, err := h.computeUserRanking(ctx, user); err != nil {
+			return err
+		}
+		ranked++
+		return nil
+	})
+	return ranked, err
+}
+
 // getUserRanking ...
-func getUserRanking(user models.User) (*models.Ranking, error) {
+func (h *Handlers) getUserRanking(ctx context.Context, user models.User) (*models.Ranking, error) {
 
 	ranking := user.Ranking
 
@@ -349,7 +393,7 @@ func getUserRanking(user models.User) (*models.Ranking, error) {
 
 	if lastUpdated.Before(midnight) {
 		// compute user ranking based on alpha
-		newRanking, err := computeUserRanking(user)
+		newRanking, err := h.computeUserRanking(ctx, user)
 		if err != nil {
 			return &ranking, err
 		}
@@ -368,7 +412,13 @@ func GetAlphaValue() {
 }
 
 // VerifyJWTToken ...
-func VerifyJWTToken(tknStr string, isAdmin bool) (bool, *JwtClaim) {
+func (h *Handlers) VerifyJWTToken(tknStr string, isAdmin bool) (bool, *JwtClaim) {
+	return h.VerifyPurposeToken(tknStr, "", isAdmin)
+}
+
+// VerifyPurposeToken verifies a token that was issued for a specific purpose.
+// Session tokens have an empty purpose.
+func (h *Handlers) VerifyPurposeToken(tknStr string, purpose string, isAdmin bool) (bool, *JwtClaim) {
 
 	// remove the bearer part
 	tknStr = strings.Replace(tknStr, "Bearer ", "", -1)
@@ -382,15 +432,15 @@ func VerifyJWTToken(tknStr string, isAdmin bool) (bool, *JwtClaim) {
 	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
 	// or if the signature does not match
 	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+		return []byte(h.conf.JWTKey), nil
 	})
-	if err != nil {
+	if err != nil || !tkn.Valid {
 		res = false
 	}
-	if !tkn.Valid {
+	if claims.IsAdmin != isAdmin {
 		res = false
 	}
-	if claims.IsAdmin != isAdmin {
+	if claims.Purpose != purpose {
 		res = false
 	}
 	return res, claims
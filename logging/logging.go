@@ -0,0 +1,104 @@
+// Package logging sets up the structured logger the API logs with, and
+// carries the logger for each request in its context.
+//
+// Logs are JSON, one object per line. Request logs have the request ID,
+// route and, once they are known, the user ID in them.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Configure makes a JSON logger writing to stdout the default, logging level
+// and above. It is also what the log package writes to from then on.
+func Configure(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	slog.SetDefault(New(os.Stdout, l))
+	return nil
+}
+
+// New returns a logger writing JSON to w.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+type contextKey struct{}
+
+// scope is shared by a context and every context made from it, so attributes
+// added further down are logged by the code that created it too.
+type scope struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// NewContext returns a context that logs with logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &scope{logger: logger})
+}
+
+// FromContext returns the logger of the context, or the default logger if it
+// doesn't have one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// With adds attributes to the logger of the context. They are in everything
+// it logs from then on, everywhere the context is used.
+func With(ctx context.Context, args ...interface{}) {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.logger = s.logger.With(args...)
+	}
+}
+
+// Error is the attribute errors are logged as: their message and the stack
+// of the code logging them.
+func Error(err error) slog.Attr {
+	return slog.Group("error",
+		slog.String("message", err.Error()),
+		slog.String("stack", stack(2)),
+	)
+}
+
+// Panic is the attribute a recovered panic is logged as, with the stack of
+// the goroutine that panicked.
+func Panic(v interface{}, stack []byte) slog.Attr {
+	return slog.Group("error",
+		slog.String("message", fmt.Sprintf("panic: %v", v)),
+		slog.String("stack", string(stack)),
+	)
+}
+
+// stack formats the goroutine's stack, leaving out the skip innermost
+// frames, counting stack itself.
+func stack(skip int) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
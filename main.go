@@ -1,26 +1,125 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/controllers"
 	"github.com/OpeOnikute/mrkt-api/db"
+	apphandlers "github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/logging"
 	"github.com/OpeOnikute/mrkt-api/router"
+	"github.com/OpeOnikute/mrkt-api/store"
+	"github.com/OpeOnikute/mrkt-api/tracing"
 	"github.com/gorilla/handlers"
 )
 
 func main() {
-	PORT := os.Getenv("PORT")
-	db.Connect()
-	fmt.Printf("Application listening on port %s\n", PORT)
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load config", logging.Error(err))
+		os.Exit(1)
+	}
+	if err := logging.Configure(cfg.LogLevel); err != nil {
+		slog.Error("Failed to configure logging", logging.Error(err))
+		os.Exit(1)
+	}
+
+	stopTracing, err := tracing.Configure(cfg.Tracing)
+	if err != nil {
+		slog.Error("Failed to configure tracing", logging.Error(err))
+		os.Exit(1)
+	}
+
+	if err := db.Connect(cfg.Mongo); err != nil {
+		slog.Error("Failed to connect to the database", logging.Error(err))
+		os.Exit(1)
+	}
+	api := controllers.NewAPI(cfg, apphandlers.New(cfg, store.NewMongo(db.Database)))
+
+	// stopped when the API is told to shut down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var jobs sync.WaitGroup
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		prepareDatabase(ctx, cfg.Mongo.MigrateOnStart)
+	}()
 
 	// handle CORS requests
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
-	originsOk := handlers.AllowedOrigins([]string{os.Getenv("ORIGIN_ALLOWED")})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "X-Edit-Token", "X-Request-ID", "traceparent", "tracestate"})
+	exposedOk := handlers.ExposedHeaders([]string{"X-Request-ID"})
+	originsOk := handlers.AllowedOrigins([]string{cfg.OriginAllowed})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.Port),
+		Handler:      handlers.CORS(originsOk, headersOk, exposedOk, methodsOk)(router.GetRouter(api)),
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Application listening", "port", cfg.Port)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		slog.Error("Failed to serve", logging.Error(err))
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down")
+	controllers.ShuttingDown()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// stop taking requests and wait for the ones in progress
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to finish requests in progress", logging.Error(err))
+	}
+	jobs.Wait()
+
+	if err := stopTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to send the last traces", logging.Error(err))
+	}
+	if err := db.Disconnect(shutdownCtx); err != nil {
+		slog.Error("Failed to disconnect from the database", logging.Error(err))
+	}
+	slog.Info("Shut down")
+}
 
-	r := router.GetRouter()
+// prepareDatabase applies the migrations, or with migrateOnStart off checks
+// they have been, trying again until it works or ctx is done. The API isn't
+// ready until the database is migrated.
+func prepareDatabase(ctx context.Context, migrateOnStart bool) {
+	for {
+		err := db.Prepare(ctx, migrateOnStart)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		slog.Error("Failed to prepare the database", logging.Error(err))
 
-	http.ListenAndServe(fmt.Sprintf(":%s", PORT), handlers.CORS(originsOk, headersOk, methodsOk)(r))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
 }
@@ -0,0 +1,140 @@
+// Package metrics keeps the Prometheus metrics of the API, served on
+// /metrics by Handler.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mrkt"
+
+var registry = prometheus.NewRegistry()
+
+var factory = promauto.With(registry)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	httpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route template and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took to handle, by route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	mongoDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "How long MongoDB commands took, by collection.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"collection", "command"})
+
+	mongoErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_errors_total",
+		Help:      "MongoDB commands that failed, by collection.",
+	}, []string{"collection", "command"})
+
+	geocoderRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geocoder_requests_total",
+		Help:      "Reverse geocoding requests, by whether they succeeded.",
+	}, []string{"result"})
+
+	geocoderDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "geocoder_request_duration_seconds",
+		Help:      "How long reverse geocoding requests took.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	entriesCreated = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "entries_created_total",
+		Help:      "Entries reported, by alert type and level.",
+	}, []string{"alert_type", "level"})
+
+	signups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Users who signed up, by how: password or the login provider.",
+	}, []string{"method"})
+
+	locationRankings = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "location_rankings_total",
+		Help:      "Location safety rankings worked out, by outcome.",
+	}, []string{"outcome"})
+)
+
+// Handler serves the metrics for Prometheus to scrape.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a handled HTTP request. route is the template of the
+// route it matched, empty if it didn't match one.
+func ObserveRequest(method, route string, status int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// ObserveMongoCommand records a command sent to MongoDB. collection is empty
+// for commands that aren't run on a collection.
+func ObserveMongoCommand(collection, command string, duration time.Duration, failed bool) {
+	if collection == "" {
+		collection = "none"
+	}
+	mongoDuration.WithLabelValues(collection, command).Observe(duration.Seconds())
+	if failed {
+		mongoErrors.WithLabelValues(collection, command).Inc()
+	}
+}
+
+// ObserveGeocode records a reverse geocoding request.
+func ObserveGeocode(duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	geocoderRequests.WithLabelValues(result).Inc()
+	geocoderDuration.Observe(duration.Seconds())
+}
+
+// EntryCreated counts a reported entry.
+func EntryCreated(alertType string, level int) {
+	entriesCreated.WithLabelValues(alertType, strconv.Itoa(level)).Inc()
+}
+
+// SignedUp counts a new user. method is "password" or the name of the login
+// provider they signed up with.
+func SignedUp(method string) {
+	signups.WithLabelValues(method).Inc()
+}
+
+// LocationRanked counts a location ranking with the outcome it had: safe,
+// warning, unsafe or unknown.
+func LocationRanked(outcome string) {
+	locationRankings.WithLabelValues(outcome).Inc()
+}
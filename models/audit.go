@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditLog records one change made through the API. Audit logs are only ever
+// inserted, never deleted, and only updated to erase a user's personal data.
+type AuditLog struct {
+	ID         primitive.ObjectID     `json:"_id" bson:"_id"`
+	Actor      AuditActor             `json:"actor" bson:"actor"`
+	Action     string                 `json:"action" bson:"action"`
+	Collection string                 `json:"collection" bson:"collection"`
+	TargetID   string                 `json:"targetID" bson:"targetID"`
+	Changes    map[string]FieldChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	Route      string                 `json:"route" bson:"route"` // method and path of the request
+	IP         string                 `json:"ip" bson:"ip"`
+	RequestID  string                 `json:"requestID" bson:"requestID"`
+	Created    time.Time              `json:"created" bson:"created"`
+}
+
+// AuditActor is who made a change. Type is admin, user, anonymous or system,
+// for changes made with the mrkt CLI.
+type AuditActor struct {
+	Type string              `json:"type" bson:"type"`
+	ID   *primitive.ObjectID `json:"id,omitempty" bson:"id,omitempty"`
+}
+
+// Is reports whether the actor is the user or admin with the ID.
+func (a AuditActor) Is(id primitive.ObjectID) bool {
+	return a.ID != nil && *a.ID == id
+}
+
+// FieldChange is the value of a field before and after a change.
+type FieldChange struct {
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
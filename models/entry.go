@@ -3,29 +3,48 @@ package models
 import (
 	"time"
 
+	"github.com/OpeOnikute/mrkt-api/constants"
+
 	geo "github.com/codingsince1985/geo-golang"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Entry struct {
-	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Title       string             `json:"title" bson:"title" validate:"required"`
-	Description string             `json:"description" bson:"description" validate:"required"`
-	UploadedBy  interface{}        `json:"uploadedBy" bson:"uploadedBy"`
-	ContentURL  string             `json:"contentURL" bson:"contentURL" validate:"required"`
-	ContentType string             `json:"contentType" bson:"contentType" validate:"required"`
-	Location    Location           `json:"location" bson:"location" validate:"required"`
-	Address     *geo.Address       `json:"address" bson:"address"`
-	AlertType   primitive.ObjectID `json:"alertType" bson:"alertType"`
-	Status      string             `json:"status" bson:"status"`
-	Created     time.Time          `json:"created" bson:"created"`
-	Updated     time.Time          `json:"updated" bson:"updated"`
+	ID          primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Title       string              `json:"title" bson:"title" validate:"required"`
+	Description string              `json:"description" bson:"description" validate:"required"`
+	UploadedBy  *primitive.ObjectID `json:"uploadedBy,omitempty" bson:"uploadedBy,omitempty"`
+	Anonymous   bool                `json:"anonymous" bson:"anonymous"`
+	EditToken   string              `json:"-" bson:"editToken,omitempty"` // hash of the token anonymous reporters manage the entry with
+	ContentURL  string              `json:"contentURL" bson:"contentURL" validate:"required"`
+	ContentType string              `json:"contentType" bson:"contentType" validate:"required,contentType"`
+	Location    Location            `json:"location" bson:"location" validate:"required"`
+	Address     *geo.Address        `json:"address" bson:"address"`
+	AlertType   primitive.ObjectID  `json:"alertType" bson:"alertType" validate:"alertType"`
+	Moderation  Moderation          `json:"moderation" bson:"moderation"`
+	FlagScore   int                 `json:"flagScore,omitempty" bson:"flagScore,omitempty"` // sum of the weights of its flags
+	Version     int                 `json:"version" bson:"version"`                         // latest revision of its content
+	Hidden      bool                `json:"-" bson:"hidden,omitempty"`                      // its reporter is shadow-banned
+	Edited      bool                `json:"edited" bson:"edited"`
+	EditedAt    *time.Time          `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+	Status      string              `json:"status" bson:"status"`
+	Created     time.Time           `json:"created" bson:"created"`
+	Updated     time.Time           `json:"updated" bson:"updated"`
+}
+
+// Moderation records where an entry is in the moderation queue and the last
+// decision an admin made about it.
+type Moderation struct {
+	State       string              `json:"state" bson:"state"`
+	Reason      string              `json:"reason,omitempty" bson:"reason,omitempty"`
+	ModeratedBy *primitive.ObjectID `json:"moderatedBy,omitempty" bson:"moderatedBy,omitempty"`
+	ModeratedAt *time.Time          `json:"moderatedAt,omitempty" bson:"moderatedAt,omitempty"`
 }
 
 type Location struct {
 	Type        string     `json:"type" bson:"type"`
-	Coordinates [2]float64 `json:"coordinates" bson:"coordinates"`
+	Coordinates [2]float64 `json:"coordinates" bson:"coordinates" validate:"coordinates"` // latitude, longitude
 }
 
 // LocationRanking ...
@@ -35,6 +54,57 @@ type LocationRanking struct {
 	NumIncidents int32   `json:"numIncidents" bson:"numIncidents"`
 }
 
+// IsUploadedBy reports whether the user reported the entry.
+func (e Entry) IsUploadedBy(userID primitive.ObjectID) bool {
+	return e.UploadedBy != nil && *e.UploadedBy == userID
+}
+
+// IsPublic reports whether the entry can be shown to people other than its
+// reporter.
+func (e Entry) IsPublic() bool {
+	if e.Status != constants.Enabled || e.Hidden {
+		return false
+	}
+	for _, state := range constants.HiddenModerationStates {
+		if e.Moderation.State == state {
+			return false
+		}
+	}
+	return true
+}
+
+// Public returns the entry as anyone but its reporter should see it.
+func (e Entry) Public() Entry {
+	if e.Anonymous {
+		e.UploadedBy = nil
+	}
+	return e
+}
+
+// Content returns the parts of the entry its reporter can edit.
+func (e Entry) Content() EntryContent {
+	return EntryContent{
+		Title:       e.Title,
+		Description: e.Description,
+		ContentURL:  e.ContentURL,
+		ContentType: e.ContentType,
+		Location:    e.Location,
+		Address:     e.Address,
+		AlertType:   e.AlertType,
+	}
+}
+
+// SetContent replaces the parts of the entry its reporter can edit.
+func (e *Entry) SetContent(c EntryContent) {
+	e.Title = c.Title
+	e.Description = c.Description
+	e.ContentURL = c.ContentURL
+	e.ContentType = c.ContentType
+	e.Location = c.Location
+	e.Address = c.Address
+	e.AlertType = c.AlertType
+}
+
 // GetDefaultEntry sets the defaults for entries
 func GetDefaultEntry() *Entry {
 	defaultLocation := Location{
@@ -43,8 +113,10 @@ func GetDefaultEntry() *Entry {
 	return &Entry{
 		ID:          primitive.NewObjectID(),
 		Location:    defaultLocation,
-		ContentType: "image",
+		ContentType: constants.CONTENT_IMAGE,
 		Status:      "enabled",
+		Moderation:  Moderation{State: constants.MODERATION_NEW},
+		Version:     1,
 		Created:     time.Now(),
 		Updated:     time.Now(),
 	}
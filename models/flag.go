@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Flag is a user's report that an entry is abusive or wrong.
+type Flag struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	Entry      primitive.ObjectID `json:"entry" bson:"entry"`
+	ReportedBy primitive.ObjectID `json:"reportedBy" bson:"reportedBy"`
+	Reason     string             `json:"reason" bson:"reason" validate:"required,oneof=spam offensive fake wrong_location duplicate"`
+	Comment    string             `json:"comment,omitempty" bson:"comment,omitempty"`
+	Weight     int                `json:"weight" bson:"weight"`
+	Created    time.Time          `json:"created" bson:"created"`
+}
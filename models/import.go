@@ -0,0 +1,21 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// ImportReport says what happened to each row of an import.
+type ImportReport struct {
+	DryRun   bool              `json:"dryRun"`
+	Total    int               `json:"total"`
+	Imported int               `json:"imported"` // or would have been, in a dry run
+	Failed   int               `json:"failed"`
+	Rows     []ImportRowResult `json:"rows"`
+}
+
+// ImportRowResult is the outcome of importing one row. Row is the line of a
+// CSV file, or the index of a GeoJSON feature, counting from 1.
+type ImportRowResult struct {
+	Row      int                 `json:"row"`
+	EntryID  *primitive.ObjectID `json:"entryID,omitempty"`
+	Errors   []string            `json:"errors,omitempty"`
+	Warnings []string            `json:"warnings,omitempty"` // the row was imported anyway
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginAttempt tracks failed logins for a single key. Keys are either an
+// account ("account:user:jane@example.com") or a client IP ("ip:10.0.0.1").
+type LoginAttempt struct {
+	Key         string    `json:"key" bson:"_id"`
+	Failures    int       `json:"failures" bson:"failures"`
+	LastFailure time.Time `json:"lastFailure" bson:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil" bson:"lockedUntil"`
+}
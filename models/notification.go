@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Notification is an in-app message addressed to a single user.
+type Notification struct {
+	ID      primitive.ObjectID `json:"_id" bson:"_id"`
+	User    primitive.ObjectID `json:"user" bson:"user"`
+	Type    string             `json:"type" bson:"type"`
+	Message string             `json:"message" bson:"message"`
+	Read    bool               `json:"read" bson:"read"`
+	Created time.Time          `json:"created" bson:"created"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	geo "github.com/codingsince1985/geo-golang"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EntryRevision is one version of an entry's content. A new revision is saved
+// every time the content changes, so older versions can be compared and
+// restored.
+type EntryRevision struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Entry        primitive.ObjectID `json:"entry" bson:"entry"`
+	Version      int                `json:"version" bson:"version"`
+	Content      EntryContent       `json:"content" bson:"content"`
+	ChangedBy    AuditActor         `json:"changedBy" bson:"changedBy"`
+	RestoredFrom int                `json:"restoredFrom,omitempty" bson:"restoredFrom,omitempty"` // version a rollback went back to
+	Created      time.Time          `json:"created" bson:"created"`
+}
+
+// EntryContent is the part of an entry its reporter can edit.
+type EntryContent struct {
+	Title       string             `json:"title" bson:"title"`
+	Description string             `json:"description" bson:"description"`
+	ContentURL  string             `json:"contentURL" bson:"contentURL"`
+	ContentType string             `json:"contentType" bson:"contentType"`
+	Location    Location           `json:"location" bson:"location"`
+	Address     *geo.Address       `json:"address" bson:"address"`
+	AlertType   primitive.ObjectID `json:"alertType" bson:"alertType"`
+}
+
+// Public returns the revision as people other than the entry's reporter and
+// admins should see it. Only the reporter of an entry that isn't anonymous is
+// named.
+func (r EntryRevision) Public(entry Entry) EntryRevision {
+	if r.ChangedBy.ID == nil {
+		return r
+	}
+	if entry.Anonymous || !entry.IsUploadedBy(*r.ChangedBy.ID) {
+		r.ChangedBy.ID = nil
+	}
+	return r
+}
@@ -0,0 +1,42 @@
+package models
+
+// EntryStat is the number of entries of an alert type reported in a period.
+type EntryStat struct {
+	Period    string `json:"period" bson:"period"`
+	AlertType string `json:"alertType" bson:"alertType"`
+	Level     int    `json:"level" bson:"level"`
+	Count     int    `json:"count" bson:"count"`
+}
+
+// LocationStat is the number of entries reported in an area.
+type LocationStat struct {
+	Location string `json:"location" bson:"location"`
+	City     string `json:"city,omitempty" bson:"city"`
+	Country  string `json:"country,omitempty" bson:"country"`
+	Count    int    `json:"count" bson:"count"`
+}
+
+// PeriodStat is a count for a day or week.
+type PeriodStat struct {
+	Period string `json:"period" bson:"period"`
+	Count  int    `json:"count" bson:"count"`
+}
+
+// UserStats tracks how many people sign up and report entries over time.
+type UserStats struct {
+	Signups         []PeriodStat `json:"signups"`
+	ActiveReporters []PeriodStat `json:"activeReporters"`
+}
+
+// ResolutionStats is how long entries wait for a moderator's decision.
+type ResolutionStats struct {
+	Resolved      int     `json:"resolved"`
+	MedianSeconds float64 `json:"medianSeconds"`
+}
+
+// RankStat is the number of users with a rank.
+type RankStat struct {
+	Rank  int    `json:"rank" bson:"_id"`
+	Name  string `json:"name" bson:"-"`
+	Count int    `json:"count" bson:"count"`
+}
@@ -8,16 +8,21 @@ import (
 
 // User ...
 type User struct {
-	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Username  string             `json:"username" bson:"username" validate:"required"`
-	Email     string             `json:"email" bson:"email" validate:"required,email"`
-	Password  string             `json:"password,omitempty" bson:"password" validate:"required"`
-	IsAdmin   bool               `json:"isAdmin" bson:"isAdmin"`
-	Ranking   Ranking            `json:"ranking" bson:"ranking"`
-	AdminRole string             `json:"adminRole,omitempty" bson:"adminRole"` // super, standard
-	Status    string             `json:"status" bson:"status"`
-	Created   time.Time          `json:"created" bson:"created"`
-	Updated   time.Time          `json:"updated" bson:"updated"`
+	ID               primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Username         string             `json:"username" bson:"username" validate:"required"`
+	Email            string             `json:"email" bson:"email" validate:"required,email"`
+	Password         string             `json:"password,omitempty" bson:"password" validate:"required,min=8"`
+	IsAdmin          bool               `json:"isAdmin" bson:"isAdmin"`
+	Ranking          Ranking            `json:"ranking" bson:"ranking"`
+	AdminRole        string             `json:"adminRole,omitempty" bson:"adminRole" validate:"omitempty,oneof=super standard"`
+	TwoFactor        TwoFactor          `json:"twoFactor" bson:"twoFactor"`
+	Identities       []Identity         `json:"identities,omitempty" bson:"identities,omitempty"`
+	EmailChange      *EmailChange       `json:"emailChange,omitempty" bson:"emailChange,omitempty"`
+	Restriction      *Restriction       `json:"restriction,omitempty" bson:"restriction,omitempty"`
+	TokensValidAfter time.Time          `json:"-" bson:"tokensValidAfter"` // tokens issued before this are no longer accepted
+	Status           string             `json:"status" bson:"status"`
+	Created          time.Time          `json:"created" bson:"created"`
+	Updated          time.Time          `json:"updated" bson:"updated"`
 }
 
 // Ranking ...
@@ -28,6 +33,62 @@ type Ranking struct {
 	LastUpdated  time.Time `json:"lastUpdated" bson:"lastUpdated"`
 }
 
+// TwoFactor holds a user's TOTP settings. Secrets and recovery codes are
+// never sent to clients.
+type TwoFactor struct {
+	Enabled       bool     `json:"enabled" bson:"enabled"`
+	Secret        string   `json:"-" bson:"secret"`
+	PendingSecret string   `json:"-" bson:"pendingSecret"` // set during enrolment, until confirmed
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes"` // hashed, each can be used once
+	// the time step of the last code accepted. Codes from it or before it
+	// can't be used again.
+	LastStep int64 `json:"-" bson:"lastStep"`
+}
+
+// Identity links a user to an account with an external OpenID Connect
+// provider.
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"-" bson:"subject"`
+	Linked   time.Time `json:"linked" bson:"linked"`
+}
+
+// UsedNonce is the nonce of an ID token a user logged in with, kept until the
+// token expires so the token can't be used again.
+type UsedNonce struct {
+	Key     string    `json:"key" bson:"_id"` // provider:nonce
+	Expires time.Time `json:"expires" bson:"expires"`
+}
+
+// EmailChange is a new email address waiting for the user to prove they own
+// it.
+type EmailChange struct {
+	Email     string    `json:"email" bson:"email"`
+	TokenHash string    `json:"-" bson:"tokenHash"`
+	Expires   time.Time `json:"expires" bson:"expires"`
+}
+
+// Restriction is a sanction an admin put on a user. Suspended and banned
+// users can't use their account. Shadow-banned users can, but nobody else sees
+// their entries.
+type Restriction struct {
+	State        string             `json:"state" bson:"state"`
+	Reason       string             `json:"reason" bson:"reason"`
+	Until        *time.Time         `json:"until,omitempty" bson:"until,omitempty"` // suspensions only
+	RestrictedBy primitive.ObjectID `json:"restrictedBy" bson:"restrictedBy"`
+	Created      time.Time          `json:"created" bson:"created"`
+}
+
+// ActiveRestriction returns the user's restriction, unless they have none or
+// their suspension is over.
+func (u User) ActiveRestriction() *Restriction {
+	r := u.Restriction
+	if r == nil || (r.Until != nil && r.Until.Before(time.Now())) {
+		return nil
+	}
+	return r
+}
+
 // GetRankName ...
 func GetRankName(rank int) string {
 	rankings := map[int]string{1: "pup", 2: "beta", 3: "alpha"}
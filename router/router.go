@@ -2,22 +2,27 @@ package router
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/OpeOnikute/mrkt-api/constants"
 	"github.com/OpeOnikute/mrkt-api/controllers"
+	"github.com/OpeOnikute/mrkt-api/metrics"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
-var adminController controllers.AdminController
-var entriesController controllers.EntriesController
-var userController controllers.UsersController
+// GetRouter exposes the main router, with its controllers running on api.
+func GetRouter(api *controllers.API) http.Handler {
+	adminController := controllers.AdminController{API: api}
+	entriesController := controllers.EntriesController{API: api}
+	healthController := controllers.HealthController{API: api}
+	userController := controllers.UsersController{API: api}
 
-// GetRouter exposes the main router
-func GetRouter() http.Handler {
 	router := mux.NewRouter()
+	router.Use(api.RequestDeadlines)
+
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.HandleFunc("/healthz", healthController.LivenessEndpoint).Methods("GET")
+	router.HandleFunc("/readyz", healthController.ReadinessEndpoint).Methods("GET")
 
 	router.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
 		data := make(map[string]interface{})
@@ -28,7 +33,12 @@ func GetRouter() http.Handler {
 	entryrouter := router.PathPrefix("/entry").Subrouter()
 	entryrouter.HandleFunc("", entriesController.AddEntryEndpoint).Methods("POST")
 	entryrouter.HandleFunc("", entriesController.GetEntriesEndpoint).Methods("GET")
+	entryrouter.HandleFunc("/export", entriesController.ExportEntriesEndpoint).Methods("GET")
 	entryrouter.HandleFunc("/{id}", entriesController.GetEntryEndpoint).Methods("GET")
+	entryrouter.HandleFunc("/{id}", entriesController.UpdateEntryEndpoint).Methods("PUT")
+	entryrouter.HandleFunc("/{id}", entriesController.DeleteEntryEndpoint).Methods("DELETE")
+	entryrouter.HandleFunc("/{id}/revisions", entriesController.GetEntryRevisionsEndpoint).Methods("GET")
+	entryrouter.HandleFunc("/{id}/revisions/diff", entriesController.GetEntryRevisionDiffEndpoint).Methods("GET")
 
 	locationrouter := router.PathPrefix("/location").Subrouter()
 	locationrouter.HandleFunc("/safety", entriesController.GetLocationRanking).Methods("GET")
@@ -38,27 +48,75 @@ func GetRouter() http.Handler {
 
 	userrouter.HandleFunc("/sign-up", userController.SignupEndpoint).Methods("POST")
 	userrouter.HandleFunc("/login", userController.LoginEndpoint).Methods("POST")
+	userrouter.HandleFunc("/login/2fa", userController.TwoFactorLoginEndpoint).Methods("POST")
+	userrouter.HandleFunc("/oidc/{provider}", userController.OIDCTokenEndpoint).Methods("POST")
+	userrouter.HandleFunc("/oidc/{provider}/authorize", userController.OIDCAuthorizeEndpoint).Methods("GET")
+	userrouter.HandleFunc("/oidc/{provider}/callback", userController.OIDCCallbackEndpoint).Methods("GET")
+	userrouter.HandleFunc("/2fa/setup", userController.SetupTwoFactorEndpoint).Methods("POST")
+	userrouter.HandleFunc("/2fa/confirm", userController.ConfirmTwoFactorEndpoint).Methods("POST")
+	userrouter.HandleFunc("/2fa/disable", userController.DisableTwoFactorEndpoint).Methods("POST")
 	userrouter.HandleFunc("/dashboard", userController.DashboardEndpoint).Methods("GET")
+	userrouter.HandleFunc("/me", userController.GetProfileEndpoint).Methods("GET")
+	userrouter.HandleFunc("/me", userController.UpdateProfileEndpoint).Methods("PATCH")
+	userrouter.HandleFunc("/me", userController.DeleteAccountEndpoint).Methods("DELETE")
+	userrouter.HandleFunc("/me/export", userController.ExportDataEndpoint).Methods("GET")
+	userrouter.HandleFunc("/me/erase", userController.EraseDataEndpoint).Methods("POST")
+	userrouter.HandleFunc("/me/password", userController.ChangePasswordEndpoint).Methods("PUT")
+	userrouter.HandleFunc("/me/email/verify", userController.VerifyEmailEndpoint).Methods("POST")
+	userrouter.HandleFunc("/notifications", userController.GetNotificationsEndpoint).Methods("GET")
 	userrouter.HandleFunc("/entry", entriesController.AddEntryEndpoint).Methods("POST")
 	userrouter.HandleFunc("/entry/{id}", entriesController.UpdateEntryEndpoint).Methods("PUT")
 	userrouter.HandleFunc("/entry", entriesController.GetEntriesEndpoint).Methods("GET")
 	userrouter.HandleFunc("/entry/{id}", entriesController.GetEntryEndpoint).Methods("GET")
 	userrouter.HandleFunc("/entry/{id}", entriesController.DeleteEntryEndpoint).Methods("DELETE")
+	userrouter.HandleFunc("/entry/{id}/flag", entriesController.FlagEntryEndpoint).Methods("POST")
+	userrouter.HandleFunc("/entry/{id}/revisions", entriesController.GetEntryRevisionsEndpoint).Methods("GET")
+	userrouter.HandleFunc("/entry/{id}/revisions/diff", entriesController.GetEntryRevisionDiffEndpoint).Methods("GET")
 
 	adminrouter := router.PathPrefix("/admin").Subrouter()
 	adminrouter.Use(adminController.AdminAuthenticationMiddleware)
 
 	adminrouter.HandleFunc("", adminController.CreateUserEndpoint).Methods("POST")
 	adminrouter.HandleFunc("/login", adminController.AdminLoginEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/login/2fa", adminController.TwoFactorLoginEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/2fa/setup", adminController.SetupTwoFactorEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/2fa/confirm", adminController.ConfirmTwoFactorEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/2fa/disable", adminController.DisableTwoFactorEndpoint).Methods("POST")
 	adminrouter.HandleFunc("/users/{id}", adminController.UpdateUserEndpoint).Methods("PUT")
 	adminrouter.HandleFunc("/users", adminController.GetUsersEndpoint).Methods("GET")
 	adminrouter.HandleFunc("/users/{id}", adminController.GetUserEndpoint).Methods("GET")
 	adminrouter.HandleFunc("/users/{id}", adminController.DeleteUserEndpoint).Methods("DELETE")
+	adminrouter.HandleFunc("/users/{id}/export", adminController.ExportUserDataEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/users/{id}/erase", adminController.EraseUserDataEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/unlock", adminController.UnlockUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/suspend", adminController.SuspendUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/ban", adminController.BanUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/shadow-ban", adminController.ShadowBanUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/reinstate", adminController.ReinstateUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/logout", adminController.LogoutUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/users/{id}/impersonate", adminController.ImpersonateUserEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries", adminController.GetAllEntriesEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/entries/import", adminController.ImportEntriesEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries/queue", adminController.GetModerationQueueEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/entries/flagged", adminController.GetFlaggedEntriesEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/entries/{id}/flags", adminController.GetEntryFlagsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/entries/bulk", adminController.BulkModerateEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries/{id}/approve", adminController.ApproveEntryEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries/{id}/reject", adminController.RejectEntryEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries/{id}/hide", adminController.HideEntryEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/entries/{id}/revisions", adminController.GetEntryRevisionsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/entries/{id}/revisions/{version}/rollback", adminController.RollbackEntryEndpoint).Methods("POST")
+	adminrouter.HandleFunc("/audit", adminController.GetAuditLogsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/stats/entries", adminController.GetEntryStatsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/stats/locations", adminController.GetTopLocationsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/stats/users", adminController.GetUserStatsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/stats/resolution", adminController.GetResolutionStatsEndpoint).Methods("GET")
+	adminrouter.HandleFunc("/stats/ranks", adminController.GetRankStatsEndpoint).Methods("GET")
 	adminrouter.HandleFunc("/alert-type", adminController.CreateAlertTypeEndpoint).Methods("POST")
 	adminrouter.HandleFunc("/alert-type/{id}", adminController.UpdateAlertTypeEndpoint).Methods("PUT")
 	adminrouter.HandleFunc("/alert-type", adminController.GetAlertTypesEndpoint).Methods("GET")
 	adminrouter.HandleFunc("/alert-type/{id}", adminController.GetAlertTypeEndpoint).Methods("GET")
 	adminrouter.HandleFunc("/alert-type/{id}", adminController.DeleteAlertTypeEndpoint).Methods("DELETE")
 
-	return handlers.LoggingHandler(os.Stdout, router)
+	return api.RequestIDMiddleware(controllers.ObserveRequests(router))
 }
@@ -0,0 +1,705 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryDatabase is the set of collections a $lookup can read from, by name.
+type memoryDatabase map[string]interface {
+	documents() ([]primitive.M, error)
+}
+
+// stage is one stage of an aggregation pipeline, like $match.
+type stage struct {
+	name string
+	spec interface{}
+}
+
+// parseStages reads a pipeline written as a slice of bson.M. $sort keeps the
+// order of its fields, so it can be written as a primitive.D.
+func parseStages(pipeline interface{}) ([]stage, error) {
+	b, err := bson.Marshal(primitive.M{"pipeline": pipeline})
+	if err != nil {
+		return nil, err
+	}
+	values, err := bson.Raw(b).Lookup("pipeline").Array().Values()
+	if err != nil {
+		return nil, err
+	}
+
+	stages := make([]stage, 0, len(values))
+	for _, value := range values {
+		raw, ok := value.DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("store: a pipeline stage must be a document")
+		}
+		elements, err := raw.Elements()
+		if err != nil {
+			return nil, err
+		}
+		if len(elements) != 1 {
+			return nil, fmt.Errorf("store: a pipeline stage must have one field")
+		}
+
+		s := stage{name: elements[0].Key()}
+		if s.name == "$sort" {
+			var fields primitive.D
+			err = elements[0].Value().Unmarshal(&fields)
+			s.spec = fields
+		} else {
+			var doc primitive.M
+			doc, err = toDocument(raw)
+			s.spec = doc[s.name]
+		}
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, s)
+	}
+	return stages, nil
+}
+
+// aggregate runs the stages over docs. vars are the variables set by a
+// $lookup's let, for $$ references. docs aren't changed.
+func aggregate(db memoryDatabase, docs []primitive.M, stages []stage, vars primitive.M) ([]primitive.M, error) {
+	var err error
+	for _, s := range stages {
+		switch s.name {
+		case "$match":
+			docs, err = matchStage(docs, s.spec, vars)
+		case "$group":
+			docs, err = groupStage(docs, s.spec, vars)
+		case "$project":
+			docs, err = projectStage(docs, s.spec, vars)
+		case "$sort":
+			docs, err = sortStage(docs, s.spec.(primitive.D))
+		case "$skip", "$limit":
+			n, ok := toFloat(s.spec)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("store: %s needs a positive number", s.name)
+			}
+			if int(n) > len(docs) {
+				n = float64(len(docs))
+			}
+			if s.name == "$skip" {
+				docs = docs[int(n):]
+			} else {
+				docs = docs[:int(n)]
+			}
+		case "$unwind":
+			docs, err = unwindStage(docs, s.spec)
+		case "$lookup":
+			docs, err = lookupStage(db, docs, s.spec, vars)
+		case "$count":
+			field, ok := s.spec.(string)
+			if !ok || field == "" {
+				return nil, fmt.Errorf("store: $count needs a field name")
+			}
+			// like MongoDB, counting nothing gives no document at all
+			if len(docs) > 0 {
+				docs = []primitive.M{{field: int32(len(docs))}}
+			}
+		default:
+			return nil, fmt.Errorf("store: %s is not supported", s.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// matchStage filters docs. $expr conditions are worked out with the other
+// fields of each document and vars.
+func matchStage(docs []primitive.M, spec interface{}, vars primitive.M) ([]primitive.M, error) {
+	filter, ok := spec.(primitive.M)
+	if !ok {
+		return nil, fmt.Errorf("store: $match needs a filter")
+	}
+	expr, hasExpr := filter["$expr"]
+	if hasExpr {
+		filter = copyDocument(filter)
+		delete(filter, "$expr")
+	}
+
+	var matched []primitive.M
+	for _, doc := range docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok && hasExpr {
+			value, err := evaluate(doc, expr, vars)
+			if err != nil {
+				return nil, err
+			}
+			ok = isTrue(value)
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+	return matched, nil
+}
+
+// groupStage supports the $sum, $avg, $min, $max, $first, $last, $push and
+// $addToSet accumulators. Groups come out in the order they were first seen.
+func groupStage(docs []primitive.M, spec interface{}, vars primitive.M) ([]primitive.M, error) {
+	fields, ok := spec.(primitive.M)
+	if !ok {
+		return nil, fmt.Errorf("store: $group needs a document")
+	}
+	idExpr, ok := fields["_id"]
+	if !ok {
+		return nil, fmt.Errorf("store: $group needs an _id")
+	}
+
+	var groups []primitive.M
+	// the values each group's $avg has seen
+	averaged := make(map[int]map[string][]float64)
+	for _, doc := range docs {
+		id, err := evaluate(doc, idExpr, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		g := -1
+		for i, group := range groups {
+			if equal(group["_id"], id) {
+				g = i
+				break
+			}
+		}
+		if g == -1 {
+			g = len(groups)
+			groups = append(groups, primitive.M{"_id": id})
+			averaged[g] = make(map[string][]float64)
+		}
+		group := groups[g]
+
+		for field, acc := range fields {
+			if field == "_id" {
+				continue
+			}
+			ops, ok := isOperatorDocument(acc)
+			if !ok || len(ops) != 1 {
+				return nil, fmt.Errorf("store: $group %s needs one accumulator", field)
+			}
+			for op, arg := range ops {
+				value, err := evaluate(doc, arg, vars)
+				if err != nil {
+					return nil, err
+				}
+				current, seen := group[field]
+
+				switch op {
+				case "$sum":
+					if !seen {
+						current = int32(0)
+					}
+					if _, ok := toFloat(value); ok {
+						if current, err = add([]interface{}{current}, value); err != nil {
+							return nil, err
+						}
+					}
+				case "$avg":
+					if n, ok := toFloat(value); ok {
+						averaged[g][field] = append(averaged[g][field], n)
+					}
+					current = nil
+				case "$min", "$max":
+					if value == nil {
+						break
+					}
+					c, ok := compare(value, current)
+					if current == nil || (ok && ((op == "$min" && c < 0) || (op == "$max" && c > 0))) {
+						current = value
+					}
+				case "$first":
+					if !seen {
+						current = value
+					}
+				case "$last":
+					current = value
+				case "$push", "$addToSet":
+					items, _ := current.(primitive.A)
+					if current, err = updateArray(op, items, value); err != nil {
+						return nil, err
+					}
+				default:
+					return nil, fmt.Errorf("store: %s is not supported", op)
+				}
+				group[field] = current
+			}
+		}
+	}
+
+	for g, fields := range averaged {
+		for field, values := range fields {
+			var total float64
+			for _, v := range values {
+				total += v
+			}
+			groups[g][field] = total / float64(len(values))
+		}
+	}
+	return groups, nil
+}
+
+// projectStage either includes the fields set to 1 and those worked out from
+// expressions, or leaves out the fields set to 0. _id is kept unless it is
+// set to 0.
+func projectStage(docs []primitive.M, spec interface{}, vars primitive.M) ([]primitive.M, error) {
+	fields, ok := spec.(primitive.M)
+	if !ok || len(fields) == 0 {
+		return nil, fmt.Errorf("store: $project needs a document")
+	}
+
+	excluding := true
+	for _, value := range fields {
+		if !isExclusion(value) {
+			excluding = false
+		}
+	}
+
+	projected := make([]primitive.M, 0, len(docs))
+	for _, doc := range docs {
+		if excluding {
+			out, err := cloneDocument(doc)
+			if err != nil {
+				return nil, err
+			}
+			for field := range fields {
+				unsetPath(out, field)
+			}
+			projected = append(projected, out)
+			continue
+		}
+
+		out := primitive.M{}
+		if _, ok := fields["_id"]; !ok {
+			out["_id"] = doc["_id"]
+		}
+		for field, value := range fields {
+			switch {
+			case isExclusion(value):
+				if field != "_id" {
+					return nil, fmt.Errorf("store: $project can't leave out %s while including fields", field)
+				}
+			case value == true || equal(value, int32(1)):
+				if values, found := lookup(doc, field); found {
+					setPath(out, field, values[0])
+				}
+			default:
+				v, err := evaluate(doc, value, vars)
+				if err != nil {
+					return nil, err
+				}
+				setPath(out, field, v)
+			}
+		}
+		projected = append(projected, out)
+	}
+	return projected, nil
+}
+
+func isExclusion(value interface{}) bool {
+	return value == false || equal(value, int32(0))
+}
+
+// sortStage sorts by each field in turn, 1 for ascending and -1 for
+// descending.
+func sortStage(docs []primitive.M, fields primitive.D) ([]primitive.M, error) {
+	for _, field := range fields {
+		if !equal(field.Value, int32(1)) && !equal(field.Value, int32(-1)) {
+			return nil, fmt.Errorf("store: $sort %s needs 1 or -1", field.Key)
+		}
+	}
+
+	sorted := append([]primitive.M{}, docs...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		for _, field := range fields {
+			x, _ := lookup(sorted[a], field.Key)
+			y, _ := lookup(sorted[b], field.Key)
+			if equal(field.Value, int32(-1)) {
+				x, y = y, x
+			}
+			if sortsBefore(x, y) {
+				return true
+			}
+			if sortsBefore(y, x) {
+				return false
+			}
+		}
+		return false
+	})
+	return sorted, nil
+}
+
+// unwindStage outputs a document for each item of an array field. The spec
+// is the field's path, or a document with the path and
+// preserveNullAndEmptyArrays.
+func unwindStage(docs []primitive.M, spec interface{}) ([]primitive.M, error) {
+	path, preserve := spec, false
+	if options, ok := spec.(primitive.M); ok {
+		path = options["path"]
+		preserve, _ = options["preserveNullAndEmptyArrays"].(bool)
+	}
+	field, ok := path.(string)
+	if !ok || !strings.HasPrefix(field, "$") {
+		return nil, fmt.Errorf("store: $unwind needs a field path")
+	}
+	field = field[1:]
+
+	var unwound []primitive.M
+	for _, doc := range docs {
+		values, found := lookup(doc, field)
+		var items primitive.A
+		if found {
+			items, ok = values[0].(primitive.A)
+			if !ok && values[0] != nil {
+				// a value that isn't an array is treated as an array of one
+				items = primitive.A{values[0]}
+			}
+		}
+
+		if len(items) == 0 {
+			if preserve {
+				unwound = append(unwound, doc)
+			}
+			continue
+		}
+		for _, item := range items {
+			out, err := cloneDocument(doc)
+			if err != nil {
+				return nil, err
+			}
+			setPath(out, field, item)
+			unwound = append(unwound, out)
+		}
+	}
+	return unwound, nil
+}
+
+// lookupStage joins documents from another collection, either where
+// localField equals foreignField, or by running a pipeline with variables
+// set by let.
+func lookupStage(db memoryDatabase, docs []primitive.M, spec interface{}, vars primitive.M) ([]primitive.M, error) {
+	options, ok := spec.(primitive.M)
+	if !ok {
+		return nil, fmt.Errorf("store: $lookup needs a document")
+	}
+	from, _ := options["from"].(string)
+	as, _ := options["as"].(string)
+	if from == "" || as == "" {
+		return nil, fmt.Errorf("store: $lookup needs from and as")
+	}
+
+	// like MongoDB, a collection that doesn't exist is empty
+	var foreign []primitive.M
+	if c, ok := db[from]; ok {
+		var err error
+		if foreign, err = c.documents(); err != nil {
+			return nil, err
+		}
+	}
+
+	var stages []stage
+	if pipeline, ok := options["pipeline"]; ok {
+		var err error
+		if stages, err = parseStages(pipeline); err != nil {
+			return nil, err
+		}
+	}
+	localField, _ := options["localField"].(string)
+	foreignField, _ := options["foreignField"].(string)
+	if stages == nil && (localField == "" || foreignField == "") {
+		return nil, fmt.Errorf("store: $lookup needs localField and foreignField, or a pipeline")
+	}
+	let, _ := options["let"].(primitive.M)
+
+	joined := make([]primitive.M, 0, len(docs))
+	for _, doc := range docs {
+		var found []primitive.M
+		if stages != nil {
+			docVars := copyDocument(vars)
+			for name, expr := range let {
+				value, err := evaluate(doc, expr, vars)
+				if err != nil {
+					return nil, err
+				}
+				docVars[name] = value
+			}
+			var err error
+			if found, err = aggregate(db, foreign, stages, docVars); err != nil {
+				return nil, err
+			}
+		} else {
+			local, _ := lookup(doc, localField)
+			local = expand(local)
+			if len(local) == 0 {
+				local = []interface{}{nil}
+			}
+			for _, other := range foreign {
+				values, _ := lookup(other, foreignField)
+				for _, v := range local {
+					if equalAny(values, v) {
+						found = append(found, other)
+						break
+					}
+				}
+			}
+		}
+
+		out, err := cloneDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		items := make(primitive.A, len(found))
+		for i, f := range found {
+			items[i] = f
+		}
+		setPath(out, as, items)
+		joined = append(joined, out)
+	}
+	return joined, nil
+}
+
+// evaluate works out an aggregation expression for doc: "$field" paths,
+// "$$variable" references, documents and arrays of expressions, operators and
+// literal values. Missing fields are nil.
+func evaluate(doc primitive.M, expr interface{}, vars primitive.M) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		switch {
+		case strings.HasPrefix(e, "$$"):
+			name, path := e[2:], ""
+			if i := strings.Index(name, "."); i >= 0 {
+				name, path = name[:i], name[i+1:]
+			}
+			value, ok := vars[name]
+			if !ok {
+				return nil, fmt.Errorf("store: $$%s is not defined", name)
+			}
+			if path == "" {
+				return value, nil
+			}
+			d, _ := value.(primitive.M)
+			return fieldValue(d, path), nil
+		case strings.HasPrefix(e, "$"):
+			return fieldValue(doc, e[1:]), nil
+		}
+		return e, nil
+	case primitive.A:
+		values := make(primitive.A, len(e))
+		for i, item := range e {
+			v, err := evaluate(doc, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	case primitive.M:
+		if len(e) == 1 {
+			for op, arg := range e {
+				if strings.HasPrefix(op, "$") {
+					return evaluateOperator(doc, op, arg, vars)
+				}
+			}
+		}
+		out := primitive.M{}
+		for field, item := range e {
+			v, err := evaluate(doc, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[field] = v
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+// fieldValue is the value at a dotted path, with the values from arrays of
+// documents along the way collected into an array.
+func fieldValue(doc primitive.M, path string) interface{} {
+	values, found := lookup(doc, path)
+	switch {
+	case !found:
+		return nil
+	case len(values) == 1:
+		return values[0]
+	}
+	return primitive.A(values)
+}
+
+// evaluateOperator supports the operators the app's pipelines use.
+func evaluateOperator(doc primitive.M, op string, arg interface{}, vars primitive.M) (interface{}, error) {
+	if op == "$literal" {
+		return arg, nil
+	}
+
+	value, err := evaluate(doc, arg, vars)
+	if err != nil {
+		return nil, err
+	}
+	args, _ := value.(primitive.A)
+
+	switch op {
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("store: %s needs two arguments", op)
+		}
+		if op == "$eq" || op == "$ne" {
+			return equal(args[0], args[1]) == (op == "$eq"), nil
+		}
+		c, ok := compare(args[0], args[1])
+		if !ok {
+			return false, nil
+		}
+		return (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0), nil
+	case "$ifNull":
+		for _, v := range args {
+			if v != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	case "$size":
+		items, ok := value.(primitive.A)
+		if !ok {
+			return nil, fmt.Errorf("store: $size needs an array")
+		}
+		return int32(len(items)), nil
+	case "$subtract":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("store: $subtract needs two arguments")
+		}
+		return subtract(args[0], args[1])
+	case "$dateToString":
+		options, _ := value.(primitive.M)
+		format, _ := options["format"].(string)
+		date, ok := options["date"].(primitive.DateTime)
+		if !ok {
+			return nil, nil
+		}
+		return formatDate(format, date.Time().UTC())
+	}
+	return nil, fmt.Errorf("store: %s is not supported", op)
+}
+
+// subtract takes a number or a date from a number or a date. Two dates give
+// the milliseconds between them.
+func subtract(a, b interface{}) (interface{}, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+
+	if x, ok := a.(primitive.DateTime); ok {
+		switch y := b.(type) {
+		case primitive.DateTime:
+			return int64(x) - int64(y), nil
+		default:
+			if n, ok := toFloat(y); ok {
+				return primitive.DateTime(int64(x) - int64(n)), nil
+			}
+		}
+	}
+
+	x, okX := a.(int32)
+	y, okY := b.(int32)
+	if okX && okY {
+		return x - y, nil
+	}
+	if isInteger(a) && isInteger(b) {
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		return int64(x) - int64(y), nil
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return x - y, nil
+		}
+	}
+	return nil, fmt.Errorf("store: $subtract needs numbers or dates")
+}
+
+func isInteger(v interface{}) bool {
+	switch v.(type) {
+	case int32, int64:
+		return true
+	}
+	return false
+}
+
+// formatDate supports the %Y, %m, %d, %H, %M, %S, %G, %V and %% specifiers
+// of $dateToString.
+func formatDate(format string, t time.Time) (string, error) {
+	isoYear, isoWeek := t.ISOWeek()
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("store: $dateToString format ends with %%")
+		}
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'G':
+			fmt.Fprintf(&b, "%04d", isoYear)
+		case 'V':
+			fmt.Fprintf(&b, "%02d", isoWeek)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("store: $dateToString doesn't support %%%c", format[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// isTrue is how $expr reads a value as a condition.
+func isTrue(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	if n, ok := toFloat(v); ok {
+		return n != 0
+	}
+	return true
+}
+
+// copyDocument makes a shallow copy of doc, so fields can be added or
+// removed without changing it.
+func copyDocument(doc primitive.M) primitive.M {
+	out := make(primitive.M, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	return out
+}
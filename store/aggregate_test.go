@@ -0,0 +1,231 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newAggregationStores has two alert types, entries reported by ada and bola
+// over two days, and their users.
+func newAggregationStores(t *testing.T) (Stores, models.User, models.User) {
+	t.Helper()
+	ctx := context.Background()
+	stores := NewMemory()
+
+	flood := models.AlertType{ID: primitive.NewObjectID(), Name: "Flood", Level: 3}
+	fire := models.AlertType{ID: primitive.NewObjectID(), Name: "Fire", Level: 5}
+	if _, err := stores.AlertTypes.InsertMany(ctx, []models.AlertType{flood, fire}); err != nil {
+		t.Fatal(err)
+	}
+
+	ada := models.User{ID: primitive.NewObjectID(), Email: "ada@example.com", Username: "ada", Status: "enabled"}
+	bola := models.User{ID: primitive.NewObjectID(), Email: "bola@example.com", Username: "bola", Status: "enabled"}
+	if _, err := stores.Users.InsertMany(ctx, []models.User{ada, bola}); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := []struct {
+		alertType primitive.ObjectID
+		by        primitive.ObjectID
+		created   time.Time
+		status    string
+	}{
+		{flood.ID, ada.ID, day, "enabled"},
+		{flood.ID, bola.ID, day, "enabled"},
+		{fire.ID, ada.ID, day, "enabled"},
+		{flood.ID, ada.ID, day.AddDate(0, 0, 1), "enabled"},
+		{fire.ID, bola.ID, day.AddDate(0, 0, 1), "deleted"},
+	}
+	for _, e := range entries {
+		entry := *models.GetDefaultEntry()
+		entry.AlertType = e.alertType
+		by := e.by
+		entry.UploadedBy = &by
+		entry.Created = e.created
+		entry.Status = e.status
+		if _, err := stores.Entries.InsertOne(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stores, ada, bola
+}
+
+func TestAggregateLookupAndGroup(t *testing.T) {
+	stores, _, _ := newAggregationStores(t)
+
+	var results []models.EntryStat
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": bson.M{"$ne": "deleted"}}},
+		{"$lookup": bson.M{"from": "alertTypes", "localField": "alertType", "foreignField": "_id", "as": "alertType"}},
+		{"$unwind": "$alertType"},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"period":    bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$created"}},
+				"alertType": "$alertType.name",
+				"level":     "$alertType.level",
+			},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{"_id": 0, "period": "$_id.period", "alertType": "$_id.alertType", "level": "$_id.level", "count": 1}},
+		{"$sort": primitive.D{{Key: "period", Value: 1}, {Key: "level", Value: -1}}},
+	}
+	if err := stores.Entries.Aggregate(context.Background(), pipeline, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []models.EntryStat{
+		{Period: "2024-03-01", AlertType: "Fire", Level: 5, Count: 1},
+		{Period: "2024-03-01", AlertType: "Flood", Level: 3, Count: 2},
+		{Period: "2024-03-02", AlertType: "Flood", Level: 3, Count: 1},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+}
+
+func TestAggregateLookupPipeline(t *testing.T) {
+	stores, ada, _ := newAggregationStores(t)
+
+	// the top alpha's pipeline: the user with the most enabled entries
+	results := []bson.M{}
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": "enabled"}},
+		{"$lookup": bson.M{
+			"from": "entries",
+			"let":  bson.M{"user_id": "$_id"},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$eq": []string{"$uploadedBy", "$$user_id"}}}},
+				{"$match": bson.M{"$expr": bson.M{"$eq": []string{"$status", "enabled"}}}},
+			},
+			"as": "entries",
+		}},
+		{"$unwind": bson.M{"path": "$entries", "preserveNullAndEmptyArrays": false}},
+		{"$group": bson.M{"_id": "$email", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.M{"count": -1}},
+		{"$limit": 1},
+	}
+	if err := stores.Users.Aggregate(context.Background(), pipeline, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("results = %v, want one", results)
+	}
+	// MongoDB sums ints as int32, which the handler relies on
+	if results[0]["_id"] != ada.Email || results[0]["count"] != int32(3) {
+		t.Errorf("results = %v, want ada with 3 entries", results)
+	}
+}
+
+func TestAggregateExpressions(t *testing.T) {
+	stores, _, bola := newAggregationStores(t)
+	ctx := context.Background()
+
+	var reporters []models.PeriodStat
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": "enabled"}},
+		{"$group": bson.M{
+			"_id":       bson.M{"$dateToString": bson.M{"format": "%G-W%V", "date": "$created"}},
+			"reporters": bson.M{"$addToSet": "$uploadedBy"},
+		}},
+		{"$project": bson.M{"_id": 0, "period": "$_id", "count": bson.M{"$size": "$reporters"}}},
+	}
+	if err := stores.Entries.Aggregate(ctx, pipeline, &reporters); err != nil {
+		t.Fatal(err)
+	}
+	if want := []models.PeriodStat{{Period: "2024-W09", Count: 2}}; !reflect.DeepEqual(reporters, want) {
+		t.Errorf("reporters = %+v, want %+v", reporters, want)
+	}
+
+	// one entry was moderated an hour after it was reported
+	moderated := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	update := bson.M{"$set": bson.M{"moderation.moderatedAt": moderated}}
+	if _, err := stores.Entries.UpdateOne(ctx, bson.M{"uploadedBy": bola.ID, "status": "enabled"}, update); err != nil {
+		t.Fatal(err)
+	}
+	waits := []bson.M{}
+	pipeline = []bson.M{
+		{"$match": bson.M{"moderation.moderatedAt": bson.M{"$exists": true}}},
+		{"$project": bson.M{"wait": bson.M{"$subtract": []string{"$moderation.moderatedAt", "$created"}}}},
+	}
+	if err := stores.Entries.Aggregate(ctx, pipeline, &waits); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0]["wait"] != int64(time.Hour/time.Millisecond) {
+		t.Errorf("waits = %v, want an hour in milliseconds", waits)
+	}
+
+	var ranks []models.RankStat
+	pipeline = []bson.M{
+		{"$group": bson.M{"_id": bson.M{"$ifNull": []interface{}{"$ranking.rank", 0}}, "count": bson.M{"$sum": 1}}},
+	}
+	if err := stores.Users.Aggregate(ctx, pipeline, &ranks); err != nil {
+		t.Fatal(err)
+	}
+	if want := []models.RankStat{{Rank: 0, Count: 2}}; !reflect.DeepEqual(ranks, want) {
+		t.Errorf("ranks = %+v, want %+v", ranks, want)
+	}
+}
+
+func TestAggregateCountSkipAndLimit(t *testing.T) {
+	stores, _, _ := newAggregationStores(t)
+	ctx := context.Background()
+
+	counts := []bson.M{}
+	pipeline := []bson.M{{"$match": bson.M{"status": "enabled"}}, {"$count": "n"}}
+	if err := stores.Entries.Aggregate(ctx, pipeline, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[0]["n"] != int32(4) {
+		t.Errorf("counts = %v, want 4", counts)
+	}
+
+	// counting nothing gives nothing, not a count of 0
+	pipeline = []bson.M{{"$match": bson.M{"status": "hidden"}}, {"$count": "n"}}
+	if err := stores.Entries.Aggregate(ctx, pipeline, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("counts = %v, want none", counts)
+	}
+
+	var entries []models.Entry
+	pipeline = []bson.M{{"$sort": bson.M{"created": 1}}, {"$skip": 3}, {"$limit": 5}}
+	if err := stores.Entries.Aggregate(ctx, pipeline, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Created.Day() != 2 {
+		t.Errorf("got %d entries, want the 2 from the second day", len(entries))
+	}
+}
+
+func TestAggregateUnsupported(t *testing.T) {
+	stores := NewMemory()
+	ctx := context.Background()
+	if _, err := stores.Entries.InsertOne(ctx, *models.GetDefaultEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	pipelines := []interface{}{
+		[]bson.M{{"$facet": bson.M{}}},
+		[]bson.M{{"$project": bson.M{"n": bson.M{"$multiply": []int{2, 3}}}}},
+		[]bson.M{{"$group": bson.M{"_id": nil, "n": bson.M{"$stdDevPop": "$level"}}}},
+		[]bson.M{{"$match": bson.M{}, "$limit": 1}},
+	}
+	for _, pipeline := range pipelines {
+		var results []bson.M
+		err := stores.Entries.Aggregate(ctx, pipeline, &results)
+		if err == nil || !strings.HasPrefix(err.Error(), "store: ") {
+			t.Errorf("%v: err = %v, want it to be unsupported", pipeline, err)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewMemory returns empty stores that keep everything in memory, with the
+// same unique indexes as the database.
+//
+// Filters can match fields and dotted paths by value or with $eq, $ne, $in,
+// $nin, $gt, $gte, $lt, $lte, $exists, $type, $regex, $size, $elemMatch and
+// $geoWithin with $centerSphere, and combine them with $and, $or and $nor.
+// Updates can use $set, $unset, $inc, $push, $addToSet and $pull.
+//
+// Aggregations can use the $match, $group, $project, $sort, $skip, $limit,
+// $unwind, $lookup and $count stages. $lookup can join any of the stores by
+// their MongoDB collection names. Expressions can be field paths, $$
+// variables, $eq, $ne, $gt, $gte, $lt, $lte, $ifNull, $size, $subtract,
+// $dateToString and $literal.
+func NewMemory() Stores {
+	db := memoryDatabase{}
+	return Stores{
+		Entries:       newMemoryCollection[models.Entry](db, "entries"),
+		Users:         newMemoryCollection[models.User](db, "users", []string{"email", "isAdmin"}, []string{"username"}),
+		AlertTypes:    newMemoryCollection[models.AlertType](db, "alertTypes"),
+		LoginAttempts: newMemoryCollection[models.LoginAttempt](db, "loginAttempts"),
+		Notifications: newMemoryCollection[models.Notification](db, "notifications"),
+		Flags:         newMemoryCollection[models.Flag](db, "flags", []string{"entry", "reportedBy"}),
+		AuditLogs:     newMemoryCollection[models.AuditLog](db, "auditLogs"),
+		Revisions:     newMemoryCollection[models.EntryRevision](db, "entryRevisions", []string{"entry", "version"}),
+		UsedNonces:    newMemoryCollection[models.UsedNonce](db, "usedNonces"),
+	}
+}
+
+// MemoryCollection returns an empty in-memory Collection. Each of unique is a
+// set of fields no two documents can have the same values for. Like the
+// database's partial indexes, documents missing any of the fields aren't
+// checked. $lookup stages can't see any other collections.
+func MemoryCollection[T any](unique ...[]string) Collection[T] {
+	return &memoryCollection[T]{unique: unique}
+}
+
+// newMemoryCollection returns an empty collection that $lookup stages in db
+// can join by name.
+func newMemoryCollection[T any](db memoryDatabase, name string, unique ...[]string) Collection[T] {
+	c := &memoryCollection[T]{db: db, unique: unique}
+	db[name] = c
+	return c
+}
+
+// memoryCollection keeps documents as BSON documents in the order they were
+// inserted, so they are stored exactly as MongoDB would store them. Stored
+// documents are never changed, only replaced, so they can be read without
+// holding the lock.
+type memoryCollection[T any] struct {
+	mu     sync.RWMutex
+	docs   []primitive.M
+	unique [][]string
+	// the collections $lookup can join, which don't change once made
+	db memoryDatabase
+}
+
+func (m *memoryCollection[T]) InsertOne(ctx context.Context, doc T) (*mongo.InsertOneResult, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.insert(d); err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: d["_id"]}, nil
+}
+
+func (m *memoryCollection[T]) InsertMany(ctx context.Context, docs []T) (*mongo.InsertManyResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := &mongo.InsertManyResult{}
+	failed := make(map[int]error)
+	for i, doc := range docs {
+		d, err := toDocument(doc)
+		if err == nil {
+			err = m.insert(d)
+		}
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		result.InsertedIDs = append(result.InsertedIDs, d["_id"])
+	}
+
+	if len(failed) > 0 {
+		return result, &InsertManyError{Failed: failed}
+	}
+	return result, nil
+}
+
+// insert adds a document, giving it an ID if it doesn't have one. The lock
+// must be held.
+func (m *memoryCollection[T]) insert(doc primitive.M) error {
+	if doc["_id"] == nil {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	if err := m.checkUnique(doc, -1); err != nil {
+		return err
+	}
+	m.docs = append(m.docs, doc)
+	return nil
+}
+
+// checkUnique makes sure doc wouldn't break a unique index if it was stored
+// at index i, or added if i is -1. The lock must be held.
+func (m *memoryCollection[T]) checkUnique(doc primitive.M, i int) error {
+	indexes := append([][]string{{"_id"}}, m.unique...)
+	for j, other := range m.docs {
+		if j == i {
+			continue
+		}
+		for _, fields := range indexes {
+			same := true
+			for _, field := range fields {
+				a, inDoc := lookup(doc, field)
+				b, inOther := lookup(other, field)
+				if !inDoc || !inOther || !equal(a, b) {
+					same = false
+					break
+				}
+			}
+			if same {
+				return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+					Code:    codeDuplicateKey,
+					Message: "E11000 duplicate key error: " + strings.Join(fields, ", "),
+				}}}
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the indexes of the documents matching filter, in the order
+// they should be returned.
+func (m *memoryCollection[T]) match(filter interface{}, opts ...FindOptions) ([]int, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []int
+	for i, doc := range m.docs {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, i)
+		}
+	}
+
+	for _, opt := range opts {
+		if opt.Sort != "" {
+			field, reverse := opt.Sort, false
+			if strings.HasPrefix(field, "-") {
+				field, reverse = field[1:], true
+			}
+			sort.SliceStable(found, func(a, b int) bool {
+				x, _ := lookup(m.docs[found[a]], field)
+				y, _ := lookup(m.docs[found[b]], field)
+				if reverse {
+					return sortsBefore(y, x)
+				}
+				return sortsBefore(x, y)
+			})
+		}
+		if opt.Limit > 0 && int64(len(found)) > opt.Limit {
+			found = found[:opt.Limit]
+		}
+	}
+	return found, nil
+}
+
+// snapshot returns the documents matching filter as they are now.
+func (m *memoryCollection[T]) snapshot(filter interface{}, opts ...FindOptions) ([]primitive.M, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found, err := m.match(filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]primitive.M, len(found))
+	for i, j := range found {
+		docs[i] = m.docs[j]
+	}
+	return docs, nil
+}
+
+func (m *memoryCollection[T]) FindOne(ctx context.Context, filter interface{}) (T, error) {
+	var doc T
+	docs, err := m.snapshot(filter, FindOptions{Limit: 1})
+	if err != nil {
+		return doc, err
+	}
+	if len(docs) == 0 {
+		return doc, mongo.ErrNoDocuments
+	}
+	return fromDocument[T](docs[0])
+}
+
+func (m *memoryCollection[T]) Find(ctx context.Context, filter interface{}, opts ...FindOptions) ([]T, error) {
+	results := []T{}
+	err := m.each(filter, opts, func(doc T) error {
+		results = append(results, doc)
+		return nil
+	})
+	return results, err
+}
+
+func (m *memoryCollection[T]) Each(ctx context.Context, filter interface{}, opts FindOptions, fn func(T) error) error {
+	return m.each(filter, []FindOptions{opts}, fn)
+}
+
+// each doesn't hold the lock while fn runs, so fn can change the collection
+func (m *memoryCollection[T]) each(filter interface{}, opts []FindOptions, fn func(T) error) error {
+	docs, err := m.snapshot(filter, opts...)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		doc, err := fromDocument[T](d)
+		if err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryCollection[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	docs, err := m.snapshot(filter)
+	return int64(len(docs)), err
+}
+
+// update applies an update to the matching documents, up to limit of them if
+// it isn't 0. It returns the updated documents. With upsert, a document is
+// made from the filter and inserted if nothing matches.
+func (m *memoryCollection[T]) update(filter interface{}, update interface{}, limit int64, upsert bool) ([]primitive.M, error) {
+	u, err := toDocument(update)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found, err := m.match(filter, FindOptions{Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 && upsert {
+		doc, err := upsertDocument(filter)
+		if err != nil {
+			return nil, err
+		}
+		if err := applyUpdate(doc, u); err != nil {
+			return nil, err
+		}
+		if err := m.insert(doc); err != nil {
+			return nil, err
+		}
+		return []primitive.M{doc}, nil
+	}
+
+	var updated []primitive.M
+	for _, i := range found {
+		doc, err := cloneDocument(m.docs[i])
+		if err != nil {
+			return updated, err
+		}
+		if err := applyUpdate(doc, u); err != nil {
+			return updated, err
+		}
+		if err := m.checkUnique(doc, i); err != nil {
+			return updated, err
+		}
+		m.docs[i] = doc
+		updated = append(updated, doc)
+	}
+	return updated, nil
+}
+
+func (m *memoryCollection[T]) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	updated, err := m.update(filter, update, 1, false)
+	n := int64(len(updated))
+	return &mongo.UpdateResult{MatchedCount: n, ModifiedCount: n}, err
+}
+
+func (m *memoryCollection[T]) UpdateMany(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	updated, err := m.update(filter, update, 0, false)
+	n := int64(len(updated))
+	return &mongo.UpdateResult{MatchedCount: n, ModifiedCount: n}, err
+}
+
+func (m *memoryCollection[T]) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, upsert bool) (T, error) {
+	var doc T
+	updated, err := m.update(filter, update, 1, upsert)
+	if err != nil {
+		return doc, err
+	}
+	if len(updated) == 0 {
+		return doc, mongo.ErrNoDocuments
+	}
+	return fromDocument[T](updated[0])
+}
+
+func (m *memoryCollection[T]) ReplaceOne(ctx context.Context, filter interface{}, doc interface{}, upsert bool) (*mongo.UpdateResult, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found, err := m.match(filter, FindOptions{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		// like MongoDB, an upserted document gets the ID it was looked up by
+		if d["_id"] == nil {
+			f, err := toDocument(filter)
+			if err != nil {
+				return nil, err
+			}
+			if id, ok := f["_id"]; ok {
+				d["_id"] = id
+			}
+		}
+		if err := m.insert(d); err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: d["_id"]}, nil
+	}
+
+	i := found[0]
+	d["_id"] = m.docs[i]["_id"]
+	if err := m.checkUnique(d, i); err != nil {
+		return nil, err
+	}
+	m.docs[i] = d
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+// delete removes the matching documents, up to limit of them if it isn't 0.
+func (m *memoryCollection[T]) delete(filter interface{}, limit int64) (*mongo.DeleteResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found, err := m.match(filter, FindOptions{Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[int]bool, len(found))
+	for _, i := range found {
+		deleted[i] = true
+	}
+	kept := m.docs[:0:0]
+	for i, doc := range m.docs {
+		if !deleted[i] {
+			kept = append(kept, doc)
+		}
+	}
+	m.docs = kept
+
+	return &mongo.DeleteResult{DeletedCount: int64(len(found))}, nil
+}
+
+func (m *memoryCollection[T]) DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	return m.delete(filter, 1)
+}
+
+func (m *memoryCollection[T]) DeleteMany(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	return m.delete(filter, 0)
+}
+
+func (m *memoryCollection[T]) Aggregate(ctx context.Context, pipeline interface{}, results interface{}) error {
+	stages, err := parseStages(pipeline)
+	if err != nil {
+		return err
+	}
+	docs, err := m.documents()
+	if err != nil {
+		return err
+	}
+	docs, err = aggregate(m.db, docs, stages, primitive.M{})
+	if err != nil {
+		return err
+	}
+
+	// decode the results the way the driver's cursor.All does
+	if docs == nil {
+		docs = []primitive.M{}
+	}
+	b, err := bson.Marshal(primitive.M{"results": docs})
+	if err != nil {
+		return err
+	}
+	return bson.Raw(b).Lookup("results").Unmarshal(results)
+}
+
+// documents returns every document as it is now, for aggregations.
+func (m *memoryCollection[T]) documents() ([]primitive.M, error) {
+	return m.snapshot(nil)
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type testFlag struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty"`
+	Entry      *primitive.ObjectID `bson:"entry,omitempty"`
+	ReportedBy string              `bson:"reportedBy,omitempty"`
+	Weight     int                 `bson:"weight"`
+}
+
+func newFlags() Collection[testFlag] {
+	return MemoryCollection[testFlag]([]string{"entry", "reportedBy"})
+}
+
+func TestMemoryCollectionUnique(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	entry, other := primitive.NewObjectID(), primitive.NewObjectID()
+
+	first := testFlag{ID: primitive.NewObjectID(), Entry: &entry, ReportedBy: "ada"}
+	if _, err := flags.InsertOne(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		flag    testFlag
+		wantDup bool
+	}{
+		{"same fields", testFlag{Entry: &entry, ReportedBy: "ada"}, true},
+		{"same ID", testFlag{ID: first.ID, Entry: &other, ReportedBy: "bola"}, true},
+		{"one field differs", testFlag{Entry: &entry, ReportedBy: "bola"}, false},
+		// like a partial index, documents missing a field aren't checked
+		{"missing a field", testFlag{ReportedBy: "ada"}, false},
+		{"missing it again", testFlag{ReportedBy: "ada"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := flags.InsertOne(ctx, test.flag)
+			if IsDuplicateKey(err) != test.wantDup {
+				t.Errorf("err = %v, want a duplicate key error: %v", err, test.wantDup)
+			}
+			if err != nil && !test.wantDup {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	count, err := flags.Count(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("count = %d, want 4", count)
+	}
+}
+
+func TestMemoryCollectionUniqueOnChange(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	entry := primitive.NewObjectID()
+
+	ada := testFlag{ID: primitive.NewObjectID(), Entry: &entry, ReportedBy: "ada"}
+	bola := testFlag{ID: primitive.NewObjectID(), Entry: &entry, ReportedBy: "bola"}
+	for _, flag := range []testFlag{ada, bola} {
+		if _, err := flags.InsertOne(ctx, flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := flags.UpdateOne(ctx, bson.M{"_id": bola.ID}, bson.M{"$set": bson.M{"reportedBy": "ada"}})
+	if !IsDuplicateKey(err) {
+		t.Errorf("UpdateOne: err = %v, want a duplicate key error", err)
+	}
+
+	_, err = flags.ReplaceOne(ctx, bson.M{"_id": bola.ID}, testFlag{Entry: &entry, ReportedBy: "ada"}, false)
+	if !IsDuplicateKey(err) {
+		t.Errorf("ReplaceOne: err = %v, want a duplicate key error", err)
+	}
+
+	// a document doesn't clash with itself
+	if _, err := flags.UpdateOne(ctx, bson.M{"_id": ada.ID}, bson.M{"$inc": bson.M{"weight": 2}}); err != nil {
+		t.Errorf("UpdateOne: %v", err)
+	}
+
+	found, err := flags.FindOne(ctx, bson.M{"_id": bola.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ReportedBy != "bola" {
+		t.Errorf("reportedBy = %q after failed changes, want bola", found.ReportedBy)
+	}
+}
+
+func TestMemoryCollectionInsertMany(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	entry := primitive.NewObjectID()
+
+	docs := []testFlag{
+		{Entry: &entry, ReportedBy: "ada"},
+		{Entry: &entry, ReportedBy: "bola"},
+		{Entry: &entry, ReportedBy: "ada"},
+		{Entry: &entry, ReportedBy: "chidi"},
+	}
+	result, err := flags.InsertMany(ctx, docs)
+
+	var insertErr *InsertManyError
+	if !errors.As(err, &insertErr) {
+		t.Fatalf("err = %v, want an *InsertManyError", err)
+	}
+	if len(insertErr.Failed) != 1 || !IsDuplicateKey(insertErr.Failed[2]) {
+		t.Errorf("failed = %v, want only the third document, as a duplicate", insertErr.Failed)
+	}
+	if len(result.InsertedIDs) != 3 {
+		t.Errorf("inserted %d documents, want the other 3", len(result.InsertedIDs))
+	}
+}
+
+func TestMemoryCollectionUpdates(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	for i, by := range []string{"ada", "bola", "chidi"} {
+		if _, err := flags.InsertOne(ctx, testFlag{ReportedBy: by, Weight: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := flags.UpdateOne(ctx, bson.M{"weight": bson.M{"$gte": 2}}, bson.M{"$inc": bson.M{"weight": 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchedCount != 1 || result.ModifiedCount != 1 {
+		t.Errorf("UpdateOne: matched %d and modified %d, want 1", result.MatchedCount, result.ModifiedCount)
+	}
+
+	result, err = flags.UpdateMany(ctx, bson.M{"weight": bson.M{"$lt": 10}}, bson.M{"$set": bson.M{"weight": 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ModifiedCount != 2 {
+		t.Errorf("UpdateMany: modified %d, want 2", result.ModifiedCount)
+	}
+
+	result, err = flags.UpdateOne(ctx, bson.M{"reportedBy": "nobody"}, bson.M{"$set": bson.M{"weight": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchedCount != 0 {
+		t.Errorf("UpdateOne: matched %d, want 0", result.MatchedCount)
+	}
+
+	updated, err := flags.FindOneAndUpdate(ctx, bson.M{"reportedBy": "bola"}, bson.M{"$inc": bson.M{"weight": 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Weight != 13 {
+		t.Errorf("FindOneAndUpdate returned weight %d, want 13 as it is after the update", updated.Weight)
+	}
+
+	if _, err := flags.FindOneAndUpdate(ctx, bson.M{"reportedBy": "nobody"}, bson.M{"$inc": bson.M{"weight": 1}}, false); err != mongo.ErrNoDocuments {
+		t.Errorf("FindOneAndUpdate: err = %v, want ErrNoDocuments", err)
+	}
+
+	sorted, err := flags.Find(ctx, bson.M{}, FindOptions{Sort: "-weight", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted) != 2 || sorted[0].ReportedBy != "bola" || sorted[1].Weight != 0 {
+		t.Errorf("Find sorted by -weight = %+v, want bola then a weight of 0", sorted)
+	}
+}
+
+func TestMemoryCollectionReplaceAndDelete(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	id := primitive.NewObjectID()
+
+	result, err := flags.ReplaceOne(ctx, bson.M{"_id": id}, testFlag{ReportedBy: "ada"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UpsertedID != id {
+		t.Errorf("upserted %v, want the ID it was looked up by, %v", result.UpsertedID, id)
+	}
+
+	if _, err := flags.ReplaceOne(ctx, bson.M{"_id": id}, testFlag{ReportedBy: "bola"}, true); err != nil {
+		t.Fatal(err)
+	}
+	found, err := flags.FindOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ReportedBy != "bola" {
+		t.Errorf("reportedBy = %q, want it replaced with bola", found.ReportedBy)
+	}
+
+	deleted, err := flags.DeleteMany(ctx, bson.M{"reportedBy": "bola"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedCount != 1 {
+		t.Errorf("deleted %d, want 1", deleted.DeletedCount)
+	}
+	if _, err := flags.FindOne(ctx, bson.M{"_id": id}); err != mongo.ErrNoDocuments {
+		t.Errorf("FindOne after delete: err = %v, want ErrNoDocuments", err)
+	}
+}
+
+func TestMemoryCollectionUpsert(t *testing.T) {
+	ctx := context.Background()
+	flags := newFlags()
+	id := primitive.NewObjectID()
+	filter := bson.M{"_id": id, "reportedBy": bson.M{"$eq": "ada"}, "weight": bson.M{"$lt": 5}}
+	update := bson.M{"$inc": bson.M{"weight": 2}}
+
+	created, err := flags.FindOneAndUpdate(ctx, filter, update, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only equality conditions make it into the new document
+	if created.ID != id || created.ReportedBy != "ada" || created.Weight != 2 {
+		t.Errorf("upserted %+v, want ada's flag with a weight of 2", created)
+	}
+
+	updated, err := flags.FindOneAndUpdate(ctx, filter, update, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != id || updated.Weight != 4 {
+		t.Errorf("updated %+v, want the same flag with a weight of 4", updated)
+	}
+
+	if count, err := flags.Count(ctx, bson.M{}); err != nil || count != 1 {
+		t.Errorf("count = %d, %v, want 1", count, err)
+	}
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo returns stores backed by the collections of a MongoDB database.
+func NewMongo(database *mongo.Database) Stores {
+	return Stores{
+		Entries:       MongoCollection[models.Entry](database.Collection("entries")),
+		Users:         MongoCollection[models.User](database.Collection("users")),
+		AlertTypes:    MongoCollection[models.AlertType](database.Collection("alertTypes")),
+		LoginAttempts: MongoCollection[models.LoginAttempt](database.Collection("loginAttempts")),
+		Notifications: MongoCollection[models.Notification](database.Collection("notifications")),
+		Flags:         MongoCollection[models.Flag](database.Collection("flags")),
+		AuditLogs:     MongoCollection[models.AuditLog](database.Collection("auditLogs")),
+		Revisions:     MongoCollection[models.EntryRevision](database.Collection("entryRevisions")),
+		UsedNonces:    MongoCollection[models.UsedNonce](database.Collection("usedNonces")),
+	}
+}
+
+// MongoCollection returns a Collection backed by a MongoDB collection.
+func MongoCollection[T any](collection *mongo.Collection) Collection[T] {
+	return mongoCollection[T]{collection}
+}
+
+type mongoCollection[T any] struct {
+	c *mongo.Collection
+}
+
+func (m mongoCollection[T]) InsertOne(ctx context.Context, doc T) (*mongo.InsertOneResult, error) {
+	result, err := m.c.InsertOne(ctx, doc)
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) InsertMany(ctx context.Context, docs []T) (*mongo.InsertManyResult, error) {
+	batch := make([]interface{}, len(docs))
+	for i := range docs {
+		batch[i] = docs[i]
+	}
+
+	result, err := m.c.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+	if bwe, ok := err.(mongo.BulkWriteException); ok && bwe.WriteConcernError == nil {
+		failed := make(map[int]error, len(bwe.WriteErrors))
+		for _, writeErr := range bwe.WriteErrors {
+			failed[writeErr.Index] = writeErr
+		}
+		return result, &InsertManyError{Failed: failed}
+	}
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) FindOne(ctx context.Context, filter interface{}) (T, error) {
+	var doc T
+	err := m.c.FindOne(ctx, filter, options.FindOne().SetMaxTime(maxTime(ctx))).Decode(&doc)
+	return doc, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) Find(ctx context.Context, filter interface{}, opts ...FindOptions) ([]T, error) {
+	// init empty array so we don't send null as json response
+	results := []T{}
+
+	cursor, err := m.c.Find(ctx, filter, findOptions(ctx, opts...))
+	if err != nil {
+		return results, contextError(ctx, err)
+	}
+	err = cursor.All(ctx, &results)
+	return results, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) Each(ctx context.Context, filter interface{}, opts FindOptions, fn func(T) error) error {
+	cursor, err := m.c.Find(ctx, filter, findOptions(ctx, opts))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc T
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return contextError(ctx, cursor.Err())
+}
+
+func findOptions(ctx context.Context, opts ...FindOptions) *options.FindOptions {
+	found := options.Find().SetMaxTime(maxTime(ctx))
+	for _, opt := range opts {
+		if opt.Sort != "" {
+			field, order := opt.Sort, 1
+			if strings.HasPrefix(field, "-") {
+				field, order = field[1:], -1
+			}
+			found.SetSort(primitive.D{{Key: field, Value: order}})
+		}
+		if opt.Limit > 0 {
+			found.SetLimit(opt.Limit)
+		}
+	}
+	return found
+}
+
+func (m mongoCollection[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	count, err := m.c.CountDocuments(ctx, filter, options.Count().SetMaxTime(maxTime(ctx)))
+	return count, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	result, err := m.c.UpdateOne(ctx, filter, update)
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) UpdateMany(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	result, err := m.c.UpdateMany(ctx, filter, update)
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, upsert bool) (T, error) {
+	var doc T
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(upsert).SetMaxTime(maxTime(ctx))
+	err := m.c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&doc)
+	return doc, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) ReplaceOne(ctx context.Context, filter interface{}, doc interface{}, upsert bool) (*mongo.UpdateResult, error) {
+	result, err := m.c.ReplaceOne(ctx, filter, doc, options.Replace().SetUpsert(upsert))
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	result, err := m.c.DeleteOne(ctx, filter)
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) DeleteMany(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	result, err := m.c.DeleteMany(ctx, filter)
+	return result, contextError(ctx, err)
+}
+
+func (m mongoCollection[T]) Aggregate(ctx context.Context, pipeline interface{}, results interface{}) error {
+	cursor, err := m.c.Aggregate(ctx, pipeline, options.Aggregate().SetMaxTime(maxTime(ctx)))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return contextError(ctx, cursor.All(ctx, results))
+}
+
+// maxTime is how long MongoDB gets to run a query before ctx's deadline, so it
+// stops working on queries no one is waiting for any more. Without a
+// deadline there is no limit.
+func maxTime(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if left := time.Until(deadline); left > time.Millisecond {
+		return left
+	}
+	return time.Millisecond
+}
+
+// codeMaxTimeExpired is the code of the error MongoDB returns for queries
+// that ran out of their max time.
+const codeMaxTimeExpired = 50
+
+// contextError makes errors caused by ctx ending match its error, so callers
+// can tell them apart with errors.Is(err, context.DeadlineExceeded). The
+// driver doesn't wrap them itself.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == codeMaxTimeExpired {
+		return fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return err
+}
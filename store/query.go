@@ -0,0 +1,607 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// toDocument converts a struct or map to the BSON document MongoDB would
+// store, so it can be matched against filters.
+func toDocument(v interface{}) (primitive.M, error) {
+	if v == nil {
+		return primitive.M{}, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc primitive.M
+	err = bson.Unmarshal(b, &doc)
+	return doc, err
+}
+
+func fromDocument[T any](doc primitive.M) (T, error) {
+	var v T
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return v, err
+	}
+	err = bson.Unmarshal(b, &v)
+	return v, err
+}
+
+func cloneDocument(doc primitive.M) (primitive.M, error) {
+	return toDocument(doc)
+}
+
+// lookup finds the values at a dotted path. Arrays of documents along the
+// way are looked into, so a path can match more than one value.
+func lookup(doc primitive.M, path string) ([]interface{}, bool) {
+	values := []interface{}{doc}
+	for _, key := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, v := range values {
+			switch v := v.(type) {
+			case primitive.M:
+				if field, ok := v[key]; ok {
+					next = append(next, field)
+				}
+			case primitive.A:
+				for _, item := range v {
+					if item, ok := item.(primitive.M); ok {
+						if field, ok := item[key]; ok {
+							next = append(next, field)
+						}
+					}
+				}
+			}
+		}
+		values = next
+	}
+	return values, len(values) > 0
+}
+
+// expand adds the items of any arrays to values, since a condition on an
+// array field matches if any of its items match.
+func expand(values []interface{}) []interface{} {
+	expanded := values
+	for _, v := range values {
+		if items, ok := v.(primitive.A); ok {
+			expanded = append(expanded, items...)
+		}
+	}
+	return expanded
+}
+
+// matches reports whether a document matches a filter.
+func matches(doc, filter primitive.M) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("store: %s is not supported", key)
+			}
+			values, _ := lookup(doc, key)
+			ok, err = matchValues(values, cond)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc primitive.M, op string, cond interface{}) (bool, error) {
+	filters, ok := cond.(primitive.A)
+	if !ok {
+		return false, fmt.Errorf("store: %s needs an array", op)
+	}
+
+	for _, f := range filters {
+		f, ok := f.(primitive.M)
+		if !ok {
+			return false, fmt.Errorf("store: %s needs an array of filters", op)
+		}
+		ok, err := matches(doc, f)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+func isOperatorDocument(cond interface{}) (primitive.M, bool) {
+	doc, ok := cond.(primitive.M)
+	if !ok || len(doc) == 0 {
+		return nil, false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// matchValues reports whether the values found at a path match a condition.
+func matchValues(values []interface{}, cond interface{}) (bool, error) {
+	ops, ok := isOperatorDocument(cond)
+	if !ok {
+		if re, ok := cond.(primitive.Regex); ok {
+			return matchRegex(values, re.Pattern, re.Options)
+		}
+		return equalAny(values, cond), nil
+	}
+
+	for op, arg := range ops {
+		ok, err := matchOperator(values, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, ops primitive.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return equalAny(values, arg), nil
+	case "$ne":
+		return !equalAny(values, arg), nil
+	case "$in", "$nin":
+		items, ok := arg.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("store: %s needs an array", op)
+		}
+		in := false
+		for _, item := range items {
+			ok, err := matchValues(values, item)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			c, ok := compare(v, arg)
+			if !ok {
+				continue
+			}
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$exists":
+		want, _ := arg.(bool)
+		return (len(values) > 0) == want, nil
+	case "$type":
+		for _, v := range expand(values) {
+			if typeName(v) == arg {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$regex":
+		options, _ := ops["$options"].(string)
+		switch pattern := arg.(type) {
+		case string:
+			return matchRegex(values, pattern, options)
+		case primitive.Regex:
+			return matchRegex(values, pattern.Pattern, pattern.Options+options)
+		}
+		return false, fmt.Errorf("store: $regex needs a pattern")
+	case "$options":
+		// read with $regex
+		return true, nil
+	case "$size":
+		for _, v := range values {
+			if items, ok := v.(primitive.A); ok && equal(int64(len(items)), arg) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		filter, ok := arg.(primitive.M)
+		if !ok {
+			return false, fmt.Errorf("store: $elemMatch needs a filter")
+		}
+		for _, v := range values {
+			items, _ := v.(primitive.A)
+			for _, item := range items {
+				var ok bool
+				var err error
+				if _, isOps := isOperatorDocument(filter); isOps {
+					ok, err = matchValues([]interface{}{item}, filter)
+				} else if doc, isDoc := item.(primitive.M); isDoc {
+					ok, err = matches(doc, filter)
+				}
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+		}
+		return false, nil
+	case "$geoWithin":
+		return matchGeoWithin(values, arg)
+	}
+	return false, fmt.Errorf("store: %s is not supported", op)
+}
+
+func equalAny(values []interface{}, want interface{}) bool {
+	// null matches fields that are missing as well as null
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	for _, v := range expand(values) {
+		if equal(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRegex(values []interface{}, pattern, options string) (bool, error) {
+	flags := ""
+	for _, option := range options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case primitive.ObjectID:
+		return "objectId"
+	case primitive.DateTime:
+		return "date"
+	case primitive.A:
+		return "array"
+	case primitive.M:
+		return "object"
+	}
+	return ""
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two values of the same kind. It returns false if they can't
+// be compared.
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return compare(int64(x), int64(y))
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x != y {
+			if x {
+				return 1, true
+			}
+			return -1, true
+		}
+		if _, ok := b.(bool); ok {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// sortsBefore orders the values found at a sort field. Like MongoDB, missing
+// and null values come first.
+func sortsBefore(a, b []interface{}) bool {
+	if len(a) == 0 || a[0] == nil {
+		return len(b) > 0 && b[0] != nil
+	}
+	if len(b) == 0 || b[0] == nil {
+		return false
+	}
+	c, _ := compare(a[0], b[0])
+	return c < 0
+}
+
+// earthRadius is the radius $centerSphere distances are divided by, in
+// metres
+const earthRadius = 6378100
+
+// matchGeoWithin supports $centerSphere, whose radius is in radians. Points
+// can be GeoJSON or legacy coordinate pairs, longitude first.
+func matchGeoWithin(values []interface{}, arg interface{}) (bool, error) {
+	shape, _ := arg.(primitive.M)
+	sphere, ok := shape["$centerSphere"].(primitive.A)
+	if !ok || len(sphere) != 2 {
+		return false, fmt.Errorf("store: $geoWithin only supports $centerSphere")
+	}
+	center, ok := point(sphere[0])
+	radius, isNumber := toFloat(sphere[1])
+	if !ok || !isNumber {
+		return false, fmt.Errorf("store: $centerSphere needs a point and a radius")
+	}
+
+	for _, v := range values {
+		if p, ok := point(v); ok && angularDistance(center, p) <= radius {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func point(v interface{}) ([2]float64, bool) {
+	if doc, ok := v.(primitive.M); ok {
+		v = doc["coordinates"]
+	}
+	coords, ok := v.(primitive.A)
+	if !ok || len(coords) != 2 {
+		return [2]float64{}, false
+	}
+	x, okX := toFloat(coords[0])
+	y, okY := toFloat(coords[1])
+	return [2]float64{x, y}, okX && okY
+}
+
+// angularDistance is the haversine distance between two points, in radians
+// so it doesn't depend on the radius of the earth.
+func angularDistance(a, b [2]float64) float64 {
+	rad := math.Pi / 180
+	lng1, lat1 := a[0]*rad, a[1]*rad
+	lng2, lat2 := b[0]*rad, b[1]*rad
+
+	h := math.Pow(math.Sin((lat2-lat1)/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lng2-lng1)/2), 2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// upsertDocument makes the document an upsert starts from, out of the
+// fields a filter matches by value or with $eq, like MongoDB does.
+func upsertDocument(filter interface{}) (primitive.M, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := primitive.M{}
+	for path, cond := range f {
+		if strings.HasPrefix(path, "$") {
+			continue
+		}
+		if ops, ok := isOperatorDocument(cond); ok {
+			value, ok := ops["$eq"]
+			if !ok {
+				continue
+			}
+			cond = value
+		}
+		setPath(doc, path, cond)
+	}
+	return doc, nil
+}
+
+// applyUpdate applies an update's operators to a document.
+func applyUpdate(doc, update primitive.M) error {
+	if len(update) == 0 {
+		return fmt.Errorf("store: the update is empty")
+	}
+
+	for op, arg := range update {
+		fields, ok := arg.(primitive.M)
+		if !ok {
+			return fmt.Errorf("store: %s needs a document", op)
+		}
+
+		for path, value := range fields {
+			switch op {
+			case "$set":
+				setPath(doc, path, value)
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc":
+				current, _ := lookup(doc, path)
+				sum, err := add(current, value)
+				if err != nil {
+					return fmt.Errorf("store: $inc %s: %v", path, err)
+				}
+				setPath(doc, path, sum)
+			case "$push", "$addToSet", "$pull":
+				current, found := lookup(doc, path)
+				if !found && op == "$pull" {
+					continue
+				}
+				var items primitive.A
+				if found && current[0] != nil {
+					if items, ok = current[0].(primitive.A); !ok {
+						return fmt.Errorf("store: %s %s: the field is not an array", op, path)
+					}
+				}
+				updated, err := updateArray(op, items, value)
+				if err != nil {
+					return err
+				}
+				setPath(doc, path, updated)
+			default:
+				return fmt.Errorf("store: %s is not supported", op)
+			}
+		}
+	}
+	return nil
+}
+
+func updateArray(op string, items primitive.A, value interface{}) (primitive.A, error) {
+	switch op {
+	case "$push":
+		return append(append(primitive.A{}, items...), value), nil
+	case "$addToSet":
+		for _, item := range items {
+			if equal(item, value) {
+				return items, nil
+			}
+		}
+		return append(append(primitive.A{}, items...), value), nil
+	}
+
+	kept := primitive.A{}
+	for _, item := range items {
+		ok, err := matchValues([]interface{}{item}, value)
+		if doc, isDoc := item.(primitive.M); isDoc {
+			if filter, isFilter := value.(primitive.M); isFilter {
+				if _, isOps := isOperatorDocument(filter); !isOps {
+					ok, err = matches(doc, filter)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+func add(current []interface{}, value interface{}) (interface{}, error) {
+	var base interface{} = int32(0)
+	if len(current) > 0 {
+		base = current[0]
+	}
+
+	switch x := base.(type) {
+	case int32:
+		switch y := value.(type) {
+		case int32:
+			return x + y, nil
+		case int64:
+			return int64(x) + y, nil
+		}
+	case int64:
+		switch y := value.(type) {
+		case int32:
+			return x + int64(y), nil
+		case int64:
+			return x + y, nil
+		}
+	}
+
+	x, okX := toFloat(base)
+	y, okY := toFloat(value)
+	if !okX || !okY {
+		return nil, fmt.Errorf("only numbers can be incremented")
+	}
+	return x + y, nil
+}
+
+func setPath(doc primitive.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(primitive.M)
+		if !ok {
+			next = primitive.M{}
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+func unsetPath(doc primitive.M, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(primitive.M)
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, keys[len(keys)-1])
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// document converts v the way the stores do, so tests can be written with the
+// same bson.M and slices the handlers use.
+func document(t *testing.T, v interface{}) primitive.M {
+	t.Helper()
+	doc, err := toDocument(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+var (
+	created = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	owner   = primitive.NewObjectID()
+)
+
+// testEntry is shaped like a stored entry, with an array of documents and a
+// GeoJSON point in Lagos.
+var testEntry = bson.M{
+	"_id":        primitive.NewObjectID(),
+	"title":      "Flooded road",
+	"status":     "enabled",
+	"level":      3,
+	"score":      int64(12),
+	"rating":     4.5,
+	"hidden":     nil,
+	"created":    created,
+	"owner":      owner,
+	"tags":       []string{"flood", "road"},
+	"location":   bson.M{"type": "Point", "coordinates": []float64{3.3792, 6.5244}},
+	"moderation": bson.M{"state": "new"},
+	"flags": []bson.M{
+		{"by": "ada", "weight": 1},
+		{"by": "bola", "weight": 3},
+	},
+}
+
+func TestMatches(t *testing.T) {
+	doc := document(t, testEntry)
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		want   bool
+	}{
+		{"empty", bson.M{}, true},
+		{"equal", bson.M{"status": "enabled"}, true},
+		{"not equal", bson.M{"status": "deleted"}, false},
+		{"ints and longs", bson.M{"level": int64(3), "score": 12}, true},
+		{"ints and doubles", bson.M{"level": 3.0}, true},
+		{"dotted path", bson.M{"moderation.state": "new"}, true},
+		{"path into an array", bson.M{"flags.by": "bola"}, true},
+		{"array item", bson.M{"tags": "road"}, true},
+		{"whole array", bson.M{"tags": []string{"flood", "road"}}, true},
+		{"object ID", bson.M{"owner": owner}, true},
+		{"time", bson.M{"created": created}, true},
+		{"null matches null", bson.M{"hidden": nil}, true},
+		{"null matches missing", bson.M{"missing": nil}, true},
+		{"null doesn't match a value", bson.M{"status": nil}, false},
+
+		{"$eq", bson.M{"status": bson.M{"$eq": "enabled"}}, true},
+		{"$ne", bson.M{"status": bson.M{"$ne": "enabled"}}, false},
+		{"$ne missing", bson.M{"missing": bson.M{"$ne": "x"}}, true},
+		{"$ne array item", bson.M{"tags": bson.M{"$ne": "flood"}}, false},
+		{"$in", bson.M{"status": bson.M{"$in": []string{"deleted", "enabled"}}}, true},
+		{"$in none", bson.M{"status": bson.M{"$in": []string{"deleted"}}}, false},
+		{"$in array item", bson.M{"tags": bson.M{"$in": []string{"fire", "flood"}}}, true},
+		{"$in regex", bson.M{"title": bson.M{"$in": []interface{}{primitive.Regex{Pattern: "^flood", Options: "i"}}}}, true},
+		{"$nin", bson.M{"status": bson.M{"$nin": []string{"deleted"}}}, true},
+		{"$nin matching", bson.M{"tags": bson.M{"$nin": []string{"road"}}}, false},
+
+		{"$gt", bson.M{"level": bson.M{"$gt": 2}}, true},
+		{"$gt equal", bson.M{"level": bson.M{"$gt": 3}}, false},
+		{"$gte", bson.M{"level": bson.M{"$gte": 3}}, true},
+		{"$lt", bson.M{"rating": bson.M{"$lt": 5}}, true},
+		{"$lte", bson.M{"rating": bson.M{"$lte": 4}}, false},
+		{"range", bson.M{"level": bson.M{"$gt": 1, "$lt": 3}}, false},
+		{"$gt time", bson.M{"created": bson.M{"$gt": created.Add(-time.Hour)}}, true},
+		{"$lt time", bson.M{"created": bson.M{"$lt": created}}, false},
+		{"$gt string", bson.M{"title": bson.M{"$gt": "A"}}, true},
+		{"$gt array item", bson.M{"flags.weight": bson.M{"$gt": 2}}, true},
+		{"$gt another type", bson.M{"title": bson.M{"$gt": 1}}, false},
+		{"$lt missing", bson.M{"missing": bson.M{"$lt": 1}}, false},
+
+		{"$exists", bson.M{"title": bson.M{"$exists": true}}, true},
+		{"$exists null", bson.M{"hidden": bson.M{"$exists": true}}, true},
+		{"$exists missing", bson.M{"missing": bson.M{"$exists": true}}, false},
+		{"not $exists", bson.M{"missing": bson.M{"$exists": false}}, true},
+		{"$type string", bson.M{"title": bson.M{"$type": "string"}}, true},
+		{"$type null", bson.M{"hidden": bson.M{"$type": "null"}}, true},
+		{"$type objectId", bson.M{"owner": bson.M{"$type": "objectId"}}, true},
+		{"$type date", bson.M{"created": bson.M{"$type": "date"}}, true},
+		{"$type wrong", bson.M{"level": bson.M{"$type": "string"}}, false},
+
+		{"$regex", bson.M{"title": bson.M{"$regex": "road$"}}, true},
+		{"$regex case", bson.M{"title": bson.M{"$regex": "^flooded"}}, false},
+		{"$regex $options", bson.M{"title": bson.M{"$regex": "^flooded", "$options": "i"}}, true},
+		{"regex value", bson.M{"title": primitive.Regex{Pattern: "^FLOOD", Options: "i"}}, true},
+		{"$regex array item", bson.M{"tags": bson.M{"$regex": "^ro"}}, true},
+		{"$regex non-string", bson.M{"level": bson.M{"$regex": "3"}}, false},
+
+		{"$size", bson.M{"tags": bson.M{"$size": 2}}, true},
+		{"$size wrong", bson.M{"tags": bson.M{"$size": 1}}, false},
+		{"$size not an array", bson.M{"title": bson.M{"$size": 1}}, false},
+
+		{"$and", bson.M{"$and": []bson.M{{"status": "enabled"}, {"level": 3}}}, true},
+		{"$and one fails", bson.M{"$and": []bson.M{{"status": "enabled"}, {"level": 4}}}, false},
+		{"$or", bson.M{"$or": []bson.M{{"status": "deleted"}, {"level": 3}}}, true},
+		{"$or none", bson.M{"$or": []bson.M{{"status": "deleted"}, {"level": 4}}}, false},
+		{"$nor", bson.M{"$nor": []bson.M{{"status": "deleted"}, {"level": 4}}}, true},
+		{"$nor one matches", bson.M{"$nor": []bson.M{{"status": "deleted"}, {"level": 3}}}, false},
+		{"nested", bson.M{"$or": []bson.M{{"$and": []bson.M{{"level": 3}, {"tags": "fire"}}}, {"title": bson.M{"$exists": false}}}}, false},
+		{"fields and $or", bson.M{"status": "enabled", "$or": []bson.M{{"level": 1}, {"level": 3}}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := matches(doc, document(t, test.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("matches(%v) = %v, want %v", test.filter, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchesElemMatch(t *testing.T) {
+	doc := document(t, testEntry)
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		want   bool
+	}{
+		// both conditions have to hold for the same item, unlike with
+		// dotted paths
+		{"same item", bson.M{"flags": bson.M{"$elemMatch": bson.M{"by": "bola", "weight": 3}}}, true},
+		{"different items", bson.M{"flags": bson.M{"$elemMatch": bson.M{"by": "ada", "weight": 3}}}, false},
+		{"dotted paths on different items", bson.M{"flags.by": "ada", "flags.weight": 3}, true},
+		{"operators", bson.M{"flags": bson.M{"$elemMatch": bson.M{"weight": bson.M{"$gte": 2, "$lt": 4}}}}, true},
+		{"operators on no item", bson.M{"flags": bson.M{"$elemMatch": bson.M{"weight": bson.M{"$gt": 3}}}}, false},
+		{"values", bson.M{"tags": bson.M{"$elemMatch": bson.M{"$regex": "^fl"}}}, true},
+		{"values none", bson.M{"tags": bson.M{"$elemMatch": bson.M{"$in": []string{"fire"}}}}, false},
+		{"not an array", bson.M{"title": bson.M{"$elemMatch": bson.M{"$eq": "Flooded road"}}}, false},
+		{"missing", bson.M{"missing": bson.M{"$elemMatch": bson.M{"by": "ada"}}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := matches(doc, document(t, test.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("matches(%v) = %v, want %v", test.filter, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchesGeoWithin(t *testing.T) {
+	// 6.5244, 3.3792 is Lagos. Ikeja is about 9.1km north of it, and
+	// Ibadan about 114km north east.
+	lagos := []float64{3.3792, 6.5244}
+	ikeja := []float64{3.3515, 6.6018}
+	ibadan := []float64{3.947, 7.3775}
+
+	within := func(center []float64, metres float64) bson.M {
+		return bson.M{"location": bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{center, metres / earthRadius}}}}
+	}
+
+	tests := []struct {
+		name   string
+		point  interface{}
+		filter bson.M
+		want   bool
+	}{
+		{"the center", bson.M{"type": "Point", "coordinates": lagos}, within(lagos, 1), true},
+		{"inside", bson.M{"type": "Point", "coordinates": ikeja}, within(lagos, 10000), true},
+		{"outside", bson.M{"type": "Point", "coordinates": ikeja}, within(lagos, 9000), false},
+		{"far", bson.M{"type": "Point", "coordinates": ibadan}, within(lagos, 100000), false},
+		{"far inside", bson.M{"type": "Point", "coordinates": ibadan}, within(lagos, 120000), true},
+		{"legacy pair", ikeja, within(lagos, 10000), true},
+		{"no point", "Lagos", within(lagos, 10000), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := document(t, bson.M{"location": test.point})
+			got, err := matches(doc, document(t, test.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// the distance to Ikeja, to check the radius is measured in radians
+	distance := angularDistance([2]float64{lagos[0], lagos[1]}, [2]float64{ikeja[0], ikeja[1]}) * earthRadius
+	if distance < 9000 || distance > 9300 {
+		t.Errorf("Lagos to Ikeja is %.0fm, want about 9100m", distance)
+	}
+}
+
+func TestMatchesUnsupported(t *testing.T) {
+	doc := document(t, testEntry)
+
+	for _, filter := range []bson.M{
+		{"$where": "true"},
+		{"title": bson.M{"$not": bson.M{"$eq": "x"}}},
+		{"location": bson.M{"$geoWithin": bson.M{"$box": []interface{}{}}}},
+		{"$or": bson.M{"title": "x"}},
+		{"title": bson.M{"$in": "x"}},
+		{"title": bson.M{"$regex": "("}},
+	} {
+		if _, err := matches(doc, document(t, filter)); err == nil {
+			t.Errorf("matches(%v) didn't return an error", filter)
+		}
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    bson.M
+		update bson.M
+		want   bson.M
+	}{
+		{
+			"$set",
+			bson.M{"a": 1, "b": "x"},
+			bson.M{"$set": bson.M{"b": "y", "c": true}},
+			bson.M{"a": 1, "b": "y", "c": true},
+		},
+		{
+			"$set dotted path",
+			bson.M{"moderation": bson.M{"state": "new", "by": "ada"}},
+			bson.M{"$set": bson.M{"moderation.state": "approved", "twoFactor.enabled": true}},
+			bson.M{"moderation": bson.M{"state": "approved", "by": "ada"}, "twoFactor": bson.M{"enabled": true}},
+		},
+		{
+			"$unset",
+			bson.M{"a": 1, "b": bson.M{"c": 1, "d": 2}},
+			bson.M{"$unset": bson.M{"a": "", "b.c": "", "missing": "", "missing.path": ""}},
+			bson.M{"b": bson.M{"d": 2}},
+		},
+		{
+			"$inc",
+			bson.M{"int": 1, "long": int64(10), "double": 1.5},
+			bson.M{"$inc": bson.M{"int": 2, "long": -1, "double": 1, "missing": 4}},
+			bson.M{"int": 3, "long": int64(9), "double": 2.5, "missing": 4},
+		},
+		{
+			"$push",
+			bson.M{"tags": []string{"a"}},
+			bson.M{"$push": bson.M{"tags": "a", "new": "b"}},
+			bson.M{"tags": []string{"a", "a"}, "new": []string{"b"}},
+		},
+		{
+			"$push to null",
+			bson.M{"tags": nil},
+			bson.M{"$push": bson.M{"tags": "a"}},
+			bson.M{"tags": []string{"a"}},
+		},
+		{
+			"$addToSet",
+			bson.M{"tags": []string{"a"}},
+			bson.M{"$addToSet": bson.M{"tags": "a", "new": "b"}},
+			bson.M{"tags": []string{"a"}, "new": []string{"b"}},
+		},
+		{
+			"$pull value",
+			bson.M{"codes": []string{"a", "b", "a"}},
+			bson.M{"$pull": bson.M{"codes": "a", "missing": "a"}},
+			bson.M{"codes": []string{"b"}},
+		},
+		{
+			"$pull condition",
+			bson.M{"levels": []int{1, 2, 3, 4}},
+			bson.M{"$pull": bson.M{"levels": bson.M{"$gte": 3}}},
+			bson.M{"levels": []int{1, 2}},
+		},
+		{
+			"$pull documents",
+			bson.M{"flags": []bson.M{{"by": "ada", "weight": 1}, {"by": "bola", "weight": 3}}},
+			bson.M{"$pull": bson.M{"flags": bson.M{"by": "ada"}}},
+			bson.M{"flags": []bson.M{{"by": "bola", "weight": 3}}},
+		},
+		{
+			"several operators",
+			bson.M{"a": 1, "b": 2},
+			bson.M{"$set": bson.M{"a": 5}, "$unset": bson.M{"b": ""}, "$inc": bson.M{"c": 1}},
+			bson.M{"a": 5, "c": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := document(t, test.doc)
+			if err := applyUpdate(doc, document(t, test.update)); err != nil {
+				t.Fatal(err)
+			}
+			if want := document(t, test.want); !reflect.DeepEqual(doc, want) {
+				t.Errorf("got %v, want %v", doc, want)
+			}
+		})
+	}
+}
+
+func TestApplyUpdateErrors(t *testing.T) {
+	doc := bson.M{"title": "x", "level": 1}
+
+	for _, update := range []bson.M{
+		{},
+		{"$rename": bson.M{"title": "name"}},
+		{"$set": "title"},
+		{"$inc": bson.M{"title": 1}},
+		{"$inc": bson.M{"level": "1"}},
+		{"$push": bson.M{"title": "x"}},
+		{"$pull": bson.M{"title": "x"}},
+		{"title": "replacement"},
+	} {
+		if err := applyUpdate(document(t, doc), document(t, update)); err == nil {
+			t.Errorf("applyUpdate(%v) didn't return an error", update)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package store is where the app keeps its data. Every collection is behind
+// the Collection interface, with a MongoDB implementation for the app and an
+// in-memory one for running the API without a database, e.g. in tests.
+//
+// Filters and updates are written the same way for both, as MongoDB queries.
+// The in-memory store understands the parts of the query language the app
+// uses, listed on NewMemory.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OpeOnikute/mrkt-api/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Collection is a collection of documents of type T. Methods that look up a
+// single document return mongo.ErrNoDocuments when nothing matches.
+type Collection[T any] interface {
+	InsertOne(ctx context.Context, doc T) (*mongo.InsertOneResult, error)
+	// InsertMany saves as many of the documents as it can. If any fail, the
+	// error is an *InsertManyError saying which.
+	InsertMany(ctx context.Context, docs []T) (*mongo.InsertManyResult, error)
+
+	FindOne(ctx context.Context, filter interface{}) (T, error)
+	Find(ctx context.Context, filter interface{}, opts ...FindOptions) ([]T, error)
+	// Each calls fn with every matching document in turn, without loading
+	// them all at once. It stops at the first error fn returns.
+	Each(ctx context.Context, filter interface{}, opts FindOptions, fn func(T) error) error
+	Count(ctx context.Context, filter interface{}) (int64, error)
+
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error)
+	// FindOneAndUpdate returns the document as it is after the update. With
+	// upsert, a document made from the filter's equality conditions is
+	// updated and inserted if nothing matches.
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, upsert bool) (T, error)
+	// ReplaceOne replaces the first matching document with doc, which can be
+	// a T or a partial document like a bson.M. With upsert, doc is inserted
+	// if nothing matches.
+	ReplaceOne(ctx context.Context, filter interface{}, doc interface{}, upsert bool) (*mongo.UpdateResult, error)
+
+	DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error)
+
+	// Aggregate runs a pipeline and decodes every result into results, which
+	// must be a pointer to a slice.
+	Aggregate(ctx context.Context, pipeline interface{}, results interface{}) error
+}
+
+// FindOptions orders and limits what Find returns.
+type FindOptions struct {
+	// Sort is the field to sort by, or -field to sort by it in reverse.
+	Sort  string
+	Limit int64
+}
+
+// InsertManyError says which documents InsertMany couldn't save, by their
+// index in the slice it was given.
+type InsertManyError struct {
+	Failed map[int]error
+}
+
+func (e *InsertManyError) Error() string {
+	return fmt.Sprintf("store: %d documents could not be saved", len(e.Failed))
+}
+
+// codeDuplicateKey is the code of the error MongoDB returns for documents
+// that break a unique index.
+const codeDuplicateKey = 11000
+
+// IsDuplicateKey reports whether err is from a document breaking a unique
+// index, with either store.
+func IsDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == codeDuplicateKey {
+				return true
+			}
+		}
+	}
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == codeDuplicateKey
+}
+
+// Stores holds every collection the app uses.
+type Stores struct {
+	Entries       Collection[models.Entry]
+	Users         Collection[models.User]
+	AlertTypes    Collection[models.AlertType]
+	LoginAttempts Collection[models.LoginAttempt]
+	Notifications Collection[models.Notification]
+	Flags         Collection[models.Flag]
+	AuditLogs     Collection[models.AuditLog]
+	Revisions     Collection[models.EntryRevision]
+	UsedNonces    Collection[models.UsedNonce]
+}
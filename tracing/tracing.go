@@ -0,0 +1,69 @@
+// Package tracing sets up OpenTelemetry tracing. Trace context is read from
+// and passed on in W3C traceparent headers, and spans are exported over OTLP.
+package tracing
+
+import (
+	"context"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/OpeOnikute/mrkt-api"
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Configure exports spans to the OTLP endpoint in cfg. Without one, nothing
+// is recorded. It returns a function that sends any spans left and stops.
+func Configure(cfg config.TracingConfig) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return Start(exporter, cfg).Shutdown, nil
+}
+
+// Start makes spans be exported to exporter, which can be a
+// tracetest.InMemoryExporter in tests. Spans are exported in batches, so call
+// ForceFlush on the provider before reading them.
+func Start(exporter sdktrace.SpanExporter, cfg config.TracingConfig) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+		// traces started by other services are sampled the way they decided
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Tracer is what the API starts its spans with.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// End ends a span, marking it as failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,161 @@
+package tracing_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpeOnikute/mrkt-api/config"
+	"github.com/OpeOnikute/mrkt-api/controllers"
+	"github.com/OpeOnikute/mrkt-api/db"
+	"github.com/OpeOnikute/mrkt-api/handlers"
+	"github.com/OpeOnikute/mrkt-api/store"
+	"github.com/OpeOnikute/mrkt-api/tracing"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID  = "00f067aa0ba902b7"
+)
+
+// geocoderTransport answers the Google geocoder's requests.
+type geocoderTransport struct{}
+
+func (geocoderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := `{"status": "OK", "results": [{"formatted_address": "1 Broad Street, Lagos"}]}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestRequestSpans(t *testing.T) {
+	cfg := config.Default()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.Start(exporter, cfg.Tracing)
+	defer provider.Shutdown(context.Background())
+
+	h := handlers.New(cfg, store.NewMemory())
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = geocoderTransport{}
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	// a handler that runs two MongoDB commands, one of which fails, then
+	// geocodes, the way creating an entry does
+	monitor := db.CommandMonitor()
+	router := mux.NewRouter()
+	router.HandleFunc("/entry/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		for i, name := range []string{"find", "update"} {
+			command, err := bson.Marshal(bson.D{{Key: name, Value: "entries"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			requestID := int64(i + 1)
+			monitor.Started(ctx, &event.CommandStartedEvent{Command: command, DatabaseName: "mrkt", CommandName: name, RequestID: requestID})
+
+			finished := event.CommandFinishedEvent{CommandName: name, RequestID: requestID, DurationNanos: 1000}
+			if name == "find" {
+				monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finished})
+			} else {
+				monitor.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: finished, Failure: "E11000 duplicate key error"})
+			}
+		}
+
+		if _, err := h.GetAddressFromCoordinates(ctx, 6.5244, 3.3792); err != nil {
+			t.Errorf("GetAddressFromCoordinates: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	request := httptest.NewRequest("PUT", "/entry/123", nil)
+	request.Header.Set("traceparent", "00-"+parentTraceID+"-"+parentSpanID+"-01")
+	recorder := httptest.NewRecorder()
+	controllers.NewAPI(cfg, h).RequestIDMiddleware(controllers.ObserveRequests(router)).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", recorder.Code)
+	}
+
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	if len(spans) != 4 {
+		t.Errorf("got spans %v, want 4", spans)
+	}
+
+	server, ok := spans["PUT /entry/{id}"]
+	if !ok {
+		t.Fatalf("no server span named after the route in %v", spans)
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span kind = %v", server.SpanKind)
+	}
+	if got := server.SpanContext.TraceID().String(); got != parentTraceID {
+		t.Errorf("server span trace ID = %s, want the caller's, %s", got, parentTraceID)
+	}
+	if got := server.Parent.SpanID().String(); got != parentSpanID || !server.Parent.IsRemote() {
+		t.Errorf("server span parent = %s, want the caller's span, %s", got, parentSpanID)
+	}
+	checkAttributes(t, server, semconv.HTTPRoute("/entry/{id}"), semconv.HTTPResponseStatusCode(http.StatusNoContent))
+
+	children := []struct {
+		name       string
+		status     codes.Code
+		attributes []attribute.KeyValue
+	}{
+		{"find mrkt.entries", codes.Unset, []attribute.KeyValue{
+			semconv.DBSystemMongoDB, semconv.DBName("mrkt"), semconv.DBOperation("find"), semconv.DBMongoDBCollection("entries"),
+		}},
+		{"update mrkt.entries", codes.Error, []attribute.KeyValue{semconv.DBOperation("update")}},
+		{"geocoder.ReverseGeocode", codes.Unset, nil},
+	}
+	for _, child := range children {
+		span, ok := spans[child.name]
+		if !ok {
+			t.Errorf("no %s span in %v", child.name, spans)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%s span isn't a child of the server span", child.name)
+		}
+		if span.SpanKind != trace.SpanKindClient {
+			t.Errorf("%s span kind = %v, want client", child.name, span.SpanKind)
+		}
+		if span.Status.Code != child.status {
+			t.Errorf("%s span status = %v, want %v", child.name, span.Status.Code, child.status)
+		}
+		checkAttributes(t, span, child.attributes...)
+	}
+}
+
+func checkAttributes(t *testing.T, span tracetest.SpanStub, want ...attribute.KeyValue) {
+	t.Helper()
+
+	got := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		got[kv.Key] = kv.Value
+	}
+	for _, kv := range want {
+		if got[kv.Key] != kv.Value {
+			t.Errorf("%s span %s = %v, want %v", span.Name, kv.Key, got[kv.Key].Emit(), kv.Value.Emit())
+		}
+	}
+}